@@ -15,8 +15,11 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -38,6 +41,10 @@ type envInfo struct {
 	RedisAddress     string `envconfig:"REDIS_ADDRESS"`
 	RequestSizeLimit int64  `envconfig:"REQUEST_SIZE_LIMIT"`
 	TlsCert          string `envconfig:"TLS_CERT"`
+
+	// File with the signing key of the controller, mounted from the gateway signing Secret.
+	// Requests without a valid signature are rejected when set.
+	GatewaySigningKeyFile string `envconfig:"GATEWAY_SIGNING_KEY_FILE"`
 }
 
 type requestData struct {
@@ -63,6 +70,7 @@ type TLSConfig struct {
 var env envInfo
 var rc redisInterface
 var now = time.Now
+var signingKey []byte
 
 func main() {
 	// Get env info for queue.
@@ -73,6 +81,16 @@ func main() {
 
 	rc = setUpRedis()
 
+	if env.GatewaySigningKeyFile != "" {
+		signingKey, err = ioutil.ReadFile(env.GatewaySigningKeyFile)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if len(signingKey) == 0 {
+			log.Fatal("The gateway signing key file is empty")
+		}
+	}
+
 	// Start an HTTP Server,
 	http.HandleFunc("/", handleRequest)
 	log.Fatal(http.ListenAndServe(":8080", nil))
@@ -112,6 +130,11 @@ func setUpRedis() redisInterface {
 
 // Handle requests coming to producer service by error checking and writing to storage.
 func handleRequest(w http.ResponseWriter, r *http.Request) {
+	if !validSignature(r) {
+		log.Println("Rejecting request without a valid gateway signature")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	// Check that body length doesn't exceed limit.
 	r.Body = http.MaxBytesReader(w, r.Body, env.RequestSizeLimit)
 	// read the request body
@@ -154,6 +177,20 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// Check the signature set by the gateway on the original host, if a signing key is configured.
+func validSignature(r *http.Request) bool {
+	if len(signingKey) == 0 {
+		return true
+	}
+	signature, err := hex.DecodeString(r.Header.Get("Async-Gateway-Signature"))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(r.Header.Get("Async-Original-Host")))
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
 // Function to write to Redis stream.
 func (mr *myRedis) write(ctx context.Context, s envInfo, reqJSON []byte, id string) (err error) {
 	strCMD := mr.client.XAdd(ctx, &redis.XAddArgs{
@@ -14,6 +14,9 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -134,6 +137,60 @@ func TestHandleRequest(t *testing.T) {
 	}
 }
 
+func TestGatewaySignature(t *testing.T) {
+	setupFakeRedis()
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("testing.default.svc.cluster.local"))
+	signature := hex.EncodeToString(mac.Sum(nil))
+	defer func() { signingKey = nil }()
+
+	tests := []struct {
+		name       string
+		key        string
+		signature  string
+		returncode int
+	}{{
+		name:       "no signing key",
+		returncode: http.StatusAccepted,
+	}, {
+		name:       "valid signature",
+		key:        "secret",
+		signature:  signature,
+		returncode: http.StatusAccepted,
+	}, {
+		name:       "missing signature",
+		key:        "secret",
+		returncode: http.StatusForbidden,
+	}, {
+		name:       "signature with another key",
+		key:        "other",
+		signature:  signature,
+		returncode: http.StatusForbidden,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env = envInfo{
+				StreamName:       "mystream",
+				RedisAddress:     "address",
+				RequestSizeLimit: 25,
+			}
+			signingKey = []byte(test.key)
+			request := httptest.NewRequest(http.MethodGet, "http://async-producer", nil)
+			request.Header.Set("Async-Original-Host", "testing.default.svc.cluster.local")
+			if test.signature != "" {
+				request.Header.Set("Async-Gateway-Signature", test.signature)
+			}
+
+			rr := httptest.NewRecorder()
+			handleRequest(rr, request)
+
+			if got, want := rr.Code, test.returncode; got != want {
+				t.Errorf("got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
 func setupFakeRedis() {
 	// set up redis client
 	opts := &redis.UniversalOptions{
@@ -7,6 +7,7 @@ require (
 	github.com/cloudevents/sdk-go/v2 v2.2.0
 	github.com/go-redis/redis/v8 v8.0.0-beta.7
 	github.com/kelseyhightower/envconfig v1.4.0
+	go.opencensus.io v0.23.0
 	k8s.io/api v0.20.7
 	k8s.io/apimachinery v0.20.7
 	k8s.io/client-go v0.20.7
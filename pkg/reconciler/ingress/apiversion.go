@@ -0,0 +1,57 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/discovery"
+	"knative.dev/networking/pkg/apis/networking"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+// supportedIngressVersions lists the Knative ingress API versions the reconciler handles,
+// in order of preference. Knative networking only defines v1alpha1, so the reconciler
+// works on the v1alpha1 types directly and has no internal representation of its own: an
+// abstraction over a single version would only guess at the next one. Supporting a new
+// version takes its informers and a conversion to the v1alpha1 types, the detected version
+// is only logged until then.
+var supportedIngressVersions = []string{v1alpha1.SchemeGroupVersion.Version}
+
+// ingressVersion returns the most preferred supported version of the Knative ingress API
+// served by the cluster.
+func ingressVersion(client discovery.DiscoveryInterface) (string, error) {
+	groups, err := client.ServerGroups()
+	if err != nil {
+		return "", err
+	}
+	for _, group := range groups.Groups {
+		if group.Name != networking.GroupName {
+			continue
+		}
+		served := sets.NewString()
+		for _, version := range group.Versions {
+			served.Insert(version.Version)
+		}
+		for _, version := range supportedIngressVersions {
+			if served.Has(version) {
+				return version, nil
+			}
+		}
+		return "", fmt.Errorf("the cluster serves versions %v of %s, the supported versions are %v",
+			served.List(), networking.GroupName, supportedIngressVersions)
+	}
+	return "", fmt.Errorf("the cluster doesn't serve the API group %s", networking.GroupName)
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	ktesting "k8s.io/client-go/testing"
+	"knative.dev/networking/pkg/apis/networking"
+)
+
+func TestIngressVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		served  []string
+		want    string
+		wantErr bool
+	}{{
+		name:   "v1alpha1",
+		served: []string{networking.GroupName + "/v1alpha1"},
+		want:   "v1alpha1",
+	}, {
+		name:   "v1alpha1 next to a newer version",
+		served: []string{networking.GroupName + "/v1beta1", networking.GroupName + "/v1alpha1"},
+		want:   "v1alpha1",
+	}, {
+		name:    "only unsupported versions",
+		served:  []string{networking.GroupName + "/v1beta1"},
+		wantErr: true,
+	}, {
+		name:    "group not served",
+		served:  []string{"serving.knative.dev/v1"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakediscovery.FakeDiscovery{Fake: &ktesting.Fake{}}
+			for _, gv := range test.served {
+				client.Resources = append(client.Resources, &metav1.APIResourceList{
+					GroupVersion: gv,
+					APIResources: []metav1.APIResource{{Name: "ingresses"}},
+				})
+			}
+			got, err := ingressVersion(client)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ingressVersion() = %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("ingressVersion() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/apis"
+)
+
+// The condition types set on the source ingresses besides the ones of the Knative
+// ingress condition set. The condition set of Knative ingresses is fixed, so these
+// conditions never affect the Ready condition.
+const (
+	// asyncModeOverriddenCondition is set on ingresses whose mode is overridden by the policy.
+	asyncModeOverriddenCondition apis.ConditionType = "AsyncModeOverridden"
+
+	// tooManyPathsCondition is set on ingresses whose generated ingress has more paths
+	// than the configured limit.
+	tooManyPathsCondition apis.ConditionType = "TooManyPaths"
+
+	// defaultLoadBalancerCondition is set on ingresses whose ingress class has no known
+	// load balancers, their status points to the Kourier load balancers.
+	defaultLoadBalancerCondition apis.ConditionType = "DefaultLoadBalancer"
+
+	// routesGeneratedCondition reports the number of async and sync paths of the generated
+	// ingress when ReportGeneratedRoutes is enabled.
+	routesGeneratedCondition apis.ConditionType = "RoutesGenerated"
+)
+
+// The condition types of the reconcile steps of the source ingresses, set when
+// ReportConditions is enabled. They never affect the Ready condition either.
+const (
+	// annotationValidCondition reports whether the async annotations of the ingress are valid.
+	annotationValidCondition apis.ConditionType = "AnnotationValid"
+
+	// producerReadyCondition reports whether the producers of the ingress are ready.
+	producerReadyCondition apis.ConditionType = "ProducerReady"
+
+	// childIngressReadyCondition mirrors the Ready condition of the generated ingress.
+	childIngressReadyCondition apis.ConditionType = "ChildIngressReady"
+
+	// serviceReadyCondition reports whether the producer services of the ingress were generated.
+	serviceReadyCondition apis.ConditionType = "ServiceReady"
+)
+
+// The reasons of the conditions set by the reconciler.
+const (
+	producerLoopReason        = "ProducerLoop"
+	invalidHostnameReason     = "InvalidHostname"
+	namespacePolicyReason     = "NamespacePolicy"
+	producerNotReadyReason    = "ProducerNotReady"
+	producerUnhealthyReason   = "ProducerUnhealthy"
+	tooManyPathsReason        = "TooManyPaths"
+	unknownIngressClassReason = "UnknownIngressClass"
+	routesGeneratedReason     = "RoutesGenerated"
+	serviceConflictReason     = "ServiceConflict"
+	ingressRejectedReason     = "IngressRejected"
+	crossNamespaceReason      = "CrossNamespaceBackend"
+	invalidSplitsReason       = "InvalidSplits"
+	producerRouteReason       = "ProducerRouteNotFound"
+	producerMissingReason     = "ProducerServiceNotFound"
+	invalidAnnotationReason   = "InvalidAnnotation"
+	childNotReadyReason       = "ChildIngressNotReady"
+	signingSecretReason       = "GatewaySigningSecretNotFound"
+)
+
+// ingressConditions manages the conditions of a source ingress.
+type ingressConditions struct {
+	apis.ConditionManager
+	status *v1alpha1.IngressStatus
+
+	// reportSteps sets the conditions of the reconcile steps.
+	reportSteps bool
+}
+
+// conditionsOf returns the condition manager of the status of the ingress.
+func conditionsOf(ing *v1alpha1.Ingress) ingressConditions {
+	return ingressConditions{ConditionManager: ing.GetConditionSet().Manage(&ing.Status), status: &ing.Status}
+}
+
+// conditionsFor returns the condition manager of the status of the ingress, which also
+// sets the conditions of the reconcile steps if the configuration reports them.
+func conditionsFor(ing *v1alpha1.Ingress, cfg *Config) ingressConditions {
+	c := conditionsOf(ing)
+	c.reportSteps = cfg.ReportConditions
+	return c
+}
+
+// markReady marks the ingress ready behind the given load balancers.
+func (c ingressConditions) markReady(public, private []v1alpha1.LoadBalancerIngressStatus) {
+	c.status.MarkLoadBalancerReady(public, private)
+	c.status.MarkNetworkConfigured()
+}
+
+// markNotConfigured marks the network of the ingress as not configured, when its routes
+// can't be generated.
+func (c ingressConditions) markNotConfigured(reason, message string) {
+	c.MarkFalse(v1alpha1.IngressConditionNetworkConfigured, reason, "%s", message)
+}
+
+// markWaitingForProducer marks the load balancer of the ingress as not ready yet, while
+// the producer is not ready.
+func (c ingressConditions) markWaitingForProducer(reason, message string) {
+	c.MarkUnknown(v1alpha1.IngressConditionLoadBalancerReady, reason, "%s", message)
+	c.markStep(producerReadyCondition, corev1.ConditionUnknown, reason, message)
+}
+
+// markStep sets the condition of a reconcile step, if they are reported.
+func (c ingressConditions) markStep(t apis.ConditionType, status corev1.ConditionStatus, reason, message string) {
+	if !c.reportSteps {
+		return
+	}
+	c.SetCondition(apis.Condition{
+		Type:     t,
+		Status:   status,
+		Severity: apis.ConditionSeverityInfo,
+		Reason:   reason,
+		Message:  message,
+	})
+}
+
+// markChildIngress mirrors the Ready condition of the generated ingress, which is Unknown
+// until the networking layer reconciled it.
+func (c ingressConditions) markChildIngress(child *v1alpha1.Ingress) {
+	ready := child.Status.GetCondition(v1alpha1.IngressConditionReady)
+	switch {
+	case ready.IsTrue():
+		c.markStep(childIngressReadyCondition, corev1.ConditionTrue, "", "")
+	case ready != nil && ready.Reason != "":
+		c.markStep(childIngressReadyCondition, ready.Status, ready.Reason, ready.Message)
+	default:
+		c.markStep(childIngressReadyCondition, corev1.ConditionUnknown, childNotReadyReason,
+			fmt.Sprintf("Waiting for the generated ingress %s to be ready", child.Name))
+	}
+}
+
+// markWarning sets a condition of the given type with a warning severity.
+func (c ingressConditions) markWarning(t apis.ConditionType, reason, messageFormat string, messageA ...interface{}) {
+	c.setTrue(t, apis.ConditionSeverityWarning, reason, fmt.Sprintf(messageFormat, messageA...))
+}
+
+// markInfo sets a condition of the given type with an informational severity.
+func (c ingressConditions) markInfo(t apis.ConditionType, reason, messageFormat string, messageA ...interface{}) {
+	c.setTrue(t, apis.ConditionSeverityInfo, reason, fmt.Sprintf(messageFormat, messageA...))
+}
+
+func (c ingressConditions) setTrue(t apis.ConditionType, severity apis.ConditionSeverity, reason, message string) {
+	c.SetCondition(apis.Condition{
+		Type:     t,
+		Status:   corev1.ConditionTrue,
+		Severity: severity,
+		Reason:   reason,
+		Message:  message,
+	})
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/apis"
+)
+
+func TestConditionTransitions(t *testing.T) {
+	ing := ingress(defaultNamespace, testingName, v1alpha1.IngressStatus{})
+	ing.Status.InitializeConditions()
+	conditions := conditionsOf(ing)
+	ready := func() corev1.ConditionStatus {
+		return conditions.GetCondition(v1alpha1.IngressConditionReady).Status
+	}
+
+	conditions.markWaitingForProducer(producerNotReadyReason, "waiting")
+	if c := conditions.GetCondition(v1alpha1.IngressConditionLoadBalancerReady); c.Status != corev1.ConditionUnknown || c.Reason != producerNotReadyReason {
+		t.Errorf("LoadBalancerReady = %+v, want Unknown with reason %s", c, producerNotReadyReason)
+	}
+
+	markIngressReady(ing, ingressKourier, &Config{})
+	if got := ready(); got != corev1.ConditionTrue {
+		t.Errorf("Ready = %v after markIngressReady, want True", got)
+	}
+
+	// Warnings and informational conditions don't affect readiness.
+	conditions.markWarning(tooManyPathsCondition, tooManyPathsReason, "%d paths", 1200)
+	conditions.markInfo(routesGeneratedCondition, routesGeneratedReason, "generated")
+	if c := conditions.GetCondition(tooManyPathsCondition); c.Severity != apis.ConditionSeverityWarning || c.Message != "1200 paths" {
+		t.Errorf("TooManyPaths = %+v, want a warning with message %q", c, "1200 paths")
+	}
+	if c := conditions.GetCondition(routesGeneratedCondition); c.Severity != apis.ConditionSeverityInfo {
+		t.Errorf("RoutesGenerated = %+v, want an informational condition", c)
+	}
+	if got := ready(); got != corev1.ConditionTrue {
+		t.Errorf("Ready = %v with warnings, want True", got)
+	}
+
+	conditions.ClearCondition(tooManyPathsCondition)
+	if c := conditions.GetCondition(tooManyPathsCondition); c != nil {
+		t.Errorf("TooManyPaths = %+v after clearing, want nil", c)
+	}
+
+	conditions.markNotConfigured(producerLoopReason, "100% loop")
+	if c := conditions.GetCondition(v1alpha1.IngressConditionNetworkConfigured); c.Status != corev1.ConditionFalse || c.Message != "100% loop" {
+		t.Errorf("NetworkConfigured = %+v, want False with the message kept verbatim", c)
+	}
+	if got := ready(); got != corev1.ConditionFalse {
+		t.Errorf("Ready = %v when not configured, want False", got)
+	}
+}
+
+func TestStepConditionTransitions(t *testing.T) {
+	ing := ingress(defaultNamespace, testingName, v1alpha1.IngressStatus{})
+	ing.Status.InitializeConditions()
+
+	conditionsOf(ing).markWaitingForProducer(producerNotReadyReason, "waiting")
+	if c := ing.Status.GetCondition(producerReadyCondition); c != nil {
+		t.Errorf("ProducerReady = %+v without ReportConditions, want nil", c)
+	}
+
+	conditions := conditionsFor(ing, &Config{ReportConditions: true})
+	conditions.markWaitingForProducer(producerNotReadyReason, "waiting")
+	if c := conditions.GetCondition(producerReadyCondition); c.Status != corev1.ConditionUnknown || c.Reason != producerNotReadyReason {
+		t.Errorf("ProducerReady = %+v, want Unknown with reason %s", c, producerNotReadyReason)
+	}
+	conditions.markStep(producerReadyCondition, corev1.ConditionTrue, "", "")
+	if c := conditions.GetCondition(producerReadyCondition); !c.IsTrue() || c.Severity != apis.ConditionSeverityInfo {
+		t.Errorf("ProducerReady = %+v, want an informational True condition", c)
+	}
+
+	child := createdIng.DeepCopy()
+	child.Status = v1alpha1.IngressStatus{}
+	child.Status.InitializeConditions()
+	conditions.markChildIngress(child)
+	if c := conditions.GetCondition(childIngressReadyCondition); c.Status != corev1.ConditionUnknown || c.Reason != childNotReadyReason {
+		t.Errorf("ChildIngressReady = %+v, want Unknown with reason %s", c, childNotReadyReason)
+	}
+	child.Status.MarkLoadBalancerFailed("Failed", "no gateway")
+	conditions.markChildIngress(child)
+	if c := conditions.GetCondition(childIngressReadyCondition); c.Status != corev1.ConditionFalse || c.Message != "no gateway" {
+		t.Errorf("ChildIngressReady = %+v, want the False condition of the generated ingress", c)
+	}
+	child.Status = statusReady
+	conditions.markChildIngress(child)
+	if c := conditions.GetCondition(childIngressReadyCondition); !c.IsTrue() {
+		t.Errorf("ChildIngressReady = %+v, want True", c)
+	}
+
+	// The step conditions don't affect readiness.
+	conditions.markStep(serviceReadyCondition, corev1.ConditionFalse, serviceConflictReason, "conflict")
+	markIngressReady(ing, ingressKourier, &Config{})
+	if got := conditions.GetCondition(v1alpha1.IngressConditionReady); !got.IsTrue() {
+		t.Errorf("Ready = %+v with a False step condition, want True", got)
+	}
+	if ing.Status.PrivateLoadBalancer == nil || ing.Status.PublicLoadBalancer == nil {
+		t.Errorf("load balancers = %+v, %+v after markIngressReady, want both set", ing.Status.PublicLoadBalancer, ing.Status.PrivateLoadBalancer)
+	}
+}
@@ -0,0 +1,725 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	networkpkg "knative.dev/networking/pkg"
+	"knative.dev/networking/pkg/apis/networking"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/kmeta"
+	"knative.dev/pkg/system"
+)
+
+// Config holds the controller settings that are read from the environment.
+// The zero value is valid and matches the defaults.
+type Config struct {
+	// ProducerProtocol is the application protocol spoken on the route to the
+	// producer service. Supported values are "http1" and "h2c".
+	ProducerProtocol string `envconfig:"PRODUCER_PROTOCOL" default:"http1"`
+
+	// ProducerSelectorKey and ProducerSelectorValue form the label selector of the
+	// generated service. They must match the labels of the producer pods.
+	ProducerSelectorKey   string `envconfig:"PRODUCER_SELECTOR_KEY" default:"app"`
+	ProducerSelectorValue string `envconfig:"PRODUCER_SELECTOR_VALUE" default:"async-producer"`
+
+	// IngressUpdateStrategy decides how an existing generated ingress is updated.
+	// "replace" overwrites its spec, "merge" only replaces the rules the reconciler
+	// owns and keeps the fields set by other controllers.
+	IngressUpdateStrategy string `envconfig:"INGRESS_UPDATE_STRATEGY" default:"replace"`
+
+	// NamespaceAllowlist restricts reconciliation to the listed namespaces when set.
+	// Namespaces in NamespaceDenylist are never reconciled.
+	NamespaceAllowlist []string `envconfig:"NAMESPACE_ALLOWLIST"`
+	NamespaceDenylist  []string `envconfig:"NAMESPACE_DENYLIST"`
+
+	// RequireAnnotation makes the reconciler ignore ingresses without the async mode
+	// annotation instead of treating them as conditional.
+	RequireAnnotation bool `envconfig:"REQUIRE_ANNOTATION"`
+
+	// ClusterName and ClusterRegion are passed to the producer in the Async-Origin-Cluster
+	// and Async-Origin-Region headers when set, for producers serving several clusters.
+	ClusterName   string `envconfig:"CLUSTER_NAME"`
+	ClusterRegion string `envconfig:"CLUSTER_REGION"`
+
+	// RequestIDHeader names the request ID header forwarded to the producer in the
+	// Async-Original-Request-Id header. The request header is referenced with the
+	// Envoy %REQ()% substitution, so this requires an Envoy based data plane such as
+	// Kourier, Contour or Istio. Request headers are never stripped, the original
+	// header reaches the producer in any case.
+	RequestIDHeader string `envconfig:"REQUEST_ID_HEADER"`
+
+	// IdempotencyKeyHeader names the header carrying an idempotency key to the producer,
+	// e.g. Idempotency-Key, for producers deduplicating retried requests. A key sent by
+	// the client is kept, otherwise the request ID is used: the RequestIDHeader, or the
+	// x-request-id header Envoy generates. Like the request ID, this requires an Envoy
+	// based data plane.
+	IdempotencyKeyHeader string `envconfig:"IDEMPOTENCY_KEY_HEADER"`
+
+	// FallbackProducerService is the name of a standby producer in the namespace of the
+	// controller. Async requests are routed to it while the producer has no ready endpoints.
+	FallbackProducerService string `envconfig:"FALLBACK_PRODUCER_SERVICE"`
+
+	// InformationalHeaderPolicy decides how the informational headers passed to the
+	// producer (origin cluster and region, original request ID) are handled. "overwrite"
+	// always sets them, "client" never sets them and leaves any value sent by the client.
+	// Knative ingresses can only overwrite headers, so set-if-absent is not supported.
+	// Async-Original-Host is trusted by the producer and is always overwritten.
+	InformationalHeaderPolicy string `envconfig:"INFORMATIONAL_HEADER_POLICY" default:"overwrite"`
+
+	// ProducerHostRewrite decides the Host header of requests routed to the producer.
+	// "producer" rewrites it to the producer hostname, "rule" keeps the host of the
+	// ingress rule for producers doing host based virtual routing. The producer is
+	// reached through the generated service in both cases.
+	ProducerHostRewrite string `envconfig:"PRODUCER_HOST_REWRITE" default:"producer"`
+
+	// MaxGeneratedPaths is the number of paths of a generated ingress above which the
+	// source ingress gets a warning condition. Very large ingresses may be rejected by
+	// the API server or slow down the data plane. The generated ingress is never split.
+	MaxGeneratedPaths int `envconfig:"MAX_GENERATED_PATHS" default:"1000"`
+
+	// PublishNotReadyAddresses sets publishNotReadyAddresses on the generated service,
+	// for producers that should receive traffic while warming up. It only has an effect
+	// on services selecting the producer pods, not on ExternalName services.
+	PublishNotReadyAddresses bool `envconfig:"PUBLISH_NOT_READY_ADDRESSES"`
+
+	// CheckProducerService makes the reconciler wait for the service of the producer of an
+	// ingress to exist before generating routes to it. The ingress is marked as waiting for
+	// the producer until then.
+	CheckProducerService bool `envconfig:"CHECK_PRODUCER_SERVICE"`
+
+	// OriginalHostFormat is the format of the Async-Original-Host header. "fqdn" is the
+	// cluster local hostname of the service, "short" is name.namespace and "external" is
+	// the first host of the first public rule, or the cluster local hostname if there is none,
+	// for producers re-dispatching to the public URL.
+	OriginalHostFormat string `envconfig:"ORIGINAL_HOST_FORMAT" default:"fqdn"`
+
+	// DisableAlwaysMode rejects ingresses using the always mode, for the whole ingress or
+	// for a path prefix. Namespaces forced to be asynchronous by the policy are not affected.
+	DisableAlwaysMode bool `envconfig:"DISABLE_ALWAYS_MODE"`
+
+	// ProducerNetworkPolicy makes the reconciler maintain a NetworkPolicy per producer
+	// allowing the gateways of all managed ingress classes to reach the producer pods, for
+	// clusters denying traffic by default. The namespaces of the gateways are matched with
+	// the kubernetes.io/metadata.name label.
+	ProducerNetworkPolicy bool `envconfig:"PRODUCER_NETWORK_POLICY"`
+
+	// PassUnknownIngressClass keeps an INGRESS_CLASS_NAME whose load balancers are unknown,
+	// e.g. a class installed on purpose, instead of generating Kourier ingresses.
+	PassUnknownIngressClass bool `envconfig:"PASS_UNKNOWN_INGRESS_CLASS"`
+
+	// IngressClasses lists the classes of generated ingresses the controller manages
+	// besides INGRESS_CLASS_NAME. Ingresses select one of them with the
+	// async.knative.dev/ingress-class annotation.
+	IngressClasses []string `envconfig:"INGRESS_CLASSES"`
+
+	// GatewaySigningSecret is the name of a Secret in the namespace of the controller whose
+	// signing-key signs the requests routed to the producer in the Async-Gateway-Signature
+	// header. The signature only depends on the route, it deters clients calling the
+	// producer directly but anyone seeing a signed request can replay it.
+	GatewaySigningSecret string `envconfig:"GATEWAY_SIGNING_SECRET"`
+
+	// gatewaySigningKey is the key read from the GatewaySigningSecret, only set on the copy
+	// of the config the objects of an ingress are generated with.
+	gatewaySigningKey string
+
+	// PortNaming sets the naming of the generated service port per ingress class, as
+	// class:naming pairs. "knative", the default, names the port after the protocol,
+	// "istio" adds a suffix following the Istio convention.
+	PortNaming map[string]string `envconfig:"PORT_NAMING"`
+
+	// MeshAnnotations are set on the generated ingress and service, for meshes needing
+	// annotations such as sidecar.istio.io/inject to route the traffic to the producer.
+	// The value is a JSON object mapping ingress classes to their annotations.
+	MeshAnnotations ClassAnnotations `envconfig:"MESH_ANNOTATIONS"`
+
+	// IngressCompareIgnore and ServiceCompareIgnore list the spec fields ignored when
+	// deciding whether a generated ingress or service needs an update, for data planes
+	// defaulting these fields. Fields are dot separated JSON names relative to the spec,
+	// such as "httpOption". An update triggered by another field still sets them.
+	IngressCompareIgnore []string `envconfig:"INGRESS_COMPARE_IGNORE"`
+	ServiceCompareIgnore []string `envconfig:"SERVICE_COMPARE_IGNORE"`
+
+	// LogIngressDiff logs the differences between the existing and the desired generated
+	// ingress at debug level when the ingress is updated, to find the fields a data plane
+	// keeps defaulting when the ingresses are updated on every reconcile.
+	LogIngressDiff bool `envconfig:"LOG_INGRESS_DIFF"`
+
+	// ProducerNotReadyMinDelay makes the reconciler wait for the producer to have ready
+	// endpoints before marking ingresses ready. Waiting ingresses are requeued after the
+	// delay, which doubles on every attempt up to ProducerNotReadyMaxDelay (five minutes
+	// by default). The routes are generated in any case.
+	ProducerNotReadyMinDelay time.Duration `envconfig:"PRODUCER_NOT_READY_MIN_DELAY"`
+	ProducerNotReadyMaxDelay time.Duration `envconfig:"PRODUCER_NOT_READY_MAX_DELAY"`
+
+	// ProducerReadinessCacheTTL caches the readiness of the producers for the given time,
+	// shared by the reconciles of all ingresses. Changes of the producer endpoints
+	// invalidate the cache. Zero disables the cache.
+	ProducerReadinessCacheTTL time.Duration `envconfig:"PRODUCER_READINESS_CACHE_TTL"`
+
+	// ProducerReadinessDebounce keeps reporting a producer as ready for the given time
+	// after its endpoints were last seen ready, so the brief endpoint gaps while the
+	// producer is rolled out don't flip the readiness of the ingresses. Zero disables it.
+	ProducerReadinessDebounce time.Duration `envconfig:"PRODUCER_READINESS_DEBOUNCE"`
+
+	// ProducerProbeTimeout is the timeout of the health probe of the producer, requested
+	// with the async.knative.dev/producer-health-path annotation. It defaults to one second.
+	ProducerProbeTimeout time.Duration `envconfig:"PRODUCER_PROBE_TIMEOUT"`
+
+	// ProducerProbeFailureThreshold is the number of consecutive failed attempts of the
+	// health probe before the producer is unhealthy, ProducerProbeInterval apart. It
+	// defaults to one attempt and is at most 10, the interval at most a minute. Each
+	// attempt is made by another reconcile of the ingress.
+	ProducerProbeFailureThreshold int           `envconfig:"PRODUCER_PROBE_FAILURE_THRESHOLD"`
+	ProducerProbeInterval         time.Duration `envconfig:"PRODUCER_PROBE_INTERVAL"`
+
+	// ChildUpdateJitter is the upper bound of a random delay before the generated ingress
+	// is created or updated. It spreads the API writes when many ingresses change at once,
+	// e.g. on a Helm upgrade. The delay blocks a reconcile worker, so keep it small.
+	ChildUpdateJitter time.Duration `envconfig:"CHILD_UPDATE_JITTER"`
+
+	// ReportGeneratedRoutes sets the RoutesGenerated condition on the source ingresses,
+	// reporting the number of async and sync paths of the generated ingress.
+	ReportGeneratedRoutes bool `envconfig:"REPORT_GENERATED_ROUTES"`
+
+	// ReportConditions sets the AnnotationValid, ProducerReady, ChildIngressReady and
+	// ServiceReady conditions on the source ingresses. It is off by default, so upgrading
+	// doesn't rewrite the status of every ingress.
+	ReportConditions bool `envconfig:"REPORT_CONDITIONS"`
+
+	// IngressClassAnnotationKey is the annotation pinning the class of the generated
+	// ingress, for networking layers following another convention than Knative's
+	// networking.knative.dev/ingress.class. Knative ingresses have no class field.
+	IngressClassAnnotationKey string `envconfig:"INGRESS_CLASS_ANNOTATION_KEY"`
+
+	// ProducerTargetPort is the target port of the generated service, a port number or
+	// the name of a port of the producer pods such as "http". It defaults to port 80.
+	ProducerTargetPort string `envconfig:"PRODUCER_TARGET_PORT"`
+
+	// ProducerPortProtocol is the protocol of the port of the generated service, TCP, UDP
+	// or SCTP, for producers fronting other protocols than HTTP. It defaults to TCP.
+	ProducerPortProtocol string `envconfig:"PRODUCER_PORT_PROTOCOL"`
+
+	// ProducerServiceType is the type of the generated services. "ExternalName" services
+	// resolve to the producer by DNS. "ClusterIP" services have no selector, their
+	// endpoints mirror the endpoints of the producer, for clusters where ExternalName
+	// services don't resolve. "auto" probes the cluster DNS on startup to choose one.
+	ProducerServiceType string `envconfig:"PRODUCER_SERVICE_TYPE" default:"ExternalName"`
+
+	// ServiceIPFamilyPolicy and ServiceIPFamilies set the IP family policy and families of
+	// the generated ClusterIP services, e.g. "PreferDualStack" and "IPv4,IPv6" on dual-stack
+	// clusters. The services get the default of the cluster when they are unset.
+	ServiceIPFamilyPolicy string   `envconfig:"SERVICE_IP_FAMILY_POLICY"`
+	ServiceIPFamilies     []string `envconfig:"SERVICE_IP_FAMILIES"`
+
+	// IgnoreVisibilityLabel makes the visibility of the rules decide whether an ingress is
+	// cluster-local. By default an ingress with the cluster-local visibility label is
+	// cluster-local whatever the visibility of its rules.
+	IgnoreVisibilityLabel bool `envconfig:"IGNORE_VISIBILITY_LABEL"`
+
+	// LegacyHeaderMatches adds a copy of every generated path matching headers, matching
+	// the lower case header names, so the routes work on data planes matching either form.
+	// It is a temporary setting for the window of a data plane upgrade.
+	LegacyHeaderMatches bool `envconfig:"LEGACY_HEADER_MATCHES"`
+
+	// CaseInsensitivePrefer adds copies of the generated paths matching the Prefer values,
+	// matching their Title-Case and upper case forms, e.g. Respond-Async.
+	CaseInsensitivePrefer bool `envconfig:"CASE_INSENSITIVE_PREFER"`
+
+	// NormalizePreferHeader sets the Prefer header of the requests routed to the producer
+	// by the Prefer: respond-async match to respond-async, replacing the values of the
+	// header sent more than once.
+	NormalizePreferHeader bool `envconfig:"NORMALIZE_PREFER_HEADER"`
+
+	// SourceGenerationAnnotation sets the async.knative.dev/source-generation annotation of
+	// the generated ingresses to the generation of their source ingress.
+	SourceGenerationAnnotation bool `envconfig:"SOURCE_GENERATION_ANNOTATION"`
+
+	// IngressNameTemplate is the Go template of the name of the generated ingresses, e.g.
+	// "async-{{.Name}}-{{.Hash}}", with the Name, Namespace and Hash of the source ingress.
+	// It defaults to "{{.Name}}-new".
+	IngressNameTemplate string `envconfig:"INGRESS_NAME_TEMPLATE"`
+
+	// nameTemplate is the parsed IngressNameTemplate, set by Validate.
+	nameTemplate *template.Template
+
+	// ServiceAnnotations are set on the generated services of all ingress classes, e.g.
+	// {"service.kubernetes.io/topology-aware-hints": "auto"}. The MeshAnnotations of the
+	// ingress class take precedence.
+	ServiceAnnotations ServiceAnnotations `envconfig:"SERVICE_ANNOTATIONS"`
+
+	// NormalizeEmptyPaths generates "/" for the paths without a path, for data planes
+	// rejecting empty paths with splits. Knative's gateways accept them, and normalizing
+	// them changes all generated ingresses, so it is disabled by default.
+	NormalizeEmptyPaths bool `envconfig:"NORMALIZE_EMPTY_PATHS"`
+
+	// FieldManager is the field manager of the creates and updates of the controller,
+	// recorded in the managed fields of the objects. It defaults to async-ingress-controller.
+	FieldManager string `envconfig:"FIELD_MANAGER"`
+
+	// ExplicitSyncPath makes conditional mode generate a path routing requests with the
+	// Prefer: respond-sync header to the original backends, like always mode, before the
+	// path all other requests fall through to. It is meant for data planes with ambiguous
+	// fall-through semantics.
+	ExplicitSyncPath bool `envconfig:"EXPLICIT_SYNC_PATH"`
+
+	// DebugAddress is the address of the debug endpoint returning the objects generated
+	// for an ingress, e.g. ":8090". The endpoint is disabled when empty. DebugToken is the
+	// bearer token required by the endpoint, read from a Secret with a secretKeyRef.
+	DebugAddress string `envconfig:"DEBUG_ADDRESS"`
+	DebugToken   string `envconfig:"DEBUG_TOKEN"`
+
+	// DisableOwnerReferences stops copying the owner references of the source ingresses
+	// to the generated objects, for users managing their lifecycle externally. The
+	// controller then sets a finalizer on the source ingresses and deletes the generated
+	// objects itself.
+	DisableOwnerReferences bool `envconfig:"DISABLE_OWNER_REFERENCES"`
+
+	// OriginalIngressClassHeader sets the Async-Original-Ingress-Class header on requests
+	// routed to the producer, carrying the class of the generated ingress, for producers
+	// behaving differently depending on the gateway.
+	OriginalIngressClassHeader bool `envconfig:"ORIGINAL_INGRESS_CLASS_HEADER"`
+
+	// AsyncModeHeader sets the Async-Mode header on requests routed to the producer to the
+	// async mode resolved for the path, for producers logging or adjusting to it.
+	AsyncModeHeader bool `envconfig:"ASYNC_MODE_HEADER"`
+
+	// DryRunGeneratedIngress sends the create or update of the generated ingress as a dry
+	// run first, so validation errors of the networking layer's webhooks are reported on
+	// the source ingress before anything is applied. It doubles the ingress writes.
+	DryRunGeneratedIngress bool `envconfig:"DRY_RUN_GENERATED_INGRESS"`
+}
+
+const (
+	fqdnOriginalHost     = "fqdn"
+	shortOriginalHost    = "short"
+	externalOriginalHost = "external"
+)
+
+const defaultMaxGeneratedPaths = 1000
+
+const defaultFieldManager = "async-ingress-controller"
+
+// clusterLocalVisibility is the value of the visibility label of cluster-local services.
+const clusterLocalVisibility = "cluster-local"
+
+const (
+	producerHostRewrite = "producer"
+	ruleHostRewrite     = "rule"
+)
+
+const (
+	overwriteHeaderPolicy = "overwrite"
+	clientHeaderPolicy    = "client"
+)
+
+const (
+	replaceUpdateStrategy = "replace"
+	mergeUpdateStrategy   = "merge"
+)
+
+// NewConfigFromEnv reads the controller Config from the environment and validates it.
+func NewConfigFromEnv() (*Config, error) {
+	cfg := &Config{}
+	if err := envconfig.Process("", cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate returns an error if any of the settings has an unsupported value.
+func (c *Config) Validate() error {
+	switch networking.ProtocolType(c.ProducerProtocol) {
+	case "", networking.ProtocolHTTP1, networking.ProtocolH2C:
+	default:
+		return fmt.Errorf("unsupported producer protocol %q: must be one of %q, %q",
+			c.ProducerProtocol, networking.ProtocolHTTP1, networking.ProtocolH2C)
+	}
+	switch c.IngressUpdateStrategy {
+	case "", replaceUpdateStrategy, mergeUpdateStrategy:
+	default:
+		return fmt.Errorf("unsupported ingress update strategy %q: must be one of %q, %q",
+			c.IngressUpdateStrategy, replaceUpdateStrategy, mergeUpdateStrategy)
+	}
+	if c.RequestIDHeader != "" {
+		if errs := validation.IsHTTPHeaderName(c.RequestIDHeader); len(errs) > 0 {
+			return fmt.Errorf("invalid request ID header %q: %s", c.RequestIDHeader, strings.Join(errs, "; "))
+		}
+	}
+	if c.IdempotencyKeyHeader != "" {
+		if errs := validation.IsHTTPHeaderName(c.IdempotencyKeyHeader); len(errs) > 0 {
+			return fmt.Errorf("invalid idempotency key header %q: %s", c.IdempotencyKeyHeader, strings.Join(errs, "; "))
+		}
+	}
+	switch c.InformationalHeaderPolicy {
+	case "", overwriteHeaderPolicy, clientHeaderPolicy:
+	default:
+		return fmt.Errorf("unsupported informational header policy %q: must be one of %q, %q",
+			c.InformationalHeaderPolicy, overwriteHeaderPolicy, clientHeaderPolicy)
+	}
+	switch c.ProducerHostRewrite {
+	case "", producerHostRewrite, ruleHostRewrite:
+	default:
+		return fmt.Errorf("unsupported producer host rewrite %q: must be one of %q, %q",
+			c.ProducerHostRewrite, producerHostRewrite, ruleHostRewrite)
+	}
+	switch c.OriginalHostFormat {
+	case "", fqdnOriginalHost, shortOriginalHost, externalOriginalHost:
+	default:
+		return fmt.Errorf("unsupported original host format %q: must be one of %q, %q, %q",
+			c.OriginalHostFormat, fqdnOriginalHost, shortOriginalHost, externalOriginalHost)
+	}
+	switch c.ProducerServiceType {
+	case "", externalNameServiceType, clusterIPServiceType, autoServiceType:
+	default:
+		return fmt.Errorf("unsupported producer service type %q: must be one of %q, %q, %q",
+			c.ProducerServiceType, externalNameServiceType, clusterIPServiceType, autoServiceType)
+	}
+	if c.IngressClassAnnotationKey != "" {
+		if errs := validation.IsQualifiedName(c.IngressClassAnnotationKey); len(errs) > 0 {
+			return fmt.Errorf("invalid ingress class annotation key %q: %s", c.IngressClassAnnotationKey, strings.Join(errs, "; "))
+		}
+	}
+	tmpl, err := validateIngressNameTemplate(c.ingressNameTemplate())
+	if err != nil {
+		return err
+	}
+	c.nameTemplate = tmpl
+	if len(c.FieldManager) > 128 {
+		return fmt.Errorf("field manager %q has more than 128 characters", c.FieldManager)
+	}
+	if c.DebugAddress != "" && c.DebugToken == "" {
+		return fmt.Errorf("the debug endpoint on %s requires a debug token", c.DebugAddress)
+	}
+	if c.ProducerTargetPort != "" {
+		port := intstr.Parse(c.ProducerTargetPort)
+		var errs []string
+		if port.Type == intstr.Int {
+			errs = validation.IsValidPortNum(port.IntValue())
+		} else {
+			errs = validation.IsValidPortName(port.StrVal)
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("invalid producer target port %q: %s", c.ProducerTargetPort, strings.Join(errs, "; "))
+		}
+	}
+	switch corev1.Protocol(c.ProducerPortProtocol) {
+	case "", corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP:
+	default:
+		return fmt.Errorf("unsupported producer port protocol %q: must be one of %q, %q, %q",
+			c.ProducerPortProtocol, corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP)
+	}
+	for class, naming := range c.PortNaming {
+		switch naming {
+		case knativePortNaming, istioPortNaming:
+		default:
+			return fmt.Errorf("unsupported port naming %q for ingress class %q: must be one of %q, %q",
+				naming, class, knativePortNaming, istioPortNaming)
+		}
+	}
+	if err := c.ServiceAnnotations.validate(); err != nil {
+		return err
+	}
+	if err := c.MeshAnnotations.validate(); err != nil {
+		return err
+	}
+	if err := validateFieldPaths(c.IngressCompareIgnore); err != nil {
+		return err
+	}
+	if err := validateFieldPaths(c.ServiceCompareIgnore); err != nil {
+		return err
+	}
+	if c.MaxGeneratedPaths < 0 {
+		return fmt.Errorf("invalid max generated paths %d: must not be negative", c.MaxGeneratedPaths)
+	}
+	if c.ProducerNotReadyMinDelay < 0 || c.ProducerNotReadyMaxDelay < 0 {
+		return fmt.Errorf("invalid producer not ready delays %v, %v: must not be negative",
+			c.ProducerNotReadyMinDelay, c.ProducerNotReadyMaxDelay)
+	}
+	if c.ProducerReadinessCacheTTL < 0 {
+		return fmt.Errorf("invalid producer readiness cache TTL %v: must not be negative", c.ProducerReadinessCacheTTL)
+	}
+	if c.ProducerReadinessDebounce < 0 {
+		return fmt.Errorf("invalid producer readiness debounce %v: must not be negative", c.ProducerReadinessDebounce)
+	}
+	if c.ProducerProbeTimeout < 0 {
+		return fmt.Errorf("invalid producer probe timeout %v: must not be negative", c.ProducerProbeTimeout)
+	}
+	if c.ProducerProbeFailureThreshold < 0 || c.ProducerProbeFailureThreshold > maxProducerProbeFailureThreshold {
+		return fmt.Errorf("invalid producer probe failure threshold %d: must be between 0 and %d",
+			c.ProducerProbeFailureThreshold, maxProducerProbeFailureThreshold)
+	}
+	if c.ProducerProbeInterval < 0 || c.ProducerProbeInterval > maxProducerProbeInterval {
+		return fmt.Errorf("invalid producer probe interval %v: must be between 0 and %v",
+			c.ProducerProbeInterval, maxProducerProbeInterval)
+	}
+	if c.ChildUpdateJitter < 0 {
+		return fmt.Errorf("invalid child update jitter %v: must not be negative", c.ChildUpdateJitter)
+	}
+	if c.ProducerNotReadyMaxDelay != 0 && c.ProducerNotReadyMaxDelay < c.ProducerNotReadyMinDelay {
+		return fmt.Errorf("invalid producer not ready max delay %v: must not be less than the min delay %v",
+			c.ProducerNotReadyMaxDelay, c.ProducerNotReadyMinDelay)
+	}
+	if c.FallbackProducerService != "" {
+		if errs := validation.IsDNS1035Label(c.FallbackProducerService); len(errs) > 0 {
+			return fmt.Errorf("invalid fallback producer service %q: %s", c.FallbackProducerService, strings.Join(errs, "; "))
+		}
+	}
+	switch corev1.IPFamilyPolicyType(c.ServiceIPFamilyPolicy) {
+	case "", corev1.IPFamilyPolicySingleStack, corev1.IPFamilyPolicyPreferDualStack, corev1.IPFamilyPolicyRequireDualStack:
+	default:
+		return fmt.Errorf("invalid service IP family policy %q: must be one of %s, %s, %s", c.ServiceIPFamilyPolicy,
+			corev1.IPFamilyPolicySingleStack, corev1.IPFamilyPolicyPreferDualStack, corev1.IPFamilyPolicyRequireDualStack)
+	}
+	families := sets.NewString()
+	for _, family := range c.ServiceIPFamilies {
+		if family != string(corev1.IPv4Protocol) && family != string(corev1.IPv6Protocol) {
+			return fmt.Errorf("invalid service IP family %q: must be %s or %s", family, corev1.IPv4Protocol, corev1.IPv6Protocol)
+		}
+		if families.Has(family) {
+			return fmt.Errorf("invalid service IP families %v: %s is duplicated", c.ServiceIPFamilies, family)
+		}
+		families.Insert(family)
+	}
+	if len(c.ServiceIPFamilies) > 1 && c.ServiceIPFamilyPolicy == string(corev1.IPFamilyPolicySingleStack) {
+		return fmt.Errorf("invalid service IP families %v: a %s service has one family", c.ServiceIPFamilies, corev1.IPFamilyPolicySingleStack)
+	}
+	if c.GatewaySigningSecret != "" {
+		if errs := validation.IsDNS1123Subdomain(c.GatewaySigningSecret); len(errs) > 0 {
+			return fmt.Errorf("invalid gateway signing secret %q: %s", c.GatewaySigningSecret, strings.Join(errs, "; "))
+		}
+	}
+	key, value := c.producerSelector()
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		return fmt.Errorf("invalid producer selector key %q: %s", key, strings.Join(errs, "; "))
+	}
+	if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+		return fmt.Errorf("invalid producer selector value %q: %s", value, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// producerProtocol returns the protocol spoken to the producer, defaulting to HTTP1.
+func (c *Config) producerProtocol() networking.ProtocolType {
+	if c.ProducerProtocol == "" {
+		return networking.ProtocolHTTP1
+	}
+	return networking.ProtocolType(c.ProducerProtocol)
+}
+
+// ingressClassAnnotationKey returns the annotation pinning the class of the generated
+// ingress, defaulting to the Knative ingress class annotation.
+func (c *Config) ingressClassAnnotationKey() string {
+	if c.IngressClassAnnotationKey == "" {
+		return networking.IngressClassAnnotationKey
+	}
+	return c.IngressClassAnnotationKey
+}
+
+// producerTargetPort returns the target port of the generated service, defaulting to 80.
+func (c *Config) producerTargetPort() intstr.IntOrString {
+	if c.ProducerTargetPort == "" {
+		return intstr.FromInt(80)
+	}
+	return intstr.Parse(c.ProducerTargetPort)
+}
+
+// producerPortProtocol returns the protocol of the port of the generated service,
+// defaulting to TCP.
+func (c *Config) producerPortProtocol() corev1.Protocol {
+	if c.ProducerPortProtocol == "" {
+		return corev1.ProtocolTCP
+	}
+	return corev1.Protocol(c.ProducerPortProtocol)
+}
+
+// labeledClusterLocal returns true if the visibility label marks the ingress cluster-local
+// and the label isn't ignored. The label wins over the visibility of the rules, so the
+// generated rules are cluster-local too and only the private load balancer is reported.
+func (c *Config) labeledClusterLocal(ingress *v1alpha1.Ingress) bool {
+	return !c.IgnoreVisibilityLabel && ingress.Labels[networkpkg.VisibilityLabelKey] == clusterLocalVisibility
+}
+
+// serviceAnnotations returns the annotations of the generated services of the ingress
+// class, the mesh annotations of the class taking precedence.
+func (c *Config) serviceAnnotations(ingressClass string) map[string]string {
+	if len(c.ServiceAnnotations) == 0 {
+		return c.MeshAnnotations[ingressClass]
+	}
+	return kmeta.UnionMaps(c.ServiceAnnotations, c.MeshAnnotations[ingressClass])
+}
+
+// fieldManager returns the field manager of the writes of the controller.
+func (c *Config) fieldManager() string {
+	if c.FieldManager == "" {
+		return defaultFieldManager
+	}
+	return c.FieldManager
+}
+
+// createOptions returns the options of the creates of the controller.
+func (c *Config) createOptions() metav1.CreateOptions {
+	return metav1.CreateOptions{FieldManager: c.fieldManager()}
+}
+
+// updateOptions returns the options of the updates of the controller.
+func (c *Config) updateOptions() metav1.UpdateOptions {
+	return metav1.UpdateOptions{FieldManager: c.fieldManager()}
+}
+
+// ownerReferences returns the owner references of the objects generated for the ingress.
+func (c *Config) ownerReferences(ingress *v1alpha1.Ingress) []metav1.OwnerReference {
+	if c.DisableOwnerReferences {
+		return nil
+	}
+	return ingress.OwnerReferences
+}
+
+// adoptable returns true if a generated object with the existing controller reference may
+// be overwritten or deleted for the source ingress: it has the controller of the source,
+// which it got while owner references were copied, or no controller at all while they
+// aren't copied.
+func (c *Config) adoptable(existing *metav1.OwnerReference, source *v1alpha1.Ingress) bool {
+	if sameController(existing, metav1.GetControllerOf(source)) {
+		return true
+	}
+	return c.DisableOwnerReferences && existing == nil
+}
+
+// maxGeneratedPaths returns the path count threshold of generated ingresses.
+func (c *Config) maxGeneratedPaths() int {
+	if c.MaxGeneratedPaths == 0 {
+		return defaultMaxGeneratedPaths
+	}
+	return c.MaxGeneratedPaths
+}
+
+// endpointsNamespace returns the namespace whose endpoints the controller watches, and
+// false if no feature needs the endpoints. The readiness of the producers needs the
+// endpoints in the namespace of the controller, the ClusterIP services the endpoints of
+// all namespaces, the endpoints of the generated services are next to the ingresses.
+func (c *Config) endpointsNamespace() (string, bool) {
+	switch {
+	case c.clusterIPServices():
+		return metav1.NamespaceAll, true
+	case c.FallbackProducerService != "" || c.ProducerNotReadyMinDelay != 0:
+		return system.Namespace(), true
+	}
+	return "", false
+}
+
+// watchesEndpointsOf returns true if the controller watches the endpoints of the namespace.
+func (c *Config) watchesEndpointsOf(namespace string) bool {
+	watched, ok := c.endpointsNamespace()
+	return ok && (watched == metav1.NamespaceAll || watched == namespace)
+}
+
+// producerNotReadyMinDelay returns the first requeue delay of ingresses waiting for the producer.
+func (c *Config) producerNotReadyMinDelay() time.Duration {
+	if c.ProducerNotReadyMinDelay == 0 {
+		return defaultProducerNotReadyMinDelay
+	}
+	return c.ProducerNotReadyMinDelay
+}
+
+// producerProbeTimeout returns the timeout of the producer health probe.
+func (c *Config) producerProbeTimeout() time.Duration {
+	if c.ProducerProbeTimeout == 0 {
+		return defaultProducerProbeTimeout
+	}
+	return c.ProducerProbeTimeout
+}
+
+// producerProbeFailureThreshold returns the number of attempts of the producer health probe.
+func (c *Config) producerProbeFailureThreshold() int {
+	if c.ProducerProbeFailureThreshold == 0 {
+		return 1
+	}
+	return c.ProducerProbeFailureThreshold
+}
+
+// producerProbeInterval returns the delay between the attempts of the producer health probe.
+func (c *Config) producerProbeInterval() time.Duration {
+	if c.ProducerProbeInterval == 0 {
+		return defaultProducerProbeInterval
+	}
+	return c.ProducerProbeInterval
+}
+
+// producerNotReadyMaxDelay returns the maximum requeue delay of ingresses waiting for the producer.
+func (c *Config) producerNotReadyMaxDelay() time.Duration {
+	if c.ProducerNotReadyMaxDelay == 0 {
+		if c.ProducerNotReadyMinDelay > defaultProducerNotReadyMaxDelay {
+			return c.ProducerNotReadyMinDelay
+		}
+		return defaultProducerNotReadyMaxDelay
+	}
+	return c.ProducerNotReadyMaxDelay
+}
+
+// namespaceAllowed returns true if ingresses in the namespace are reconciled.
+func (c *Config) namespaceAllowed(namespace string) bool {
+	if sets.NewString(c.NamespaceDenylist...).Has(namespace) {
+		return false
+	}
+	return len(c.NamespaceAllowlist) == 0 || sets.NewString(c.NamespaceAllowlist...).Has(namespace)
+}
+
+// skipReason returns why ReconcileKind skips the ingress, empty if it reconciles it. The
+// ingress class is checked by the informer filter before.
+func (c *Config) skipReason(ing *v1alpha1.Ingress) string {
+	if !c.namespaceAllowed(ing.Namespace) {
+		return fmt.Sprintf("the namespace %s is excluded", ing.Namespace)
+	}
+	if _, ok := ing.Annotations[AsyncModeAnnotationKey]; c.RequireAnnotation && !ok {
+		return fmt.Sprintf("the ingress has no %s annotation", AsyncModeAnnotationKey)
+	}
+	return ""
+}
+
+// namespaceFilter returns a FilterFunc accepting objects in the reconciled namespaces. The
+// tombstones of deleted objects are unwrapped, so their deletes aren't filtered out.
+func (c *Config) namespaceFilter() func(interface{}) bool {
+	return func(obj interface{}) bool {
+		if mo, err := kmeta.DeletionHandlingAccessor(obj); err == nil {
+			return c.namespaceAllowed(mo.GetNamespace())
+		}
+		return false
+	}
+}
+
+// producerSelector returns the label key and value selecting the producer pods.
+func (c *Config) producerSelector() (string, string) {
+	key, value := c.ProducerSelectorKey, c.ProducerSelectorValue
+	if key == "" {
+		key = "app"
+	}
+	if value == "" {
+		value = producerServiceName
+	}
+	return key, value
+}
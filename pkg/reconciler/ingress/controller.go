@@ -15,20 +15,30 @@ package ingress
 
 import (
 	"context"
+	"net"
+	"net/http"
 
 	"knative.dev/networking/pkg/apis/networking"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	kubeinformers "k8s.io/client-go/informers"
+	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 	netclient "knative.dev/networking/pkg/client/injection/client"
 	kubeclient "knative.dev/pkg/client/injection/kube/client"
 	serviceinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/service"
 	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/controller"
+	"knative.dev/pkg/kmeta"
 	"knative.dev/pkg/logging"
 	knativeReconciler "knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
 
 	ingressinformer "knative.dev/networking/pkg/client/injection/informers/networking/v1alpha1/ingress"
 	v1alpha1ingress "knative.dev/networking/pkg/client/injection/reconciler/networking/v1alpha1/ingress"
+	networkinglisters "knative.dev/networking/pkg/client/listers/networking/v1alpha1"
 )
 
 const (
@@ -45,26 +55,260 @@ func NewController(
 	ingressInformer := ingressinformer.Get(ctx)
 	serviceInformer := serviceinformer.Get(ctx)
 
-	r := &Reconciler{
-		ingressLister: ingressInformer.Lister(),
-		serviceLister: serviceInformer.Lister(),
-		netclient:     netclient.Get(ctx),
-		kubeclient:    kubeclient.Get(ctx),
+	cfg, err := NewConfigFromEnv()
+	if err != nil {
+		logger.Fatalf("Error loading async controller configuration: %v", err)
 	}
-	impl := v1alpha1ingress.NewImpl(ctx, r, asyncIngressClassName)
 
-	logger.Info("Setting up event handlers.")
+	if version, err := ingressVersion(kubeclient.Get(ctx).Discovery()); err != nil {
+		logger.Warnf("Error detecting the Knative ingress API version: %v", err)
+	} else {
+		logger.Infof("Reconciling Knative ingresses of version %s", version)
+	}
+
+	if cfg.ProducerServiceType == autoServiceType {
+		cfg.ProducerServiceType = detectProducerServiceType(ctx, kubeclient.Get(ctx), net.DefaultResolver.LookupHost)
+	}
+
+	// The endpoints are only watched if a feature needs them, in the namespace it needs.
+	// Without them the lister stays empty.
+	var endpointsInformer cache.SharedIndexInformer
+	endpointsLister := corev1listers.NewEndpointsLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+	if namespace, ok := cfg.endpointsNamespace(); ok {
+		factory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeclient.Get(ctx),
+			controller.GetResyncPeriod(ctx), kubeinformers.WithNamespace(namespace))
+		endpointsInformer = factory.Core().V1().Endpoints().Informer()
+		endpointsLister = factory.Core().V1().Endpoints().Lister()
+		factory.Start(ctx.Done())
+		if !cache.WaitForCacheSync(ctx.Done(), endpointsInformer.HasSynced) {
+			logger.Fatal("Failed to sync the endpoints informer")
+		}
+	}
 
+	r := NewReconciler(ingressInformer.Lister(), serviceInformer.Lister(), endpointsLister,
+		netclient.Get(ctx), kubeclient.Get(ctx), *cfg)
 	// Ingresses need to be filtered by ingress class, so async-component does not
 	// react to nor modify ingresses created by other gateways.
 	classFilter := knativeReconciler.AnnotationFilterFunc(
 		networking.IngressClassAnnotationKey, asyncIngressClassName, false,
 	)
 
+	ingressFilter := knativeReconciler.ChainFilterFuncs(classFilter, cfg.namespaceFilter())
+
+	// The generated objects share the owner references of their source and are garbage
+	// collected with it. Only when owner references are disabled, the finalizing reconciler
+	// deletes them and the finalizer is set. It is patched by the generated reconciler,
+	// which only adds and removes its own finalizer name and keeps the finalizers of others.
+	var policyStore *PolicyStore
+	impl := v1alpha1ingress.NewImpl(ctx, reconcilerFor(r), asyncIngressClassName, func(impl *controller.Impl) controller.Options {
+		// Reconcile all ingresses again when the policy changes.
+		resync := configmap.TypeFilter(&Policy{})(func(string, interface{}) {
+			impl.FilteredGlobalResync(ingressFilter, ingressInformer.Informer())
+		})
+		policyStore = NewPolicyStore(logger.Named("policy-store"), resync)
+		policyStore.WatchConfigs(cmw)
+		return controller.Options{ConfigStore: policyStore, FinalizerName: finalizerFor(cfg)}
+	})
+
+	r.enqueueAfter = impl.EnqueueAfter
+
+	if cfg.ProducerNetworkPolicy {
+		// The producers may be Knative Services in any namespace.
+		factory := kubeinformers.NewSharedInformerFactory(kubeclient.Get(ctx), controller.GetResyncPeriod(ctx))
+		policyInformer := factory.Networking().V1().NetworkPolicies()
+		r.policyLister = policyInformer.Lister()
+		factory.Start(ctx.Done())
+		if !cache.WaitForCacheSync(ctx.Done(), policyInformer.Informer().HasSynced) {
+			logger.Fatal("Failed to sync the network policy informer")
+		}
+	}
+
+	if cfg.GatewaySigningSecret != "" {
+		// Only the signing Secret is watched, the routes are signed again when it changes.
+		factory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeclient.Get(ctx),
+			controller.GetResyncPeriod(ctx), kubeinformers.WithNamespace(system.Namespace()),
+			kubeinformers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", cfg.GatewaySigningSecret).String()
+			}))
+		secretInformer := factory.Core().V1().Secrets()
+		r.secretLister = secretInformer.Lister()
+		secretInformer.Informer().AddEventHandler(controller.HandleAll(func(interface{}) {
+			impl.FilteredGlobalResync(ingressFilter, ingressInformer.Informer())
+		}))
+		factory.Start(ctx.Done())
+		if !cache.WaitForCacheSync(ctx.Done(), secretInformer.Informer().HasSynced) {
+			logger.Fatal("Failed to sync the gateway signing secret informer")
+		}
+	}
+
+	if cfg.DebugAddress != "" {
+		server := &http.Server{
+			Addr:    cfg.DebugAddress,
+			Handler: newDebugHandler(r, cfg.DebugToken, policyStore.ToContext),
+		}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Errorf("Error serving the debug endpoint: %v", err)
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+	}
+
+	logger.Info("Setting up event handlers.")
+
 	ingressInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
-		FilterFunc: classFilter,
+		FilterFunc: ingressFilter,
 		Handler:    controller.HandleAll(impl.Enqueue),
 	})
+	// Drop the requeue state of the deleted ingresses, the finalizer is only set without
+	// owner references.
+	ingressInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: ingressFilter,
+		Handler:    cache.ResourceEventHandlerFuncs{DeleteFunc: r.forgetIngress},
+	})
+
+	// Correct deletions and manual edits of the generated ingresses and services.
+	enqueueSource := enqueueSourceOf(impl, ingressInformer.Lister())
+	childHandler := cache.FilteringResourceEventHandler{
+		FilterFunc: knativeReconciler.ChainFilterFuncs(cfg.namespaceFilter(), generatedFilter),
+		Handler:    controller.HandleAll(enqueueSource),
+	}
+	ingressInformer.Informer().AddEventHandler(childHandler)
+	serviceInformer.Informer().AddEventHandler(childHandler)
+
+	// Reconcile the ingresses of a Knative Service producer when its route changes.
+	serviceInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: knativeReconciler.LabelExistsFilterFunc(routeLabelKey),
+		Handler: controller.HandleAll(func(obj interface{}) {
+			route, err := kmeta.DeletionHandlingAccessor(obj)
+			if err != nil {
+				return
+			}
+			impl.FilteredGlobalResync(knativeReconciler.ChainFilterFuncs(ingressFilter, kserviceProducerFilter(route)),
+				ingressInformer.Informer())
+		}),
+	})
+
+	if cfg.CheckProducerService {
+		if exists, err := producerServiceExists(ctx, kubeclient.Get(ctx)); err != nil {
+			logger.Warnf("Error checking the producer service: %v", err)
+		} else if !exists {
+			logger.Warnf("The producer service %s/%s does not exist, the ingresses using it wait until it is created",
+				system.Namespace(), producerServiceName)
+		}
+		// Reconcile the waiting ingresses once a producer service is created or deleted. The
+		// producers are in the namespace of the controller, Knative Service producers are
+		// resynced by their route services above.
+		resync := func(interface{}) {
+			impl.FilteredGlobalResync(ingressFilter, ingressInformer.Informer())
+		}
+		serviceInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: knativeReconciler.NamespaceFilterFunc(system.Namespace()),
+			Handler: cache.ResourceEventHandlerFuncs{
+				AddFunc:    resync,
+				DeleteFunc: resync,
+			},
+		})
+	}
+
+	if cfg.FallbackProducerService != "" {
+		// Switch between the producer and the fallback producer when the readiness
+		// of the producer changes. The handlers of an informer run concurrently, the
+		// cached readiness is refreshed before the ingresses are reconciled.
+		endpointsInformer.AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: func(obj interface{}) bool {
+				p, ok := producerOfEndpoints(obj)
+				return ok && p == defaultProducer()
+			},
+			Handler: controller.HandleAll(func(obj interface{}) {
+				r.refreshReadinessOf(obj)
+				impl.FilteredGlobalResync(ingressFilter, ingressInformer.Informer())
+			}),
+		})
+	}
+
+	if cfg.clusterIPServices() {
+		// Mirror the endpoints of the producers to the endpoints of the generated services
+		// mirroring them, and correct manual edits of the generated endpoints.
+		services := serviceInformer.Informer()
+		if err := services.AddIndexers(cache.Indexers{producerIndex: producerIndexFunc}); err != nil {
+			logger.Fatalf("Error indexing the generated services by producer: %v", err)
+		}
+		endpointsInformer.AddEventHandler(controller.HandleAll(func(obj interface{}) {
+			for _, service := range mirroringServices(services.GetIndexer(), obj) {
+				enqueueSource(service)
+			}
+		}))
+		// The generated endpoints aren't annotated, their service is.
+		endpointsInformer.AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: knativeReconciler.ChainFilterFuncs(cfg.namespaceFilter(), generatedEndpointsFilter(serviceInformer.Lister())),
+			Handler: controller.HandleAll(func(obj interface{}) {
+				endpoints, err := kmeta.DeletionHandlingAccessor(obj)
+				if err != nil {
+					return
+				}
+				if service, err := serviceInformer.Lister().Services(endpoints.GetNamespace()).Get(endpoints.GetName()); err == nil {
+					enqueueSource(service)
+				}
+			}),
+		})
+	}
+
+	if cfg.ProducerReadinessDebounce != 0 && endpointsInformer != nil {
+		// Record when the producers were last ready, their endpoints may lose their
+		// addresses long after the last reconcile.
+		endpointsInformer.AddEventHandler(r.lastReadyHandler())
+	}
+
+	if cfg.ProducerReadinessCacheTTL != 0 && endpointsInformer != nil {
+		// Refresh the cached readiness of a producer when its endpoints change. The
+		// informer only watches the namespaces of the checked producers.
+		endpointsInformer.AddEventHandler(controller.HandleAll(r.refreshReadinessOf))
+	}
 
 	return impl
 }
+
+// generatedFilter selects the generated ingresses and services, annotated with the name
+// of their source ingress. The objects generated before the annotation was set get it on
+// the first reconcile of their source, the controller reconciles all sources on startup.
+func generatedFilter(obj interface{}) bool {
+	object, err := kmeta.DeletionHandlingAccessor(obj)
+	if err != nil {
+		return false
+	}
+	_, ok := object.GetAnnotations()[asyncSourceKey]
+	return ok
+}
+
+// enqueueSourceOf returns a handler enqueueing the async ingress a generated object was
+// made from, named by its source annotation. The prefer and method producer services
+// are annotated like the ingress and the service of the producer.
+func enqueueSourceOf(impl *controller.Impl, lister networkinglisters.IngressLister) func(interface{}) {
+	return func(obj interface{}) {
+		child, err := kmeta.DeletionHandlingAccessor(obj)
+		if err != nil {
+			return
+		}
+		name, ok := child.GetAnnotations()[asyncSourceKey]
+		if !ok {
+			return
+		}
+		source, err := lister.Ingresses(child.GetNamespace()).Get(name)
+		if err != nil || source.Annotations[networking.IngressClassAnnotationKey] != asyncIngressClassName {
+			return
+		}
+		impl.EnqueueKey(types.NamespacedName{Namespace: source.Namespace, Name: source.Name})
+	}
+}
+
+// sameController returns true if both controller references are unset or point to the same object.
+func sameController(a, b *metav1.OwnerReference) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.UID == b.UID
+}
@@ -15,12 +15,18 @@ package ingress
 
 import (
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	network "knative.dev/networking/pkg"
+	"knative.dev/networking/pkg/apis/networking"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
 
-	_ "knative.dev/networking/pkg/client/injection/informers/networking/v1alpha1/ingress/fake"
+	fakeingressinformer "knative.dev/networking/pkg/client/injection/informers/networking/v1alpha1/ingress/fake"
+	fakekubeclient "knative.dev/pkg/client/injection/kube/client/fake"
 	_ "knative.dev/pkg/client/injection/kube/informers/core/v1/service/fake"
 	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/system"
@@ -41,9 +47,184 @@ func TestNew(t *testing.T) {
 			Namespace: system.Namespace(),
 			Name:      network.ConfigName,
 		},
+	}, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: system.Namespace(),
+			Name:      PolicyConfigName,
+		},
 	}))
 
 	if c == nil {
 		t.Fatal("Expected NewController to return a non-nil value")
 	}
 }
+
+func TestEndpointsNamespace(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           Config
+		wantNamespace string
+		wantWatched   bool
+	}{{
+		name: "no feature needs the endpoints",
+	}, {
+		name:          "fallback producer",
+		cfg:           Config{FallbackProducerService: "async-producer-standby"},
+		wantNamespace: system.Namespace(),
+		wantWatched:   true,
+	}, {
+		name:          "waiting for the producer",
+		cfg:           Config{ProducerNotReadyMinDelay: time.Second},
+		wantNamespace: system.Namespace(),
+		wantWatched:   true,
+	}, {
+		name:          "ClusterIP services",
+		cfg:           Config{ProducerServiceType: clusterIPServiceType, FallbackProducerService: "async-producer-standby"},
+		wantNamespace: metav1.NamespaceAll,
+		wantWatched:   true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			namespace, watched := test.cfg.endpointsNamespace()
+			if namespace != test.wantNamespace || watched != test.wantWatched {
+				t.Errorf("endpointsNamespace() = %q, %v, want %q, %v", namespace, watched, test.wantNamespace, test.wantWatched)
+			}
+		})
+	}
+}
+
+func TestPolicyChangeResync(t *testing.T) {
+	ctx, _ := SetupFakeContext(t)
+	watcher := &configmap.ManualWatcher{Namespace: system.Namespace()}
+	impl := NewController(ctx, watcher)
+
+	managed := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+	}))
+	other := ingress(defaultNamespace, "other", statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: ingressKourier,
+	}))
+	for _, ing := range []*v1alpha1.Ingress{managed, other} {
+		if err := fakeingressinformer.Get(ctx).Informer().GetIndexer().Add(ing); err != nil {
+			t.Fatalf("Error adding ingress %s: %v", ing.Name, err)
+		}
+	}
+
+	watcher.OnChange(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: system.Namespace(),
+			Name:      PolicyConfigName,
+		},
+		Data: map[string]string{forceAsyncNamespacesKey: defaultNamespace},
+	})
+
+	// Only the ingress of the async class is enqueued again.
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return impl.WorkQueue().Len() == 1, nil
+	}); err != nil {
+		t.Fatalf("Work queue length = %d, want 1", impl.WorkQueue().Len())
+	}
+}
+
+func TestChildChangeEnqueuesSource(t *testing.T) {
+	ctx, _ := SetupFakeContext(t)
+	impl := NewController(ctx, &configmap.ManualWatcher{Namespace: system.Namespace()})
+
+	source := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+	}))
+	if err := fakeingressinformer.Get(ctx).Informer().GetIndexer().Add(source); err != nil {
+		t.Fatalf("Error adding ingress %s: %v", source.Name, err)
+	}
+	enqueue := enqueueSourceOf(impl, fakeingressinformer.Get(ctx).Lister())
+	dequeue := func() {
+		t.Helper()
+		if got := impl.WorkQueue().Len(); got != 1 {
+			t.Fatalf("Work queue length = %d, want 1", got)
+		}
+		key, _ := impl.WorkQueue().Get()
+		if want := (types.NamespacedName{Namespace: defaultNamespace, Name: testingName}); key != want {
+			t.Errorf("Enqueued key = %v, want %v", key, want)
+		}
+		impl.WorkQueue().Done(key)
+		impl.WorkQueue().Forget(key)
+	}
+
+	// An unrelated ingress of another class is ignored.
+	other := ingress(defaultNamespace, "other", statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: ingressKourier,
+	}))
+	if err := fakeingressinformer.Get(ctx).Informer().GetIndexer().Add(other); err != nil {
+		t.Fatalf("Error adding ingress %s: %v", other.Name, err)
+	}
+	if generatedFilter(other) {
+		t.Error("generatedFilter() = true for an ingress without the source annotation")
+	}
+	enqueue(other)
+	if got := impl.WorkQueue().Len(); got != 0 {
+		t.Fatalf("Work queue length = %d, want 0", got)
+	}
+
+	// A manual edit of the generated ingress enqueues the source ingress.
+	edited := makeNewIngress(source, ingressKourier, defaultProducer(), &Config{})
+	edited.Spec.Rules[0].HTTP.Paths = edited.Spec.Rules[0].HTTP.Paths[:1]
+	if !generatedFilter(edited) {
+		t.Error("generatedFilter() = false for the generated ingress")
+	}
+	enqueue(edited)
+	dequeue()
+
+	// The source is found under any name template.
+	renamed := makeNewIngress(source, ingressKourier, defaultProducer(), &Config{IngressNameTemplate: "async-{{.Name}}"})
+	enqueue(renamed)
+	dequeue()
+
+	// The prefer and method producer services enqueue the source like its producer service.
+	withProducers := source.DeepCopy()
+	withProducers.Annotations[asyncPreferProducersKey] = "respond-batch=batch-producer"
+	withProducers.Annotations[asyncReadProducerKey] = "read-producer"
+	services := append([]*corev1.Service{MakeK8sService(withProducers, ingressKourier, defaultProducer(), &Config{})},
+		makePreferServices(withProducers, ingressKourier, &Config{})...)
+	if len(services) != 3 {
+		t.Fatalf("Generated services = %d, want 3", len(services))
+	}
+	for _, svc := range services {
+		if !generatedFilter(svc) {
+			t.Errorf("generatedFilter() = false for the generated service %s", svc.Name)
+		}
+		enqueue(svc)
+		dequeue()
+	}
+
+	// Objects annotated with a missing source or a source of another class are ignored.
+	for _, name := range []string{"missing", other.Name} {
+		orphan := edited.DeepCopy()
+		orphan.Annotations[asyncSourceKey] = name
+		enqueue(orphan)
+		if got := impl.WorkQueue().Len(); got != 0 {
+			t.Fatalf("Work queue length = %d, want 0 for the source %s", got, name)
+		}
+	}
+}
+
+func TestProducerServiceExists(t *testing.T) {
+	ctx, _ := SetupFakeContext(t)
+	client := fakekubeclient.Get(ctx)
+
+	if exists, err := producerServiceExists(ctx, client); err != nil || exists {
+		t.Errorf("producerServiceExists() = %v, %v, want false, nil", exists, err)
+	}
+
+	producer := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      producerServiceName,
+			Namespace: system.Namespace(),
+		},
+	}
+	if _, err := client.CoreV1().Services(producer.Namespace).Create(ctx, producer, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Error creating the producer service: %v", err)
+	}
+	if exists, err := producerServiceExists(ctx, client); err != nil || !exists {
+		t.Errorf("producerServiceExists() = %v, %v, want true, nil", exists, err)
+	}
+}
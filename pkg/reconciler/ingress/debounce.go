@@ -0,0 +1,111 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+// lastReadyTimes holds the last time each producer was seen with ready endpoints.
+type lastReadyTimes struct {
+	mu    sync.Mutex
+	times map[Producer]time.Time
+}
+
+// get returns the last time the producer was seen ready, or false if it never was.
+func (l *lastReadyTimes) get(p Producer) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.times[p]
+	return t, ok
+}
+
+// set records that the producer was seen ready at now.
+func (l *lastReadyTimes) set(p Producer, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.times == nil {
+		l.times = make(map[Producer]time.Time)
+	}
+	l.times[p] = now
+}
+
+// producerReadyDebounced returns true if the producer is ready, or was ready within the
+// last ProducerReadinessDebounce, so the brief endpoint gaps of a rollout of the producer
+// don't flip the ingresses to not ready. A masked gap requeues the ingress at the end of
+// the window, to mark it not ready if the producer didn't come back.
+func (r *Reconciler) producerReadyDebounced(ing *v1alpha1.Ingress, p Producer) (bool, error) {
+	ready, err := r.producerReady(p)
+	window := r.config.ProducerReadinessDebounce
+	if err != nil || window == 0 {
+		return ready, err
+	}
+	now := r.clock.Now()
+	if ready {
+		r.lastReady.set(p, now)
+		return true, nil
+	}
+	last, ok := r.lastReady.get(p)
+	if !ok {
+		return false, nil
+	}
+	remaining := last.Add(window).Sub(now)
+	if remaining <= 0 {
+		return false, nil
+	}
+	if r.enqueueAfter != nil {
+		r.enqueueAfter(ing, remaining)
+	}
+	return true, nil
+}
+
+// recordLastReady records the time the producers of the endpoints were last seen ready, it
+// handles the events of the endpoints informer. Endpoints that had a ready address before
+// an update or deletion were ready until the event, so a gap starting long after the last
+// reconcile of an ingress is masked too.
+func (r *Reconciler) recordLastReady(objs ...interface{}) {
+	now := r.clock.Now()
+	for _, obj := range objs {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		endpoints, ok := obj.(*corev1.Endpoints)
+		if !ok || !hasReadyAddress(endpoints) {
+			continue
+		}
+		if p, ok := producerOfEndpoints(endpoints); ok {
+			r.lastReady.set(p, now)
+		}
+	}
+}
+
+// lastReadyHandler returns the handler recording the last ready time of the producers.
+func (r *Reconciler) lastReadyHandler() cache.ResourceEventHandler {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			r.recordLastReady(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			r.recordLastReady(oldObj, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			r.recordLastReady(obj)
+		},
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestProducerReadinessDebounce(t *testing.T) {
+	producer := defaultProducer()
+	ready := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: producer.Name, Namespace: producer.Namespace},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+		}},
+	}
+	gap := ready.DeepCopy()
+	gap.Subsets = nil
+
+	newReconciler := func(window time.Duration) (*Reconciler, cache.Indexer, *clock.FakeClock, *[]time.Duration) {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		if err := indexer.Add(ready); err != nil {
+			t.Fatalf("Error adding the endpoints: %v", err)
+		}
+		fakeClock := clock.NewFakeClock(time.Now())
+		var requeues []time.Duration
+		r := &Reconciler{
+			serviceLister:   corev1listers.NewServiceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+			endpointsLister: corev1listers.NewEndpointsLister(indexer),
+			config:          Config{ProducerReadinessDebounce: window},
+			clock:           fakeClock,
+		}
+		r.enqueueAfter = func(_ interface{}, delay time.Duration) {
+			requeues = append(requeues, delay)
+		}
+		return r, indexer, fakeClock, &requeues
+	}
+	ing := ingress(defaultNamespace, testingName, statusUnknown)
+	wantReady := func(r *Reconciler, want bool, when string) {
+		t.Helper()
+		if got, err := r.producerReadyDebounced(ing, producer); err != nil || got != want {
+			t.Errorf("producerReadyDebounced() %s = %v, %v, want %v", when, got, err, want)
+		}
+	}
+
+	r, indexer, fakeClock, requeues := newReconciler(10 * time.Second)
+	wantReady(r, true, "initially")
+
+	// A brief endpoint gap while the producer is rolled out is masked, and the ingress
+	// is requeued at the end of the window.
+	indexer.Update(gap)
+	fakeClock.Step(4 * time.Second)
+	wantReady(r, true, "during a brief gap")
+	if want := []time.Duration{6 * time.Second}; len(*requeues) != 1 || (*requeues)[0] != want[0] {
+		t.Errorf("Requeues = %v, want %v", *requeues, want)
+	}
+
+	// The producer comes back, the window starts over.
+	indexer.Update(ready)
+	fakeClock.Step(time.Second)
+	wantReady(r, true, "after the gap")
+	indexer.Update(gap)
+	fakeClock.Step(9 * time.Second)
+	wantReady(r, true, "during a second gap")
+
+	// A gap longer than the window makes the producer not ready.
+	fakeClock.Step(time.Second)
+	wantReady(r, false, "after the window")
+
+	// A gap starting long after the last reconcile is masked too, the endpoints informer
+	// records that the producer was ready until the gap started.
+	r, indexer, fakeClock, _ = newReconciler(10 * time.Second)
+	handler := r.lastReadyHandler()
+	wantReady(r, true, "before the informer events")
+	fakeClock.Step(time.Minute)
+	indexer.Update(gap)
+	handler.OnUpdate(ready, gap)
+	fakeClock.Step(4 * time.Second)
+	wantReady(r, true, "during a gap after a minute")
+	fakeClock.Step(6 * time.Second)
+	wantReady(r, false, "after the window of the informer event")
+	handler.OnDelete(cache.DeletedFinalStateUnknown{Key: "knative-testing/async-producer", Obj: gap})
+	wantReady(r, false, "after the deletion of endpoints without addresses")
+
+	// A producer never seen ready isn't ready.
+	r, indexer, _, _ = newReconciler(10 * time.Second)
+	indexer.Update(gap)
+	wantReady(r, false, "never seen ready")
+
+	// Without a window the gap is reported right away.
+	r, indexer, _, requeues = newReconciler(0)
+	wantReady(r, true, "without a window")
+	indexer.Update(gap)
+	wantReady(r, false, "without a window")
+	if len(*requeues) != 0 {
+		t.Errorf("Requeues = %v, want none without a window", *requeues)
+	}
+
+	if err := (&Config{ProducerReadinessDebounce: -time.Second}).Validate(); err == nil {
+		t.Error("Validate() = nil, want error for a negative debounce")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"knative.dev/networking/pkg/apis/networking"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+// debugGeneratedPath is the path prefix of the debug endpoint, followed by the namespace
+// and name of a source ingress.
+const debugGeneratedPath = "/generated/"
+
+// generatedObjects are the objects the reconciler generates for a source ingress.
+type generatedObjects struct {
+	Ingress  *v1alpha1.Ingress `json:"ingress"`
+	Services []*corev1.Service `json:"services"`
+}
+
+// newDebugHandler returns a handler answering GET /generated/<namespace>/<name> with the
+// objects the reconciler generates for the ingress, without applying them. Requests must
+// carry the token as a bearer token. toContext attaches the current policy.
+func newDebugHandler(r *Reconciler, token string, toContext func(context.Context) context.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth := []byte(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+		if token == "" || subtle.ConstantTimeCompare(auth, []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, debugGeneratedPath), "/")
+		if !strings.HasPrefix(req.URL.Path, debugGeneratedPath) || len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			http.Error(w, "expected "+debugGeneratedPath+"<namespace>/<name>", http.StatusNotFound)
+			return
+		}
+		ing, err := r.ingressLister.Ingresses(parts[0]).Get(parts[1])
+		if apierrs.IsNotFound(err) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		generated, err := r.generate(toContext(req.Context()), ing.DeepCopy())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(generated)
+	})
+}
+
+// generate returns the objects ReconcileKind generates for the ingress. It returns an
+// error for the ingresses the controller doesn't reconcile, filtered like the informer
+// and ReconcileKind filter them.
+func (r *Reconciler) generate(ctx context.Context, ing *v1alpha1.Ingress) (*generatedObjects, error) {
+	if class := ing.Annotations[networking.IngressClassAnnotationKey]; class != asyncIngressClassName {
+		return nil, fmt.Errorf("the ingress class %q is not %s, the ingress isn't reconciled", class, asyncIngressClassName)
+	}
+	if reason := r.config.skipReason(ing); reason != "" {
+		return nil, fmt.Errorf("%s, the ingress isn't reconciled", reason)
+	}
+	if err := validateIngress(ctx, ing, &r.config); err != nil {
+		return nil, err
+	}
+	ingressClass, err := r.ingressClassFor(ing)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := r.resolveProducer(ing)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := r.generateConfig()
+	if err != nil {
+		return nil, err
+	}
+	source, _ := sourceFor(ctx, ing)
+	desired, service, preferServices := makeChildren(source, ingressClass, producer, cfg)
+	generated := &generatedObjects{Ingress: desired}
+	if routesToService(desired, service.Name) {
+		generated.Services = append(generated.Services, service)
+	}
+	for _, svc := range preferServices {
+		if routesToService(desired, svc.Name) {
+			generated.Services = append(generated.Services, svc)
+		}
+	}
+	return generated, nil
+}
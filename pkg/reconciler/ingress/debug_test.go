@@ -0,0 +1,92 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+	"knative.dev/networking/pkg/apis/networking"
+
+	. "knative.dev/async-component/pkg/reconciler/testing"
+)
+
+func TestDebugHandler(t *testing.T) {
+	invalid := ingress(defaultNamespace, "invalid", statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		asyncRoutesKey:                       "SEND /orders",
+	}))
+	otherClass := ingress(defaultNamespace, "other-class", statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: ingressKourier,
+	}))
+	denied := ingress("denied", testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+	}))
+	listers := NewListers([]runtime.Object{ingSometimesAsync, invalid, otherClass, denied})
+	r := NewReconciler(listers.GetIngressLister(), listers.GetK8sServiceLister(), listers.GetEndpointsLister(),
+		nil, nil, Config{NamespaceDenylist: []string{"denied"}})
+	handler := newDebugHandler(r, "secret", func(ctx context.Context) context.Context { return ctx })
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, test := range []struct {
+		name   string
+		path   string
+		token  string
+		status int
+	}{
+		{name: "missing token", path: "/generated/default/testing", status: http.StatusUnauthorized},
+		{name: "wrong token", path: "/generated/default/testing", token: "guess", status: http.StatusUnauthorized},
+		{name: "unknown ingress", path: "/generated/default/unknown", token: "secret", status: http.StatusNotFound},
+		{name: "missing name", path: "/generated/default", token: "secret", status: http.StatusNotFound},
+		{name: "invalid annotations", path: "/generated/default/invalid", token: "secret", status: http.StatusUnprocessableEntity},
+		{name: "another ingress class", path: "/generated/default/other-class", token: "secret", status: http.StatusUnprocessableEntity},
+		{name: "denied namespace", path: "/generated/denied/testing", token: "secret", status: http.StatusUnprocessableEntity},
+	} {
+		if rec := get(test.path, test.token); rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.status)
+		}
+	}
+
+	rec := get("/generated/default/testing", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var got generatedObjects
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding the generated objects: %v", err)
+	}
+	// The reconciler creates the same objects, with the spec hash annotation.
+	if got.Ingress.Name != createdIng.Name || !equality.Semantic.DeepEqual(got.Ingress.Spec, createdIng.Spec) {
+		t.Errorf("generated ingress = %+v, want the spec of %s", got.Ingress, createdIng.Name)
+	}
+	wantService := service(defaultNamespace, testingName)
+	if len(got.Services) != 1 || got.Services[0].Name != wantService.Name ||
+		!equality.Semantic.DeepEqual(got.Services[0].Spec, wantService.Spec) {
+		t.Errorf("generated services = %+v, want %s", got.Services, wantService.Name)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"fmt"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+// ingressRejectedError is returned when the API server or an admission webhook rejects
+// the dry run of the generated ingress. Retrying doesn't help, the spec has to change.
+type ingressRejectedError struct {
+	err error
+}
+
+func (e *ingressRejectedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ingressRejectedError) Unwrap() error {
+	return e.err
+}
+
+// dryRunIngress sends the create or update of the generated ingress as a dry run when
+// DryRunGeneratedIngress is enabled, so the validation of the API server and the webhooks
+// of the networking layer run before the ingress is applied.
+func (r *Reconciler) dryRunIngress(ctx context.Context, ingress *v1alpha1.Ingress, update bool) error {
+	if !r.config.DryRunGeneratedIngress {
+		return nil
+	}
+	ingresses := r.netclient.NetworkingV1alpha1().Ingresses(ingress.Namespace)
+	var err error
+	if update {
+		opts := r.config.updateOptions()
+		opts.DryRun = []string{metav1.DryRunAll}
+		_, err = ingresses.Update(ctx, ingress, opts)
+	} else {
+		opts := r.config.createOptions()
+		opts.DryRun = []string{metav1.DryRunAll}
+		_, err = ingresses.Create(ctx, ingress, opts)
+	}
+	if err == nil {
+		return nil
+	}
+	if apierrs.IsInvalid(err) || apierrs.IsBadRequest(err) || apierrs.IsForbidden(err) {
+		return &ingressRejectedError{err: err}
+	}
+	return fmt.Errorf("failed to dry run the Ingress: %w", err)
+}
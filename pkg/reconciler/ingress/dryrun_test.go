@@ -0,0 +1,88 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"testing"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ktesting "k8s.io/client-go/testing"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+
+	. "knative.dev/async-component/pkg/reconciler/testing"
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+// onDryRun returns a reactor handling the first create of an ingress, the dry run, with
+// the given error. The fake clientset ignores the dry run option and would store the
+// ingress otherwise.
+func onDryRun(err error) ktesting.ReactionFunc {
+	handled := false
+	return func(action ktesting.Action) (bool, runtime.Object, error) {
+		if handled || !action.Matches("create", "ingresses") {
+			return false, nil, nil
+		}
+		handled = true
+		return true, action.(ktesting.CreateAction).GetObject(), err
+	}
+}
+
+func TestDryRunGeneratedIngress(t *testing.T) {
+	invalid := apierrs.NewInvalid(v1alpha1.Kind("Ingress"), createdIng.Name, field.ErrorList{
+		field.Invalid(field.NewPath("spec", "rules").Index(0).Child("hosts"), "example.com", "host not allowed"),
+	})
+	rejected := ingSometimesAsync.DeepCopy()
+	conditionsOf(rejected).markNotConfigured(ingressRejectedReason, "The generated ingress was rejected: "+invalid.Error())
+	dryRun := withTestConfig(Config{DryRunGeneratedIngress: true})
+
+	table := TableTest{{
+		Name: "dry run accepted",
+		Key:  "default/testing",
+		Ctx:  dryRun,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WithReactors: []ktesting.ReactionFunc{onDryRun(nil)},
+		WantCreates: []runtime.Object{
+			createdIng,
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "dry run rejected",
+		Key:  "default/testing",
+		Ctx:  dryRun,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WithReactors: []ktesting.ReactionFunc{onDryRun(invalid)},
+		WantCreates: []runtime.Object{
+			createdIng,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: rejected,
+		}}}, {
+		Name: "no dry run by default",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	ktesting "k8s.io/client-go/testing"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	netclientset "knative.dev/networking/pkg/client/clientset/versioned"
+	netv1alpha1client "knative.dev/networking/pkg/client/clientset/versioned/typed/networking/v1alpha1"
+	fakenetworkingclient "knative.dev/networking/pkg/client/injection/client/fake"
+	ingressreconciler "knative.dev/networking/pkg/client/injection/reconciler/networking/v1alpha1/ingress"
+	fakekubeclient "knative.dev/pkg/client/injection/kube/client/fake"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+
+	. "knative.dev/async-component/pkg/reconciler/testing"
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+// The fake clientsets don't record the options of the writes, these wrappers record the
+// field managers of the ingress and service writes.
+type recordingNetClient struct {
+	netclientset.Interface
+	managers *[]string
+}
+
+func (c recordingNetClient) NetworkingV1alpha1() netv1alpha1client.NetworkingV1alpha1Interface {
+	return recordingNetworking{c.Interface.NetworkingV1alpha1(), c.managers}
+}
+
+type recordingNetworking struct {
+	netv1alpha1client.NetworkingV1alpha1Interface
+	managers *[]string
+}
+
+func (c recordingNetworking) Ingresses(namespace string) netv1alpha1client.IngressInterface {
+	return recordingIngresses{c.NetworkingV1alpha1Interface.Ingresses(namespace), c.managers}
+}
+
+type recordingIngresses struct {
+	netv1alpha1client.IngressInterface
+	managers *[]string
+}
+
+func (c recordingIngresses) Create(ctx context.Context, ing *v1alpha1.Ingress, opts metav1.CreateOptions) (*v1alpha1.Ingress, error) {
+	*c.managers = append(*c.managers, "create ingress "+opts.FieldManager)
+	return c.IngressInterface.Create(ctx, ing, opts)
+}
+
+func (c recordingIngresses) Update(ctx context.Context, ing *v1alpha1.Ingress, opts metav1.UpdateOptions) (*v1alpha1.Ingress, error) {
+	*c.managers = append(*c.managers, "update ingress "+opts.FieldManager)
+	return c.IngressInterface.Update(ctx, ing, opts)
+}
+
+type recordingKubeClient struct {
+	kubernetes.Interface
+	managers *[]string
+}
+
+func (c recordingKubeClient) CoreV1() corev1client.CoreV1Interface {
+	return recordingCore{c.Interface.CoreV1(), c.managers}
+}
+
+type recordingCore struct {
+	corev1client.CoreV1Interface
+	managers *[]string
+}
+
+func (c recordingCore) Services(namespace string) corev1client.ServiceInterface {
+	return recordingServices{c.CoreV1Interface.Services(namespace), c.managers}
+}
+
+type recordingServices struct {
+	corev1client.ServiceInterface
+	managers *[]string
+}
+
+func (c recordingServices) Create(ctx context.Context, svc *corev1.Service, opts metav1.CreateOptions) (*corev1.Service, error) {
+	*c.managers = append(*c.managers, "create service "+opts.FieldManager)
+	return c.ServiceInterface.Create(ctx, svc, opts)
+}
+
+func (c recordingServices) Update(ctx context.Context, svc *corev1.Service, opts metav1.UpdateOptions) (*corev1.Service, error) {
+	*c.managers = append(*c.managers, "update service "+opts.FieldManager)
+	return c.ServiceInterface.Update(ctx, svc, opts)
+}
+
+func TestFieldManager(t *testing.T) {
+	changedIng := createdIng.DeepCopy()
+	changedIng.Spec.Rules[0].HTTP.Paths[0].RewriteHost = "changed"
+	changedService := service(defaultNamespace, testingName)
+	changedService.Spec.ExternalName = "changed"
+
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{{
+		name: "default field manager",
+		want: "async-ingress-controller",
+	}, {
+		name: "configured field manager",
+		cfg:  Config{FieldManager: "platform-team"},
+		want: "platform-team",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var managers []string
+			table := TableTest{{
+				Name: "create",
+				Key:  "default/testing",
+				Ctx:  withTestConfig(test.cfg),
+				Objects: []runtime.Object{
+					ingSometimesAsync,
+				},
+				WantCreates: []runtime.Object{
+					createdIng,
+					service(defaultNamespace, testingName),
+				}}, {
+				Name: "update",
+				Key:  "default/testing",
+				Ctx:  withTestConfig(test.cfg),
+				Objects: []runtime.Object{
+					ingSometimesAsync,
+					changedIng,
+					changedService,
+				},
+				WantUpdates: []ktesting.UpdateActionImpl{{
+					Object: createdIng,
+				}, {
+					Object: service(defaultNamespace, testingName),
+				}}},
+			}
+			table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+				cfg, _ := ctx.Value(testConfigKey{}).(Config)
+				r := NewReconciler(listers.GetIngressLister(), listers.GetK8sServiceLister(), listers.GetEndpointsLister(),
+					recordingNetClient{fakenetworkingclient.Get(ctx), &managers},
+					recordingKubeClient{fakekubeclient.Get(ctx), &managers}, cfg)
+				return ingressreconciler.NewReconciler(ctx, logging.FromContext(ctx), fakenetworkingclient.Get(ctx),
+					listers.GetIngressLister(), controller.GetEventRecorder(ctx), reconcilerFor(r), asyncIngressClassName,
+					controller.Options{FinalizerName: finalizerName})
+			}))
+
+			want := []string{"create ingress", "create service", "update ingress", "update service"}
+			if len(managers) != len(want) {
+				t.Fatalf("writes = %v, want %v", managers, want)
+			}
+			for i, write := range managers {
+				if write != want[i]+" "+test.want {
+					t.Errorf("write %d = %q, want %q", i, write, want[i]+" "+test.want)
+				}
+			}
+		})
+	}
+
+	if err := (&Config{FieldManager: strings.Repeat("m", 129)}).Validate(); err == nil {
+		t.Error("Validate() = nil, want error for an over-long field manager")
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/kmp"
+	"knative.dev/pkg/logging"
+)
+
+// specHashKey is set on the generated objects to the hash of the spec the reconciler
+// produced, to show whether an object is up to date.
+const specHashKey = "async.knative.dev/spec-hash"
+
+// specHash returns the hex encoded SHA-256 hash of the spec, ignoring the fields at
+// the given paths. A path is a dot separated list of JSON field names relative to the
+// spec, such as "httpOption". Fields inside lists can't be ignored individually.
+func specHash(spec interface{}, ignored []string) (string, error) {
+	u, err := comparedSpec(spec, ignored)
+	if err != nil {
+		return "", err
+	}
+	// Map keys are sorted when encoding, so the hash is stable.
+	b, err := json.Marshal(u)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode spec: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// comparedSpec returns the spec as unstructured object without the fields at the given
+// paths, the form of the spec that is hashed.
+func comparedSpec(spec interface{}, ignored []string) (map[string]interface{}, error) {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(spec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert spec: %w", err)
+	}
+	for _, path := range ignored {
+		unstructured.RemoveNestedField(u, strings.Split(path, ".")...)
+	}
+	return u, nil
+}
+
+// ingressDiff returns the differences between the existing and the desired generated
+// ingress that make the reconciler update it: those of the specs as they are hashed, with
+// the webhook defaults applied and the ignored fields removed, and those of the annotations.
+func ingressDiff(existing, desired *v1alpha1.Ingress, ignored []string) (string, error) {
+	existingCompared, err := comparedIngress(existing, ignored)
+	if err != nil {
+		return "", err
+	}
+	desiredCompared, err := comparedIngress(desired, ignored)
+	if err != nil {
+		return "", err
+	}
+	return kmp.SafeDiff(existingCompared, desiredCompared)
+}
+
+// comparedIngress returns the annotations and the spec of the ingress the reconciler
+// compares to decide whether to update it.
+func comparedIngress(ing *v1alpha1.Ingress, ignored []string) (map[string]interface{}, error) {
+	spec, err := comparedSpec(normalizeIngressSpec(&ing.Spec), ignored)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"annotations": filterServerManagedAnnotations(ing.Annotations),
+		"spec":        spec,
+	}, nil
+}
+
+// ingressSpecHash returns the hash of the ingress spec with the defaults of the networking
+// webhook applied, so an ingress as returned by the API server hashes like the spec it was
+// made from. The status isn't part of the hash, status changes never update the spec.
+func ingressSpecHash(spec *v1alpha1.IngressSpec, ignored []string) (string, error) {
+	return specHash(normalizeIngressSpec(spec), ignored)
+}
+
+// normalizeIngressSpec returns a copy of the spec with the defaults of the networking
+// webhook applied, such as the visibility of the rules and the percent of a single split.
+// The defaults dereference the HTTP of the rules, rules without one keep it unset.
+func normalizeIngressSpec(spec *v1alpha1.IngressSpec) *v1alpha1.IngressSpec {
+	normalized := spec.DeepCopy()
+	var withoutHTTP []int
+	for i := range normalized.Rules {
+		if normalized.Rules[i].HTTP == nil {
+			normalized.Rules[i].HTTP = &v1alpha1.HTTPIngressRuleValue{}
+			withoutHTTP = append(withoutHTTP, i)
+		}
+	}
+	normalized.SetDefaults(context.Background())
+	for _, i := range withoutHTTP {
+		normalized.Rules[i].HTTP = nil
+	}
+	return normalized
+}
+
+// validateFieldPaths returns an error if a path has an empty field name.
+func validateFieldPaths(paths []string) error {
+	for _, path := range paths {
+		for _, field := range strings.Split(path, ".") {
+			if field == "" {
+				return fmt.Errorf("invalid field path %q: empty field name", path)
+			}
+		}
+	}
+	return nil
+}
+
+// logIngressDiff logs the differences that make the reconciler update the generated ingress.
+func logIngressDiff(ctx context.Context, existing, desired *v1alpha1.Ingress, ignored []string) {
+	logger := logging.FromContext(ctx)
+	diff, err := ingressDiff(existing, desired, ignored)
+	if err != nil {
+		logger.Warnf("Error computing the differences of the Ingress %s: %v", desired.Name, err)
+		return
+	}
+	logger.Debugf("Updating the Ingress %s (-existing, +desired):\n%s", desired.Name, diff)
+}
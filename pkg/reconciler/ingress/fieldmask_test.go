@@ -0,0 +1,177 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/logging"
+)
+
+func TestSpecHash(t *testing.T) {
+	redirected := ingSometimesAsync.Spec.DeepCopy()
+	redirected.HTTPOption = v1alpha1.HTTPOptionRedirected
+	clientIP := corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, SessionAffinity: corev1.ServiceAffinityClientIP}
+	none := corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, SessionAffinity: corev1.ServiceAffinityNone}
+
+	tests := []struct {
+		name    string
+		a, b    interface{}
+		ignored []string
+		want    bool
+	}{{
+		name: "equal",
+		a:    ingSometimesAsync.Spec.DeepCopy(),
+		b:    ingSometimesAsync.Spec.DeepCopy(),
+		want: true,
+	}, {
+		name: "included field differs",
+		a:    ingSometimesAsync.Spec.DeepCopy(),
+		b:    redirected,
+		want: false,
+	}, {
+		name:    "excluded field differs",
+		a:       ingSometimesAsync.Spec.DeepCopy(),
+		b:       redirected,
+		ignored: []string{"httpOption"},
+		want:    true,
+	}, {
+		name:    "other field excluded",
+		a:       ingSometimesAsync.Spec.DeepCopy(),
+		b:       redirected,
+		ignored: []string{"tls"},
+		want:    false,
+	}, {
+		name:    "excluded service field differs",
+		a:       &clientIP,
+		b:       &none,
+		ignored: []string{"sessionAffinity"},
+		want:    true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := specHash(test.a, test.ignored)
+			if err != nil {
+				t.Fatalf("specHash() = %v", err)
+			}
+			b, err := specHash(test.b, test.ignored)
+			if err != nil {
+				t.Fatalf("specHash() = %v", err)
+			}
+			if got := a == b; got != test.want {
+				t.Errorf("hashes equal = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// The hash of the generated ingress is stable and follows the rules of the source.
+	changed := ingSometimesAsync.DeepCopy()
+	changed.Spec.Rules[0].Hosts = []string{testHost}
+	hashes := sets.NewString()
+	for _, source := range []*v1alpha1.Ingress{ingSometimesAsync, ingSometimesAsync.DeepCopy(), changed} {
+		hash, err := specHash(&makeNewIngress(source, ingressKourier, defaultProducer(), &Config{}).Spec, nil)
+		if err != nil {
+			t.Fatalf("specHash() = %v", err)
+		}
+		hashes.Insert(hash)
+	}
+	if hashes.Len() != 2 {
+		t.Errorf("Generated ingress hashes = %v, want one per distinct rule set", hashes.List())
+	}
+
+	// The webhook defaults are applied before hashing, rules without HTTP are kept.
+	defaulted := ingSometimesAsync.Spec.DeepCopy()
+	defaulted.Rules = append(defaulted.Rules, v1alpha1.IngressRule{Hosts: []string{testHost}})
+	undefaulted := defaulted.DeepCopy()
+	undefaulted.Rules[0].Visibility = ""
+	undefaulted.Rules[0].HTTP.Paths[0].Splits[0].Percent = 0
+	undefaulted.Rules[0].HTTP.Paths[0].DeprecatedRetries = &v1alpha1.HTTPRetry{Attempts: 3}
+	defaulted.Rules[1].Visibility = v1alpha1.IngressVisibilityExternalIP
+	a, err := ingressSpecHash(defaulted, nil)
+	if err != nil {
+		t.Fatalf("ingressSpecHash() = %v", err)
+	}
+	if b, err := ingressSpecHash(undefaulted, nil); err != nil || a != b {
+		t.Errorf("ingressSpecHash() = %s, %v, want %s with the webhook defaults", b, err, a)
+	}
+	if normalized := normalizeIngressSpec(undefaulted); normalized.Rules[1].HTTP != nil {
+		t.Errorf("normalizeIngressSpec() HTTP = %+v, want the rule without HTTP kept", normalized.Rules[1].HTTP)
+	}
+
+	if err := (&Config{IngressCompareIgnore: []string{"rules..hosts"}}).Validate(); err == nil {
+		t.Error("Validate() = nil, want error for empty field name")
+	}
+}
+
+func TestIngressDiff(t *testing.T) {
+	existing := createdIng.DeepCopy()
+	existing.Annotations["kubectl.kubernetes.io/last-applied-configuration"] = "{}"
+	existing.Spec.Rules[0].Visibility = ""
+	existing.Spec.Rules[0].HTTP.Paths[0].RewriteHost = "defaulted.example.com"
+	existing.Spec.HTTPOption = v1alpha1.HTTPOptionRedirected
+	desired := createdIng.DeepCopy()
+	desired.Annotations["async.knative.dev/force-sync-at"] = "now"
+
+	want := []string{
+		`+ "async.knative.dev/force-sync-at": "now",`,
+		`- "httpOption": string("Redirected"),`,
+		`- "rewriteHost": string("defaulted.example.com"),`,
+		fmt.Sprintf(`+ "rewriteHost": string(%q),`, desired.Spec.Rules[0].HTTP.Paths[0].RewriteHost),
+	}
+	// changedLines returns the lines of the diff marked with - or +, with their spaces
+	// normalized, as the diff varies its spaces.
+	changedLines := func(diff string) sets.String {
+		changed := sets.NewString()
+		for _, line := range strings.Split(diff, "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && (fields[0] == "-" || fields[0] == "+") {
+				changed.Insert(strings.Join(fields, " "))
+			}
+		}
+		return changed
+	}
+	diff, err := ingressDiff(existing, desired, nil)
+	if err != nil {
+		t.Fatalf("ingressDiff() = %v", err)
+	}
+	// The server managed annotations and the webhook defaults are no differences.
+	if got := changedLines(diff); !got.Equal(sets.NewString(want...)) {
+		t.Errorf("ingressDiff() changed lines = %v, want %v in\n%s", got.List(), want, diff)
+	}
+	if diff, _ := ingressDiff(existing, desired, []string{"httpOption"}); strings.Contains(diff, "httpOption") {
+		t.Errorf("ingressDiff() = %s, want no difference of the ignored httpOption", diff)
+	}
+	// The differences are logged at debug level.
+	logFile := filepath.Join(t.TempDir(), "controller.log")
+	logger, _ := logging.NewLogger(fmt.Sprintf(`{"level": "debug", "encoding": "console", "outputPaths": [%q]}`, logFile), "debug")
+	logIngressDiff(logging.WithLogger(context.Background(), logger), existing, desired, nil)
+	logger.Sync()
+	logged, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Error reading the log: %v", err)
+	}
+	if got := changedLines(string(logged)); !got.Equal(sets.NewString(want...)) {
+		t.Errorf("logged changed lines = %v, want %v in\n%s", got.List(), want, logged)
+	}
+	if !strings.Contains(string(logged), "(-existing, +desired)") {
+		t.Errorf("log = %s, want the header of the diff", logged)
+	}
+}
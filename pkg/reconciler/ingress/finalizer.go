@@ -0,0 +1,115 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"fmt"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	v1alpha1ingress "knative.dev/networking/pkg/client/injection/reconciler/networking/v1alpha1/ingress"
+	"knative.dev/pkg/kmeta"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/reconciler"
+)
+
+// finalizerName is the finalizer set on the source ingresses. The generated reconciler
+// only adds and removes its own finalizer name.
+const finalizerName = asyncIngressClassName
+
+// finalizingReconciler deletes the generated objects when their source ingress is deleted,
+// for generated objects without owner references.
+type finalizingReconciler struct {
+	*Reconciler
+}
+
+var _ v1alpha1ingress.Finalizer = (*finalizingReconciler)(nil)
+
+// reconcilerFor returns the reconciler to wrap with the generated ingress reconciler. It
+// only implements Finalizer when owner references are disabled, otherwise the garbage
+// collector deletes the generated objects and no finalizer is set on the source ingresses.
+func reconcilerFor(r *Reconciler) v1alpha1ingress.Interface {
+	if r.config.DisableOwnerReferences {
+		return &finalizingReconciler{r}
+	}
+	return r
+}
+
+// finalizerFor returns the finalizer the generated reconciler sets on the source ingresses,
+// empty unless owner references are disabled.
+func finalizerFor(cfg *Config) string {
+	if cfg.DisableOwnerReferences {
+		return finalizerName
+	}
+	return ""
+}
+
+// generatedFor returns true if the object was generated for the source ingress: it is
+// annotated with the source and the spec hash and has no other controller.
+func (c *Config) generatedFor(obj metav1.Object, source *v1alpha1.Ingress) bool {
+	annotations := obj.GetAnnotations()
+	return annotations[asyncSourceKey] == source.Name && annotations[specHashKey] != "" &&
+		c.adoptable(metav1.GetControllerOf(obj), source)
+}
+
+// FinalizeKind implements Finalizer.FinalizeKind. It deletes the objects generated for the
+// ingress, the objects of the same name generated for another source or by someone else
+// are kept.
+func (r *finalizingReconciler) FinalizeKind(ctx context.Context, ing *v1alpha1.Ingress) reconciler.Event {
+	logger := logging.FromContext(ctx)
+
+	name := r.config.generatedIngressName(ing.Namespace, ing.Name)
+	generated, err := r.ingressLister.Ingresses(ing.Namespace).Get(name)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("failed to get Ingress: %w", err)
+	}
+	if err == nil && !r.config.generatedFor(generated, ing) {
+		logger.Warnf("Not deleting the ingress %s, it was not generated for %s", name, ing.Name)
+	} else if err == nil {
+		logger.Infof("Deleting the generated ingress %s", name)
+		err := r.netclient.NetworkingV1alpha1().Ingresses(ing.Namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			return fmt.Errorf("failed to delete Ingress: %w", err)
+		}
+	}
+	if err := r.deleteStaleIngresses(ctx, ing); err != nil {
+		return err
+	}
+
+	services, err := r.serviceLister.Services(ing.Namespace).List(labels.SelectorFromSet(labels.Set{
+		preferProducerIngressLabelKey: ing.Name,
+	}))
+	if err != nil {
+		return fmt.Errorf("Failed to list async K8s Services: %w", err)
+	}
+	service, err := r.serviceLister.Services(ing.Namespace).Get(kmeta.ChildName(ing.Name, asyncSuffix))
+	if err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("Failed to get async K8s Service: %w", err)
+	} else if err == nil {
+		services = append(services, service)
+	}
+	for _, svc := range services {
+		if !r.config.generatedFor(svc, ing) {
+			logger.Warnf("Not deleting K8s service %s, it was not generated for %s", svc.Name, ing.Name)
+			continue
+		}
+		if err := r.deleteService(ctx, svc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
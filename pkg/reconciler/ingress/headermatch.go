@@ -0,0 +1,81 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"strings"
+
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+// withLegacyHeaderMatches returns the paths with a copy of every path matching headers by
+// a name that isn't lower case, placed right after it and matching the lower case names.
+// Older data planes compare header names case sensitively against the lower case names
+// of HTTP/2, newer ones match the canonical names; both copies route the same requests,
+// so routing is unchanged across an upgrade. It is meant for the upgrade window only.
+func withLegacyHeaderMatches(paths []v1alpha1.HTTPIngressPath) []v1alpha1.HTTPIngressPath {
+	dual := make([]v1alpha1.HTTPIngressPath, 0, 2*len(paths))
+	for _, path := range paths {
+		dual = append(dual, path)
+		if legacy, ok := legacyHeaderMatch(path); ok {
+			dual = append(dual, legacy)
+		}
+	}
+	return dual
+}
+
+// legacyHeaderMatch returns a copy of the path matching the lower case header names, or
+// false if the path already matches lower case names only.
+func legacyHeaderMatch(path v1alpha1.HTTPIngressPath) (v1alpha1.HTTPIngressPath, bool) {
+	changed := false
+	headers := make(map[string]v1alpha1.HeaderMatch, len(path.Headers))
+	for name, match := range path.Headers {
+		lower := strings.ToLower(name)
+		changed = changed || lower != name
+		headers[lower] = match
+	}
+	if !changed {
+		return v1alpha1.HTTPIngressPath{}, false
+	}
+	legacy := *path.DeepCopy()
+	legacy.Headers = headers
+	return legacy, true
+}
+
+// preferValueCasings are the casings of the Prefer values matched in addition to the
+// lower case ones. Knative ingresses only match header values exactly, so a case
+// insensitive match is approximated by the casings clients send in practice.
+var preferValueCasings = map[string][]string{
+	preferAsyncValue: {"Respond-Async", "RESPOND-ASYNC"},
+	preferSyncValue:  {"Respond-Sync", "RESPOND-SYNC"},
+}
+
+// withPreferValueCasings returns the paths with copies of every path matching a Prefer
+// value, placed right after it and matching the other casings of the value.
+func withPreferValueCasings(paths []v1alpha1.HTTPIngressPath) []v1alpha1.HTTPIngressPath {
+	cased := make([]v1alpha1.HTTPIngressPath, 0, len(paths))
+	for _, path := range paths {
+		cased = append(cased, path)
+		match, ok := path.Headers[preferHeaderField]
+		if !ok {
+			continue
+		}
+		for _, value := range preferValueCasings[match.Exact] {
+			copied := *path.DeepCopy()
+			copied.Headers[preferHeaderField] = v1alpha1.HeaderMatch{Exact: value}
+			cased = append(cased, copied)
+		}
+	}
+	return cased
+}
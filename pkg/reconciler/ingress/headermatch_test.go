@@ -0,0 +1,188 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/runtime"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+
+	. "knative.dev/async-component/pkg/reconciler/testing"
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+func TestWithLegacyHeaderMatches(t *testing.T) {
+	canonical := v1alpha1.HTTPIngressPath{
+		Path:    "/",
+		Headers: map[string]v1alpha1.HeaderMatch{"Prefer": {Exact: preferAsyncValue}, "x-tenant": {Exact: "a"}},
+	}
+	lower := v1alpha1.HTTPIngressPath{
+		Path:    "/",
+		Headers: map[string]v1alpha1.HeaderMatch{"prefer": {Exact: preferAsyncValue}, "x-tenant": {Exact: "a"}},
+	}
+	plain := v1alpha1.HTTPIngressPath{Path: "/"}
+
+	got := withLegacyHeaderMatches([]v1alpha1.HTTPIngressPath{canonical, lower, plain})
+	want := []v1alpha1.HTTPIngressPath{canonical, lower, lower, plain}
+	if !equality.Semantic.DeepEqual(got, want) {
+		t.Errorf("withLegacyHeaderMatches() = %+v, want %+v", got, want)
+	}
+	if _, ok := canonical.Headers["prefer"]; ok {
+		t.Error("withLegacyHeaderMatches() changed the headers of the source path")
+	}
+}
+
+func TestLegacyHeaderMatches(t *testing.T) {
+	legacy := *conditionalAsyncPaths[0].DeepCopy()
+	legacy.Headers = map[string]v1alpha1.HeaderMatch{"prefer": {Exact: preferAsyncValue}}
+	dual := ingressWithPaths(defaultNamespace, testingName, statusUnknown,
+		[]v1alpha1.HTTPIngressPath{conditionalAsyncPaths[0], legacy, conditionalAsyncPaths[1]})
+
+	table := TableTest{{
+		Name: "both header match forms",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{LegacyHeaderMatches: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			dual,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "canonical header matches by default",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestWithPreferValueCasings(t *testing.T) {
+	async := v1alpha1.HTTPIngressPath{
+		Path:    "/",
+		Headers: map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferAsyncValue}, "x-tenant": {Exact: "a"}},
+	}
+	sync := v1alpha1.HTTPIngressPath{
+		Path:    "/",
+		Headers: map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferSyncValue}},
+	}
+	other := v1alpha1.HTTPIngressPath{
+		Path:    "/",
+		Headers: map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: "respond-async; producer=b"}},
+	}
+	plain := v1alpha1.HTTPIngressPath{Path: "/"}
+	withPrefer := func(path v1alpha1.HTTPIngressPath, value string) v1alpha1.HTTPIngressPath {
+		copied := *path.DeepCopy()
+		copied.Headers[preferHeaderField] = v1alpha1.HeaderMatch{Exact: value}
+		return copied
+	}
+
+	got := withPreferValueCasings([]v1alpha1.HTTPIngressPath{async, sync, other, plain})
+	want := []v1alpha1.HTTPIngressPath{
+		async, withPrefer(async, "Respond-Async"), withPrefer(async, "RESPOND-ASYNC"),
+		sync, withPrefer(sync, "Respond-Sync"), withPrefer(sync, "RESPOND-SYNC"),
+		other, plain,
+	}
+	if !equality.Semantic.DeepEqual(got, want) {
+		t.Errorf("withPreferValueCasings() = %+v, want %+v", got, want)
+	}
+	if async.Headers[preferHeaderField].Exact != preferAsyncValue {
+		t.Error("withPreferValueCasings() changed the headers of the source path")
+	}
+}
+
+func TestCaseInsensitivePrefer(t *testing.T) {
+	titleCase := *conditionalAsyncPaths[0].DeepCopy()
+	titleCase.Headers[preferHeaderField] = v1alpha1.HeaderMatch{Exact: "Respond-Async"}
+	upperCase := *conditionalAsyncPaths[0].DeepCopy()
+	upperCase.Headers[preferHeaderField] = v1alpha1.HeaderMatch{Exact: "RESPOND-ASYNC"}
+	mixed := ingressWithPaths(defaultNamespace, testingName, statusUnknown,
+		[]v1alpha1.HTTPIngressPath{conditionalAsyncPaths[0], titleCase, upperCase, conditionalAsyncPaths[1]})
+
+	table := TableTest{{
+		Name: "mixed-case Prefer values",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{CaseInsensitivePrefer: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			mixed,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "lower case Prefer values by default",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestNormalizePreferHeader(t *testing.T) {
+	normalized := *conditionalAsyncPaths[0].DeepCopy()
+	normalized.AppendHeaders[preferHeaderField] = preferAsyncValue
+	titleCase := *normalized.DeepCopy()
+	titleCase.Headers[preferHeaderField] = v1alpha1.HeaderMatch{Exact: "Respond-Async"}
+	upperCase := *normalized.DeepCopy()
+	upperCase.Headers[preferHeaderField] = v1alpha1.HeaderMatch{Exact: "RESPOND-ASYNC"}
+
+	// How a Prefer header sent more than once is matched depends on the data plane, the
+	// requests it routes to the producer carry a single respond-async value.
+	table := TableTest{{
+		Name: "producer sees a single canonical Prefer value",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{NormalizePreferHeader: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown,
+				[]v1alpha1.HTTPIngressPath{normalized, conditionalAsyncPaths[1]}),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "mixed-case Prefer values are normalized too",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{NormalizePreferHeader: true, CaseInsensitivePrefer: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown,
+				[]v1alpha1.HTTPIngressPath{normalized, titleCase, upperCase, conditionalAsyncPaths[1]}),
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+
+	header := ingSometimesAsync.DeepCopy()
+	header.Annotations[AsyncModeAnnotationKey] = asyncHeaderMode
+	header.Annotations[asyncHeaderNameKey] = "X-User-Tier"
+	header.Annotations[asyncHeaderValueKey] = "premium"
+	ing := makeNewIngress(header, ingressKourier, defaultProducer(), &Config{NormalizePreferHeader: true})
+	if got, ok := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders[preferHeaderField]; ok {
+		t.Errorf("Prefer = %q, want no header in header mode", got)
+	}
+}
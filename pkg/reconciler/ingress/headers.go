@@ -0,0 +1,177 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/kmeta"
+	"knative.dev/pkg/network"
+)
+
+const (
+	// asyncOriginalHostHeader is used by the producer to build the URL the consumer
+	// calls, so it must never carry a value sent by the client.
+	asyncOriginalHostHeader = "Async-Original-Host"
+
+	// asyncAcceptedStatusHeader passes the status code configured with the
+	// accepted-status annotation, for the producer to answer accepted requests with.
+	asyncAcceptedStatusHeader = "Async-Accepted-Status"
+
+	// asyncGatewaySignatureHeader carries the signature of the original host, for
+	// the producer to verify the request was routed through the gateway.
+	asyncGatewaySignatureHeader = "Async-Gateway-Signature"
+
+	// asyncOriginalIngressClassHeader carries the class of the generated ingress, i.e.
+	// the gateway the request was routed through.
+	asyncOriginalIngressClassHeader = "Async-Original-Ingress-Class"
+
+	// asyncModeHeader carries the async mode resolved for the path of the request, for
+	// producers logging or adjusting to it.
+	asyncModeHeader = "Async-Mode"
+
+	// asyncOriginalHostHeaderKey set to "false" omits the Async-Original-Host header, for
+	// producers doing their own routing. The default producer needs the header.
+	asyncOriginalHostHeaderKey = "async.knative.dev/original-host-header"
+
+	// envoyRequestIDHeader is the request ID header Envoy generates for every request,
+	// the idempotency key of requests without one if no RequestIDHeader is configured.
+	envoyRequestIDHeader = "x-request-id"
+
+	// Informational headers, handled according to the InformationalHeaderPolicy.
+	asyncOriginClusterHeader     = "Async-Origin-Cluster"
+	asyncOriginRegionHeader      = "Async-Origin-Region"
+	asyncOriginalRequestIDHeader = "Async-Original-Request-Id"
+)
+
+// producerHeaders returns the headers set on requests routed to the producer. Knative
+// ingresses overwrite the request headers with the AppendHeaders values, so a client
+// can't spoof the headers set here. The ingress API has no way to remove request
+// headers, other Async-* headers sent by the client are passed on unchanged.
+func producerHeaders(ingress *v1alpha1.Ingress, ingressClass string, cfg *Config) map[string]string {
+	headers := make(map[string]string)
+	if originalHostHeaderEnabled(ingress.Annotations) {
+		headers[asyncOriginalHostHeader] = originalHost(ingress, cfg)
+	}
+	if status := ingress.Annotations[asyncAcceptedStatusKey]; status != "" {
+		headers[asyncAcceptedStatusHeader] = status
+	}
+	if cfg.gatewaySigningKey != "" {
+		headers[asyncGatewaySignatureHeader] = gatewaySignature(cfg.gatewaySigningKey, originalHost(ingress, cfg))
+	}
+	if cfg.OriginalIngressClassHeader {
+		headers[asyncOriginalIngressClassHeader] = ingressClass
+	}
+	if cfg.IdempotencyKeyHeader != "" {
+		headers[cfg.IdempotencyKeyHeader] = idempotencyKey(cfg)
+	}
+	if cfg.InformationalHeaderPolicy == clientHeaderPolicy {
+		return headers
+	}
+	if cfg.ClusterName != "" {
+		headers[asyncOriginClusterHeader] = cfg.ClusterName
+	}
+	if cfg.ClusterRegion != "" {
+		headers[asyncOriginRegionHeader] = cfg.ClusterRegion
+	}
+	if cfg.RequestIDHeader != "" {
+		headers[asyncOriginalRequestIDHeader] = envoyRequestHeader(cfg.RequestIDHeader)
+	}
+	return headers
+}
+
+// withAsyncModeHeader returns a copy of the producer path setting the Async-Mode header to
+// the short name of the mode: always, conditional, header or never. Modes the paths are
+// generated for as conditional are reported as conditional.
+func withAsyncModeHeader(producer v1alpha1.HTTPIngressPath, mode string) v1alpha1.HTTPIngressPath {
+	name := "conditional"
+	switch mode {
+	case asyncAlwaysMode, asyncHeaderMode, asyncNeverMode:
+		name = strings.TrimSuffix(mode, ".async.knative.dev")
+	}
+	withMode := *producer.DeepCopy()
+	withMode.AppendHeaders = kmeta.UnionMaps(withMode.AppendHeaders, map[string]string{asyncModeHeader: name})
+	return withMode
+}
+
+// originalHostHeaderEnabled returns false if the annotations disable the Async-Original-Host
+// header. The value was validated before.
+func originalHostHeaderEnabled(annotations map[string]string) bool {
+	value, ok := annotations[asyncOriginalHostHeaderKey]
+	if !ok {
+		return true
+	}
+	enabled, _ := strconv.ParseBool(value)
+	return enabled
+}
+
+// gatewaySignature returns the hex encoded HMAC-SHA256 of the original host.
+func gatewaySignature(key, host string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(host))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// originalHost returns the host of the service in the configured format. The external
+// format falls back to the cluster local hostname for ingresses the visibility label
+// makes cluster-local, their public hosts aren't reachable.
+func originalHost(ingress *v1alpha1.Ingress, cfg *Config) string {
+	switch cfg.OriginalHostFormat {
+	case shortOriginalHost:
+		return ingress.Name + "." + ingress.Namespace
+	case externalOriginalHost:
+		if cfg.labeledClusterLocal(ingress) {
+			break
+		}
+		for _, rule := range ingress.Spec.Rules {
+			if rule.Visibility == v1alpha1.IngressVisibilityExternalIP && len(rule.Hosts) > 0 {
+				return rule.Hosts[0]
+			}
+		}
+	}
+	return network.GetServiceHostname(ingress.Name, ingress.Namespace)
+}
+
+// validateGeneratedHostnames returns an error if the hostnames used in the generated
+// ingress and service are not valid DNS names.
+func validateGeneratedHostnames(ingress *v1alpha1.Ingress, producer Producer, cfg *Config) error {
+	for _, host := range []string{producer.Hostname(), originalHost(ingress, cfg)} {
+		if errs := validation.IsFullyQualifiedDomainName(field.NewPath("host"), host); len(errs) > 0 {
+			return errs.ToAggregate()
+		}
+	}
+	return nil
+}
+
+// idempotencyKey returns the Envoy substitution for the idempotency key: the key sent by
+// the client, or the request ID if there is none.
+func idempotencyKey(cfg *Config) string {
+	requestID := cfg.RequestIDHeader
+	if requestID == "" {
+		requestID = envoyRequestIDHeader
+	}
+	return envoyRequestHeader(cfg.IdempotencyKeyHeader + "?" + requestID)
+}
+
+// envoyRequestHeader returns the Envoy substitution for the value of a request header.
+func envoyRequestHeader(header string) string {
+	return "%REQ(" + header + ")%"
+}
@@ -2,39 +2,92 @@ package ingress
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"math/rand"
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	corev1listers "k8s.io/client-go/listers/core/v1"
+	networkingv1listers "k8s.io/client-go/listers/networking/v1"
 	"knative.dev/networking/pkg/apis/networking"
 	"knative.dev/networking/pkg/apis/networking/v1alpha1"
 	netclientset "knative.dev/networking/pkg/client/clientset/versioned"
 	networkinglisters "knative.dev/networking/pkg/client/listers/networking/v1alpha1"
 
+	"knative.dev/pkg/controller"
 	"knative.dev/pkg/kmeta"
 	"knative.dev/pkg/logging"
 	network "knative.dev/pkg/network"
 	"knative.dev/pkg/reconciler"
-	"knative.dev/pkg/system"
 )
 
 // Reconciler implements controller.Reconciler for Ingress resources.
 type Reconciler struct {
-	ingressLister networkinglisters.IngressLister
-	serviceLister corev1listers.ServiceLister
-	netclient     netclientset.Interface
-	kubeclient    kubernetes.Interface
+	ingressLister   networkinglisters.IngressLister
+	serviceLister   corev1listers.ServiceLister
+	endpointsLister corev1listers.EndpointsLister
+	// policyLister lists the NetworkPolicies of the producers, it is set by the controller
+	// when ProducerNetworkPolicy is enabled.
+	policyLister networkingv1listers.NetworkPolicyLister
+	// secretLister lists the gateway signing Secret, it is set by the controller when
+	// GatewaySigningSecret is configured.
+	secretLister corev1listers.SecretLister
+	netclient    netclientset.Interface
+	kubeclient   kubernetes.Interface
+	config       Config
+
+	// enqueueAfter requeues ingresses waiting for the producer, it is set by the controller.
+	enqueueAfter func(interface{}, time.Duration)
+	backoff      notReadyBackoff
+	failures     probeFailures
+	readiness    readinessCache
+	lastReady    lastReadyTimes
+	httpClient   *http.Client
+
+	// clock and random time the jitter before the generated ingress is written.
+	clock  clock.Clock
+	random func() float64
+}
+
+// NewReconciler returns a Reconciler using the given listers, clients and Config.
+// It can be wrapped with the generated ingress reconciler by other controllers and tests.
+func NewReconciler(
+	ingressLister networkinglisters.IngressLister,
+	serviceLister corev1listers.ServiceLister,
+	endpointsLister corev1listers.EndpointsLister,
+	netclient netclientset.Interface,
+	kubeclient kubernetes.Interface,
+	config Config,
+) *Reconciler {
+	return &Reconciler{
+		ingressLister:   ingressLister,
+		serviceLister:   serviceLister,
+		endpointsLister: endpointsLister,
+		netclient:       netclient,
+		kubeclient:      kubeclient,
+		config:          config,
+		httpClient:      probeClient(http.DefaultTransport),
+		clock:           clock.RealClock{},
+		random:          rand.Float64,
+	}
 }
 
 const (
 	AsyncModeAnnotationKey  = "async.knative.dev/mode"
+	ownedHostsAnnotationKey = "async.knative.dev/owned-hosts"
 	asyncSuffix             = "-async"
 	newSuffix               = "-new"
 	preferHeaderField       = "Prefer"
@@ -42,74 +95,322 @@ const (
 	preferSyncValue         = "respond-sync"
 	asyncAlwaysMode         = "always.async.knative.dev"
 	asyncConditionalMode    = "conditional.async.knative.dev"
+	asyncHeaderMode         = "header.async.knative.dev"
+	asyncHeaderNameKey      = "async.knative.dev/header-name"
+	asyncHeaderValueKey     = "async.knative.dev/header-value"
+	asyncPathModesKey       = "async.knative.dev/path-modes"
+	asyncNeverMode          = "never.async.knative.dev"
+	asyncAcceptedStatusKey  = "async.knative.dev/accepted-status"
+	asyncProducerServiceKey = "async.knative.dev/producer-service"
+	asyncRoutesKey          = "async.knative.dev/async-routes"
 	publicLBDomain          = "kourier.kourier-system.svc.cluster.local"
 	privateLBDomain         = "kourier-internal.kourier-system.svc.cluster.local"
 	producerServiceName     = "async-producer"
-	asyncOriginalHostHeader = "Async-Original-Host"
 	ingressClassName        = "INGRESS_CLASS_NAME"
 	ingressKourier          = "kourier.ingress.networking.knative.dev"
 )
 
+const (
+	// asyncSplitModeKey selects how async requests reach the producer. In route mode the
+	// producer answers the request. Mirror mode, sending the producer a copy while the
+	// service answers, is rejected: Knative ingresses can't mirror traffic.
+	asyncSplitModeKey = "async.knative.dev/split-mode"
+	routeSplitMode    = "route"
+	mirrorSplitMode   = "mirror"
+)
+
+const (
+	// asyncValidationKey set to "skip" exempts an ingress from the validation of its
+	// annotations, e.g. while migrating ingresses carrying experimental values.
+	asyncValidationKey = "async.knative.dev/validation"
+	skipValidation     = "skip"
+)
+
+// asyncForceSyncAtKey set to a new value, e.g. the current time, writes the generated
+// objects again without changing the spec of the ingress.
+const asyncForceSyncAtKey = "async.knative.dev/force-sync-at"
+
+// sourceGenerationKey is set on the generated ingress to the generation of the source
+// ingress with SourceGenerationAnnotation.
+const sourceGenerationKey = "async.knative.dev/source-generation"
+
 type loadBalancerDomain struct {
 	Private, Public string
 }
 
 var loadBalancers = map[string]loadBalancerDomain{
-	"istio":   loadBalancerDomain{"istio-ingressgateway.istio-system.svc.cluster.local", "knative-local-gateway.istio-system.svc.cluster.local"},
-	"kourier": loadBalancerDomain{"kourier.kourier-system.svc.cluster.local", "kourier.kourier-system.svc.cluster.local"},
+	"istio":   loadBalancerDomain{"knative-local-gateway.istio-system.svc.cluster.local", "istio-ingressgateway.istio-system.svc.cluster.local"},
+	"kourier": loadBalancerDomain{privateLBDomain, publicLBDomain},
 	// "contour":    loadBalancerDomain{"",""},
 	// "ambassador": loadBalancerDomain{"",""}, TODO Add contour/ambassador after successful tests in cluster
 }
 
 // ReconcileKind implements Interface.ReconcileKind.
 func (r *Reconciler) ReconcileKind(ctx context.Context, ing *v1alpha1.Ingress) reconciler.Event {
+	var metricClass, metricMode string
+	defer func(start time.Time) {
+		reportReconcileLatency(ctx, start, metricClass, metricMode, ing.Annotations[asyncMetricLabelsKey])
+	}(time.Now())
 	logger := logging.FromContext(ctx)
-	ingressClass := os.Getenv(ingressClassName)
 
-	if _, ok := loadBalancers[strings.Split(ingressClass, ".")[0]]; !ok {
-		ingressClass = ingressKourier
+	if reason := r.config.skipReason(ing); reason != "" {
+		logger.Debugf("Skipping ingress, %s", reason)
+		return nil
 	}
 
-	err := validateAsyncModeAnnotation(ing.Annotations)
+	conditions := conditionsFor(ing, &r.config)
+	err := validateIngress(ctx, ing, &r.config)
 	if err != nil {
 		logger.Errorf("error validating ingress annotations: %w", err)
+		conditions.markStep(annotationValidCondition, corev1.ConditionFalse, invalidAnnotationReason, err.Error())
 		return err
 	}
+	conditions.markStep(annotationValidCondition, corev1.ConditionTrue, "", "")
+	ingressClass, err := r.ingressClassFor(ing)
+	if err != nil {
+		logger.Errorf("error resolving the ingress class: %v", err)
+		return err
+	}
+	metricClass = ingressClass
 
-	markIngressReady(ing)
-	desired := makeNewIngress(ing, ingressClass)
-	service := MakeK8sService(ing)
-	_, err = r.reconcileIngress(ctx, desired)
+	producer, err := r.resolveProducer(ing)
+	var routeErr *kserviceRouteError
+	if errors.As(err, &routeErr) {
+		logger.Warn(routeErr.message)
+		conditions.markNotConfigured(producerRouteReason, routeErr.message)
+		conditions.markStep(producerReadyCondition, corev1.ConditionFalse, producerRouteReason, routeErr.message)
+		return nil
+	} else if err != nil {
+		logger.Errorf("error resolving the producer: %v", err)
+		return err
+	}
+
+	if msg, err := r.checkProducerService(producer); err != nil {
+		logger.Errorf("error checking the producer service: %v", err)
+		return err
+	} else if msg != "" {
+		logger.Warn(msg)
+		conditions.markWaitingForProducer(producerMissingReason, msg)
+		return nil
+	}
+	if host, loop := producerLoop(ing, producer); loop {
+		msg := fmt.Sprintf("The producer host %s routes to this ingress itself, refusing to generate a routing loop", host)
+		logger.Warn(msg)
+		conditions.markNotConfigured(producerLoopReason, msg)
+		return nil
+	}
+	if backend, ok := crossNamespaceBackend(ing); ok {
+		msg := fmt.Sprintf("The backend %s/%s is not in the namespace of the ingress, Knative ingresses can't route to other namespaces",
+			backend.ServiceNamespace, backend.ServiceName)
+		logger.Warn(msg)
+		conditions.markNotConfigured(crossNamespaceReason, msg)
+		return nil
+	}
+	if err := validateGeneratedHostnames(ing, producer, &r.config); err != nil {
+		msg := fmt.Sprintf("The generated routes are invalid, the ingress name or namespace may be too long: %v", err)
+		logger.Warn(msg)
+		conditions.markNotConfigured(invalidHostnameReason, msg)
+		return nil
+	}
+
+	cfg, err := r.generateConfig()
+	var signingErr *gatewaySigningError
+	if errors.As(err, &signingErr) {
+		logger.Warn(signingErr.message)
+		conditions.markNotConfigured(signingSecretReason, signingErr.message)
+		return nil
+	} else if err != nil {
+		logger.Errorf("error reading the gateway signing secret: %v", err)
+		return err
+	}
+
+	source, forced := sourceFor(ctx, ing)
+	metricMode = asyncModeOf(source)
+	if forced {
+		logger.Infof("Namespace %s is forced to be asynchronous by %s, overriding the async mode of the ingress", ing.Namespace, PolicyConfigName)
+		conditions.markInfo(asyncModeOverriddenCondition, namespacePolicyReason,
+			"The namespace %s is forced to %s by the cluster policy", ing.Namespace, asyncAlwaysMode)
+	} else {
+		conditions.ClearCondition(asyncModeOverriddenCondition)
+	}
+
+	ready, err := r.waitForProducer(ctx, ing, producer)
+	if err != nil {
+		logger.Errorf("error checking the producer readiness: %v", err)
+		return err
+	}
+	if !knownLoadBalancer(ingressClass) {
+		msg := fmt.Sprintf("The load balancers of the ingress class %s are unknown, the status points to the default load balancers", ingressClass)
+		logger.Warn(msg)
+		controller.GetEventRecorder(ctx).Event(ing, corev1.EventTypeWarning, "DefaultLoadBalancer", msg)
+		conditions.markWarning(defaultLoadBalancerCondition, unknownIngressClassReason, "%s", msg)
+	} else {
+		conditions.ClearCondition(defaultLoadBalancerCondition)
+	}
+	if ready {
+		markIngressReady(ing, ingressClass, &r.config)
+	}
+	desired, service, preferServices := makeChildren(source, ingressClass, producer, cfg)
+	for _, svc := range append([]*corev1.Service{service}, preferServices...) {
+		if !routesToService(desired, svc.Name) {
+			continue
+		}
+		msg, err := r.serviceConflict(ing, svc)
+		if err != nil {
+			logger.Errorf("error checking the service %s: %v", svc.Name, err)
+			return err
+		}
+		if msg != "" {
+			logger.Warn(msg)
+			conditions.markNotConfigured(serviceConflictReason, msg)
+			conditions.markStep(serviceReadyCondition, corev1.ConditionFalse, serviceConflictReason, msg)
+			return nil
+		}
+	}
+	if path, total, ok := invalidSplitPercents(desired); ok {
+		msg := fmt.Sprintf("The splits of the generated path %q total %d%%, they must total 100%%", path, total)
+		logger.Warn(msg)
+		conditions.markNotConfigured(invalidSplitsReason, msg)
+		return nil
+	}
+	if paths := countPaths(desired); paths > r.config.maxGeneratedPaths() {
+		logger.Warnf("The generated ingress %s has %d paths, more than the limit of %d", desired.Name, paths, r.config.maxGeneratedPaths())
+		conditions.markWarning(tooManyPathsCondition, tooManyPathsReason,
+			"The generated ingress has %d paths, more than the limit of %d", paths, r.config.maxGeneratedPaths())
+	} else {
+		conditions.ClearCondition(tooManyPathsCondition)
+	}
+	if r.config.ReportGeneratedRoutes {
+		producerServices := sets.NewString(service.Name)
+		for _, svc := range preferServices {
+			producerServices.Insert(svc.Name)
+		}
+		async, sync := countRoutes(desired, producerServices)
+		conditions.markInfo(routesGeneratedCondition, routesGeneratedReason,
+			"The generated ingress has %d async and %d sync paths in %s mode", async, sync, asyncModeOf(source))
+	} else {
+		conditions.ClearCondition(routesGeneratedCondition)
+	}
+	child, err := r.reconcileIngress(ctx, desired)
+	var rejected *ingressRejectedError
+	if errors.As(err, &rejected) {
+		logger.Warnf("The generated ingress %s was rejected: %v", desired.Name, rejected)
+		msg := fmt.Sprintf("The generated ingress was rejected: %v", rejected)
+		conditions.markNotConfigured(ingressRejectedReason, msg)
+		conditions.markStep(childIngressReadyCondition, corev1.ConditionFalse, ingressRejectedReason, msg)
+		return nil
+	}
 	if err != nil {
 		logger.Errorf("error reconciling ingress: %s", desired.Name)
 		return err
 	}
-	err = r.reconcileService(ctx, service)
+	conditions.markChildIngress(child)
+	if err := r.deleteStaleIngresses(ctx, ing); err != nil {
+		logger.Errorf("error deleting the stale generated ingresses: %v", err)
+		return err
+	}
+	if routesToService(desired, service.Name) {
+		err = r.reconcileService(ctx, service)
+	} else {
+		// All paths are synchronous, the service is not needed.
+		err = r.deleteService(ctx, service)
+	}
 	if err != nil {
 		logger.Errorf("error reconciling service: %s", service.Name)
 		return err
 	}
+	if err := r.reconcilePreferServices(ctx, ing, desired, preferServices); err != nil {
+		logger.Errorf("error reconciling the prefer producer services: %v", err)
+		return err
+	}
+	conditions.markStep(serviceReadyCondition, corev1.ConditionTrue, "", "")
+	if err := r.reconcileNetworkPolicy(ctx, ing, producer); err != nil {
+		logger.Errorf("error reconciling the producer network policy: %v", err)
+		return err
+	}
 	return nil
 }
 
+// asyncModeOf returns the async mode of the ingress, conditional if it has no mode annotation.
+func asyncModeOf(ing *v1alpha1.Ingress) string {
+	if mode := ing.Annotations[AsyncModeAnnotationKey]; mode != "" {
+		return mode
+	}
+	return asyncConditionalMode
+}
+
+// sourceFor returns the ingress the generated objects are made from, a copy of the
+// ingress in always mode if the policy forces its namespace to be asynchronous.
+func sourceFor(ctx context.Context, ing *v1alpha1.Ingress) (*v1alpha1.Ingress, bool) {
+	if policyFromContext(ctx).forcesAsync(ing.Namespace) &&
+		(ing.Annotations[AsyncModeAnnotationKey] != asyncAlwaysMode || ing.Annotations[asyncPathModesKey] != "") {
+		return forceAlwaysAsync(ing), true
+	}
+	return ing, false
+}
+
+// makeChildren returns the generated ingress, the service routing to the producer and the
+// services routing to the producers of the prefer-producers annotation.
+func makeChildren(source *v1alpha1.Ingress, ingressClass string, producer Producer, cfg *Config) (*v1alpha1.Ingress, *corev1.Service, []*corev1.Service) {
+	return makeNewIngress(source, ingressClass, producer, cfg),
+		MakeK8sService(source, ingressClass, producer, cfg),
+		makePreferServices(source, ingressClass, cfg)
+}
+
 func (r *Reconciler) reconcileIngress(ctx context.Context, desired *v1alpha1.Ingress) (*v1alpha1.Ingress, error) {
 	desired.Status.InitializeConditions()
 	ingress, err := r.ingressLister.Ingresses(desired.Namespace).Get(desired.Name)
 	if apierrs.IsNotFound(err) {
-		ingress, err = r.netclient.NetworkingV1alpha1().Ingresses(desired.Namespace).Create(ctx, desired, metav1.CreateOptions{})
+		hash, err := ingressSpecHash(&desired.Spec, r.config.IngressCompareIgnore)
+		if err != nil {
+			return nil, err
+		}
+		desired.Annotations[specHashKey] = hash
+		if err := r.staggerChildUpdate(ctx); err != nil {
+			return nil, err
+		}
+		if err := r.dryRunIngress(ctx, desired, false); err != nil {
+			return nil, err
+		}
+		ingress, err = r.netclient.NetworkingV1alpha1().Ingresses(desired.Namespace).Create(ctx, desired, r.config.createOptions())
 		if err != nil {
 			return nil, fmt.Errorf("failed to create Ingress: %w", err)
 		}
 		return ingress, nil
 	} else if err != nil {
 		return nil, err
-	} else if !equality.Semantic.DeepEqual(ingress.Spec, desired.Spec) ||
-		!equality.Semantic.DeepEqual(ingress.Annotations, desired.Annotations) {
+	}
+	if r.config.IngressUpdateStrategy == mergeUpdateStrategy {
+		desired = mergeIngress(ingress, desired)
+	}
+	existingHash, err := ingressSpecHash(&ingress.Spec, r.config.IngressCompareIgnore)
+	if err != nil {
+		return nil, err
+	}
+	desiredHash, err := ingressSpecHash(&desired.Spec, r.config.IngressCompareIgnore)
+	if err != nil {
+		return nil, err
+	}
+	desired.Annotations[specHashKey] = desiredHash
+	// The existing spec is hashed again, a manual edit of the spec keeps the hash annotation.
+	// The annotation is only compared with the other annotations, as a stamp of the last write.
+	if existingHash != desiredHash ||
+		!equality.Semantic.DeepEqual(filterServerManagedAnnotations(ingress.Annotations),
+			filterServerManagedAnnotations(desired.Annotations)) {
+		if r.config.LogIngressDiff {
+			logIngressDiff(ctx, ingress, desired, r.config.IngressCompareIgnore)
+		}
 		// Don't modify the informers copy
 		origin := ingress.DeepCopy()
 		origin.Spec = desired.Spec
 		origin.Annotations = desired.Annotations
-		updated, err := r.netclient.NetworkingV1alpha1().Ingresses(origin.Namespace).Update(ctx, origin, metav1.UpdateOptions{})
+		if err := r.staggerChildUpdate(ctx); err != nil {
+			return nil, err
+		}
+		if err := r.dryRunIngress(ctx, origin, true); err != nil {
+			return nil, err
+		}
+		updated, err := r.netclient.NetworkingV1alpha1().Ingresses(origin.Namespace).Update(ctx, origin, r.config.updateOptions())
 		if err != nil {
 			return nil, fmt.Errorf("failed to update Ingress: %w", err)
 		}
@@ -118,89 +419,409 @@ func (r *Reconciler) reconcileIngress(ctx context.Context, desired *v1alpha1.Ing
 	return ingress, err
 }
 
+// mergeIngress returns a copy of desired that keeps the rules, annotations and spec
+// fields other controllers set on the existing ingress. Only the rules and TLS settings
+// for the hosts the reconciler generated (now or on the previous reconcile) are replaced.
+func mergeIngress(existing, desired *v1alpha1.Ingress) *v1alpha1.Ingress {
+	merged := desired.DeepCopy()
+	owned := sets.NewString()
+	for _, rule := range desired.Spec.Rules {
+		owned.Insert(rule.Hosts...)
+	}
+	merged.Annotations = mergeAnnotations(existing.Annotations, desired.Annotations)
+	merged.Annotations[ownedHostsAnnotationKey] = strings.Join(owned.List(), ",")
+	if previous := existing.Annotations[ownedHostsAnnotationKey]; previous != "" {
+		owned.Insert(strings.Split(previous, ",")...)
+	}
+
+	spec := existing.Spec.DeepCopy()
+	spec.Rules = merged.Spec.Rules
+	for _, rule := range existing.Spec.Rules {
+		if !owned.HasAny(rule.Hosts...) {
+			spec.Rules = append(spec.Rules, *rule.DeepCopy())
+		}
+	}
+	spec.TLS = merged.Spec.TLS
+	for _, setting := range existing.Spec.TLS {
+		if !owned.HasAny(setting.Hosts...) {
+			spec.TLS = append(spec.TLS, *setting.DeepCopy())
+		}
+	}
+	merged.Spec = *spec
+	return merged
+}
+
 // makeNewIngress creates an Ingress object with respond-async headers pointing to async-producer
-func makeNewIngress(ingress *v1alpha1.Ingress, ingressClass string) *v1alpha1.Ingress {
+// in the namespace of the source. Ingress backends must be in the namespace of the ingress,
+// so the generated ingress and service can't be moved to another namespace.
+func makeNewIngress(ingress *v1alpha1.Ingress, ingressClass string, producer Producer, cfg *Config) *v1alpha1.Ingress {
 	original := ingress.DeepCopy()
 	splits := make([]v1alpha1.IngressBackendSplit, 0, 1)
 	splits = append(splits, v1alpha1.IngressBackendSplit{
 		IngressBackend: v1alpha1.IngressBackend{
 			ServiceName:      kmeta.ChildName(ingress.Name, asyncSuffix),
 			ServiceNamespace: original.Namespace,
-			ServicePort:      intstr.FromInt(80),
+			ServicePort:      intstr.FromInt(networking.ServicePort(cfg.producerProtocol())),
 		},
 		Percent: int(100),
 	})
-	theRules := []v1alpha1.IngressRule{}
+	// Paths have no HTTP option, the producer path is served like the rest of the ingress.
+	// Splits can't mirror traffic either, each request reaches exactly one producer. This
+	// is the route split mode, the only one the split-mode annotation accepts.
+	producerPath := v1alpha1.HTTPIngressPath{
+		Splits:        splits,
+		AppendHeaders: producerHeaders(ingress, ingressClass, cfg),
+	}
+	// The other paths are copies of the source paths. Their backends are in the namespace
+	// of the ingress like the generated service, ingresses with backends in other namespaces
+	// are refused before. The Async-Original-Host header is the host of the route, not of a
+	// backend: the consumer calls the route through the gateway.
+	// The generated service is an ExternalName service resolving to the producer, or a
+	// ClusterIP service mirroring the producer endpoints, so the rewritten host is the one
+	// of the producer either way.
+	if cfg.ProducerHostRewrite != ruleHostRewrite {
+		producerPath.RewriteHost = producer.Hostname()
+	}
+	// The annotations were validated before, or the ingress is exempt from validation and
+	// invalid values are ignored.
+	pathModes, _ := parsePathModes(ingress.Annotations[asyncPathModesKey])
+	methodRoutes, _ := parseMethodRoutes(ingress.Annotations[asyncRoutesKey])
+	preferProducers, _ := parsePreferProducers(ingress.Annotations[asyncPreferProducersKey])
+	theRules := make([]v1alpha1.IngressRule, 0, len(original.Spec.Rules))
 	for _, rule := range original.Spec.Rules {
-		newRule := rule
-		newPaths := make([]v1alpha1.HTTPIngressPath, 0)
-		if ingress.Annotations[AsyncModeAnnotationKey] == asyncAlwaysMode {
+		if rule.HTTP != nil {
+			newPaths := make([]v1alpha1.HTTPIngressPath, 0, 2*len(rule.HTTP.Paths))
 			for _, path := range rule.HTTP.Paths {
-				defaultPath := path
-				defaultPath.Splits = splits
-				defaultPath.AppendHeaders = map[string]string{
-					asyncOriginalHostHeader: network.GetServiceHostname(ingress.Name, ingress.Namespace),
+				// An empty path matches all requests like "/", the path modes and method
+				// routes treat both alike.
+				if cfg.NormalizeEmptyPaths && path.Path == "" {
+					path.Path = "/"
 				}
-				defaultPath.RewriteHost = network.GetServiceHostname(producerServiceName, system.Namespace())
-				if path.Headers == nil {
-					path.Headers = map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferSyncValue}}
-				} else {
-					path.Headers[preferHeaderField] = v1alpha1.HeaderMatch{Exact: preferSyncValue}
+				mode := pathModes.modeFor(path.Path, ingress.Annotations[AsyncModeAnnotationKey])
+				pathProducer := producerPath
+				if cfg.AsyncModeHeader {
+					pathProducer = withAsyncModeHeader(producerPath, mode)
 				}
-				newPaths = append(newPaths, path, defaultPath)
-				newRule.HTTP.Paths = newPaths
-				theRules = append(theRules, newRule)
+				if mode != asyncNeverMode {
+					newPaths = append(newPaths, makePreferPaths(path, pathProducer, preferProducers, ingress.Name)...)
+				}
+				newPaths = append(newPaths, makeMethodPaths(path, pathProducer, methodRoutes)...)
+				newPaths = append(newPaths, makeAsyncPaths(path, pathProducer, mode, ingress.Annotations, cfg)...)
+			}
+			newPaths = withMethodProducers(newPaths, splits[0].ServiceName, ingress)
+			if cfg.CaseInsensitivePrefer {
+				newPaths = withPreferValueCasings(newPaths)
 			}
-		} else {
-			newPaths = append(newPaths, v1alpha1.HTTPIngressPath{
-				Headers: map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferAsyncValue}},
-				Splits:  splits,
-				AppendHeaders: map[string]string{
-					asyncOriginalHostHeader: network.GetServiceHostname(ingress.Name, ingress.Namespace),
-				},
-				RewriteHost: network.GetServiceHostname(producerServiceName, system.Namespace()),
-			})
-			newPaths = append(newPaths, newRule.HTTP.Paths...)
-			newRule.HTTP.Paths = newPaths
-			theRules = append(theRules, newRule)
+			if cfg.LegacyHeaderMatches {
+				newPaths = withLegacyHeaderMatches(newPaths)
+			}
+			rule.HTTP.Paths = newPaths
+		}
+		if cfg.labeledClusterLocal(ingress) {
+			rule.Visibility = v1alpha1.IngressVisibilityClusterLocal
 		}
+		theRules = append(theRules, rule)
 	}
 	return &v1alpha1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      original.Name + newSuffix,
+			Name:      cfg.generatedIngressName(original.Namespace, original.Name),
 			Namespace: original.Namespace,
-			Annotations: kmeta.FilterMap(kmeta.UnionMaps(map[string]string{
-				networking.IngressClassAnnotationKey: ingressClass,
-			}), func(key string) bool {
-				return key == corev1.LastAppliedConfigAnnotation
-			}),
+			Annotations: filterServerManagedAnnotations(kmeta.UnionMaps(withManagedKeys(cfg.MeshAnnotations[ingressClass]),
+				sourceGenerationAnnotation(original, cfg), forceSyncAnnotation(original), map[string]string{
+					cfg.ingressClassAnnotationKey(): ingressClass,
+					asyncSourceKey:                  original.Name,
+				})),
 			Labels:          original.Labels,
-			OwnerReferences: original.OwnerReferences,
+			OwnerReferences: cfg.ownerReferences(original),
 		},
 		Spec: v1alpha1.IngressSpec{
 			Rules: theRules,
+			TLS:   alignTLS(original.Spec.TLS, theRules),
 		},
 	}
 }
 
-func markIngressReady(ingress *v1alpha1.Ingress) {
-	privateDomain := domainForLocalGateway(ingress.Name, true)
-	publicDomain := domainForLocalGateway(ingress.Name, false)
+// alignTLS returns the TLS settings for the hosts of the rules. The producer paths are
+// paths of the same rules, so the requests routed to the producer are terminated with the
+// certificate of the host the client requested, the producer needs no SNI of its own.
+// Hosts without a rule are dropped, and settings left without hosts.
+func alignTLS(tls []v1alpha1.IngressTLS, rules []v1alpha1.IngressRule) []v1alpha1.IngressTLS {
+	hosts := sets.NewString()
+	for _, rule := range rules {
+		hosts.Insert(rule.Hosts...)
+	}
+	var aligned []v1alpha1.IngressTLS
+	for _, setting := range tls {
+		setting := *setting.DeepCopy()
+		kept := setting.Hosts[:0]
+		for _, host := range setting.Hosts {
+			if hosts.Has(host) {
+				kept = append(kept, host)
+			}
+		}
+		if len(kept) > 0 {
+			setting.Hosts = kept
+			aligned = append(aligned, setting)
+		}
+	}
+	return aligned
+}
+
+// countPaths returns the number of paths over all rules of the ingress.
+func countPaths(ingress *v1alpha1.Ingress) int {
+	paths := 0
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP != nil {
+			paths += len(rule.HTTP.Paths)
+		}
+	}
+	return paths
+}
+
+// countRoutes returns the number of paths of the ingress routing to one of the producer
+// services and the number of the other paths.
+func countRoutes(ingress *v1alpha1.Ingress, producerServices sets.String) (async, sync int) {
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			isAsync := false
+			for _, split := range path.Splits {
+				isAsync = isAsync || producerServices.Has(split.ServiceName)
+			}
+			if isAsync {
+				async++
+			} else {
+				sync++
+			}
+		}
+	}
+	return async, sync
+}
+
+// forceSyncAnnotation returns the force-sync-at annotation of the source, copied to the
+// generated objects so a new value writes them even if their spec is unchanged.
+func forceSyncAnnotation(source *v1alpha1.Ingress) map[string]string {
+	value, ok := source.Annotations[asyncForceSyncAtKey]
+	if !ok {
+		return nil
+	}
+	return map[string]string{asyncForceSyncAtKey: value}
+}
+
+// sourceGenerationAnnotation returns the annotation with the generation of the source
+// ingress the generated ingress was made from, for tooling to tell when it is behind the
+// source. The resource version isn't used, it changes with every status update and would
+// update the generated ingress on every reconcile. The generation alone can't skip the
+// generation of the ingress, the producer and the configuration change the routes too;
+// the generated ingress is only updated when the annotation or the spec hash differ.
+func sourceGenerationAnnotation(source *v1alpha1.Ingress, cfg *Config) map[string]string {
+	if !cfg.SourceGenerationAnnotation {
+		return nil
+	}
+	return map[string]string{sourceGenerationKey: strconv.FormatInt(source.Generation, 10)}
+}
+
+// filterServerManagedAnnotations returns a copy of the annotations without the keys
+// written by clients or the API server, so they are never treated as drift.
+func filterServerManagedAnnotations(annotations map[string]string) map[string]string {
+	return kmeta.FilterMap(annotations, func(key string) bool {
+		return key == corev1.LastAppliedConfigAnnotation
+	})
+}
+
+// makeAsyncPaths returns the paths replacing a path of the source ingress in the given mode.
+// In always mode only requests preferring a synchronous response are routed to the original
+// backends, unless the async-percent annotation sends a share of the other requests to them
+// too, in conditional and header mode only the requests matching the async header are
+// routed to the producer, and in never mode the path is kept as is. With ExplicitSyncPath,
+// conditional mode also routes requests preferring a synchronous response explicitly.
+func makeAsyncPaths(path, producer v1alpha1.HTTPIngressPath, mode string, annotations map[string]string, cfg *Config) []v1alpha1.HTTPIngressPath {
+	async := routeToProducer(path, producer)
+
+	switch mode {
+	case asyncNeverMode:
+		return []v1alpha1.HTTPIngressPath{path}
+	case asyncAlwaysMode:
+		// With an async percent, requests preferring an async response explicitly are
+		// still always routed to the producer, only the others are weighted.
+		if percent, _ := parseAsyncPercent(annotations); percent < 100 {
+			async.Headers = unionHeaderMatches(path.Headers,
+				map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferAsyncValue}})
+			return []v1alpha1.HTTPIngressPath{syncBypassPath(path), async, weightedProducerPath(path, producer, percent)}
+		}
+		return []v1alpha1.HTTPIngressPath{syncBypassPath(path), async}
+	default:
+		async.Headers = unionHeaderMatches(path.Headers, asyncHeaderMatch(annotations))
+		// The path matches a single Prefer: respond-async header, setting it again replaces
+		// any other Prefer values, so the producer sees the canonical value only.
+		if cfg.NormalizePreferHeader && annotations[AsyncModeAnnotationKey] != asyncHeaderMode {
+			async.AppendHeaders = kmeta.UnionMaps(async.AppendHeaders,
+				map[string]string{preferHeaderField: preferAsyncValue})
+		}
+		if cfg.ExplicitSyncPath && annotations[AsyncModeAnnotationKey] != asyncHeaderMode {
+			return []v1alpha1.HTTPIngressPath{async, syncBypassPath(path), path}
+		}
+		return []v1alpha1.HTTPIngressPath{async, path}
+	}
+}
+
+// syncBypassPath returns a copy of the path only matching requests preferring a
+// synchronous response. It keeps the splits of the path, e.g. between revisions, only
+// the producer paths replace them.
+func syncBypassPath(path v1alpha1.HTTPIngressPath) v1alpha1.HTTPIngressPath {
+	sync := *path.DeepCopy()
+	sync.Headers = unionHeaderMatches(path.Headers,
+		map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferSyncValue}})
+	return sync
+}
+
+// routeToProducer returns a copy of the path routed like the producer path. The copy
+// shares no maps or slices with either path, so the paths generated for several rules
+// from the same source path or producer path can be changed independently.
+func routeToProducer(path, producer v1alpha1.HTTPIngressPath) v1alpha1.HTTPIngressPath {
+	async := *path.DeepCopy()
+	route := producer.DeepCopy()
+	async.Splits = route.Splits
+	async.AppendHeaders = route.AppendHeaders
+	async.RewriteHost = route.RewriteHost
+	return async
+}
+
+// unionHeaderMatches returns a new map with the header matches of both maps, b taking precedence.
+func unionHeaderMatches(a, b map[string]v1alpha1.HeaderMatch) map[string]v1alpha1.HeaderMatch {
+	union := make(map[string]v1alpha1.HeaderMatch, len(a)+len(b))
+	for k, v := range a {
+		union[k] = v
+	}
+	for k, v := range b {
+		union[k] = v
+	}
+	return union
+}
+
+// crossNamespaceBackend returns the first backend of the ingress in another namespace. The
+// generated ingress copies the backends, and Knative ingresses must route to services in
+// their own namespace, so it would be rejected.
+func crossNamespaceBackend(ingress *v1alpha1.Ingress) (v1alpha1.IngressBackend, bool) {
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			for _, split := range path.Splits {
+				if split.ServiceNamespace != ingress.Namespace {
+					return split.IngressBackend, true
+				}
+			}
+		}
+	}
+	return v1alpha1.IngressBackend{}, false
+}
 
-	ingress.Status.MarkLoadBalancerReady(
-		[]v1alpha1.LoadBalancerIngressStatus{{
-			DomainInternal: publicDomain,
-		}},
-		[]v1alpha1.LoadBalancerIngressStatus{{
-			DomainInternal: privateDomain,
-		}},
+// invalidSplitPercents returns the first path of the generated ingress whose splits don't
+// total 100 percent, and their total. A single split without a percent takes all traffic.
+// The data plane would reject or misroute such a path, so the ingress isn't applied.
+func invalidSplitPercents(ingress *v1alpha1.Ingress) (string, int, bool) {
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			total := 0
+			for _, split := range path.Splits {
+				total += split.Percent
+			}
+			if (len(path.Splits) != 1 || total != 0) && total != 100 {
+				return path.Path, total, true
+			}
+		}
+	}
+	return "", 0, false
+}
+
+// producerLoop reports whether the producer resolves to the ingress itself, in which case
+// rewriting the host to the producer would route requests back to the same ingress.
+func producerLoop(ingress *v1alpha1.Ingress, producer Producer) (string, bool) {
+	producerHost := producer.Hostname()
+	producerHosts := sets.NewString(
+		producerHost,
+		producer.Name+"."+producer.Namespace,
+		producer.Name+"."+producer.Namespace+".svc",
 	)
-	ingress.Status.MarkNetworkConfigured()
+	if producerHosts.Has(network.GetServiceHostname(ingress.Name, ingress.Namespace)) {
+		return producerHost, true
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if producerHosts.HasAny(rule.Hosts...) {
+			return producerHost, true
+		}
+	}
+	return "", false
+}
+
+// asyncHeaderMatch returns the header match routing a request to the producer. In header
+// mode it is the configured header, e.g. a claim set by an authenticating proxy,
+// otherwise the Prefer: respond-async header.
+func asyncHeaderMatch(annotations map[string]string) map[string]v1alpha1.HeaderMatch {
+	if annotations[AsyncModeAnnotationKey] == asyncHeaderMode {
+		return map[string]v1alpha1.HeaderMatch{
+			annotations[asyncHeaderNameKey]: {Exact: annotations[asyncHeaderValueKey]},
+		}
+	}
+	return map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferAsyncValue}}
+}
+
+// forceAlwaysAsync returns a copy of the ingress in always mode, without path modes.
+func forceAlwaysAsync(ingress *v1alpha1.Ingress) *v1alpha1.Ingress {
+	forced := ingress.DeepCopy()
+	forced.Annotations = kmeta.FilterMap(forced.Annotations, func(key string) bool {
+		return key == asyncPathModesKey
+	})
+	forced.Annotations[AsyncModeAnnotationKey] = asyncAlwaysMode
+	return forced
 }
 
-func domainForLocalGateway(ingressName string, isPrivate bool) string {
+// markIngressReady reports the load balancers of the ingress class. Cluster-local
+// ingresses are only served by the internal gateway, their public load balancer is empty.
+func markIngressReady(ingress *v1alpha1.Ingress, ingressClass string, cfg *Config) {
+	privateDomain := domainForLocalGateway(ingressClass, true)
+	var public []v1alpha1.LoadBalancerIngressStatus
+	if !isClusterLocal(ingress, cfg) {
+		public = []v1alpha1.LoadBalancerIngressStatus{{
+			DomainInternal: domainForLocalGateway(ingressClass, false),
+		}}
+	}
+
+	conditionsOf(ingress).markReady(public, []v1alpha1.LoadBalancerIngressStatus{{
+		DomainInternal: privateDomain,
+	}})
+}
+
+// isClusterLocal returns true if the visibility label marks the ingress cluster-local, or
+// if all rules of the ingress are cluster-local.
+func isClusterLocal(ingress *v1alpha1.Ingress, cfg *Config) bool {
+	if cfg.labeledClusterLocal(ingress) {
+		return true
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if rule.Visibility != v1alpha1.IngressVisibilityClusterLocal {
+			return false
+		}
+	}
+	return len(ingress.Spec.Rules) > 0
+}
+
+// knownLoadBalancer returns true if the load balancers of the ingress class are known.
+func knownLoadBalancer(ingressClass string) bool {
+	_, ok := loadBalancers[strings.Split(ingressClass, ".")[0]]
+	return ok
+}
+
+func domainForLocalGateway(ingressClass string, isPrivate bool) string {
 	// checks for a valid domain in the list of load balancers
-	if LBDomain, ok := loadBalancers[strings.Split(ingressName, ".")[0]]; ok {
+	if LBDomain, ok := loadBalancers[strings.Split(ingressClass, ".")[0]]; ok {
 		return getLoadBalancerDomain(LBDomain, isPrivate)
 	} else {
 		return getDefaultLoadBalancerDomain(isPrivate)
@@ -221,64 +842,332 @@ func getLoadBalancerDomain(LBDomain loadBalancerDomain, isPrivate bool) string {
 	return LBDomain.Public
 }
 
+// reconcileService creates the generated service or updates its managed fields. The
+// ExternalName follows the producer, so a service generated for a moved or renamed
+// producer is updated on the next reconcile of its ingress: the controller reconciles
+// all ingresses on startup, and again when the policy or the fallback producer changes.
 func (r *Reconciler) reconcileService(ctx context.Context, desiredSvc *corev1.Service) error {
 	logger := logging.FromContext(ctx)
 
+	desiredSpec := managedServiceSpec(desiredSvc.Spec)
+	desiredHash, err := specHash(&desiredSpec, r.config.ServiceCompareIgnore)
+	if err != nil {
+		return err
+	}
+	desiredSvc.Annotations = kmeta.UnionMaps(desiredSvc.Annotations, map[string]string{specHashKey: desiredHash})
+
 	sn := desiredSvc.Name
 	service, err := r.serviceLister.Services(desiredSvc.Namespace).Get(sn)
 	if apierrs.IsNotFound(err) {
 		logger.Infof("K8s public service %s does not exist; creating.", sn)
-		_, err := r.kubeclient.CoreV1().Services(desiredSvc.Namespace).Create(ctx, desiredSvc, metav1.CreateOptions{})
+		_, err := r.kubeclient.CoreV1().Services(desiredSvc.Namespace).Create(ctx, desiredSvc, r.config.createOptions())
 		if err != nil {
 			return fmt.Errorf("Failed to create async K8s Service: %w", err)
 		}
 		logger.Info("Created K8s service: ", sn)
-		return nil
+		return r.reconcileEndpoints(ctx, desiredSvc)
 	} else if err != nil {
 		return fmt.Errorf("Failed to get async K8s Service: %w", err)
 	} else {
-		if !equality.Semantic.DeepEqual(service.Spec, desiredSvc.Spec) {
+		existingSpec := managedServiceSpec(service.Spec)
+		// The IP families defaulted by the cluster are kept unless they are configured.
+		if desiredSpec.IPFamilyPolicy == nil {
+			existingSpec.IPFamilyPolicy = nil
+		}
+		if desiredSpec.IPFamilies == nil {
+			existingSpec.IPFamilies = nil
+		}
+		existingHash, err := specHash(&existingSpec, r.config.ServiceCompareIgnore)
+		if err != nil {
+			return err
+		}
+		annotations := mergeAnnotations(service.Annotations, desiredSvc.Annotations)
+		if existingHash != desiredHash || !equality.Semantic.DeepEqual(annotations, service.Annotations) {
 			// Don't modify the informers copy
 			template := service.DeepCopy()
-			template.Spec = desiredSvc.Spec
-			if _, err = r.kubeclient.CoreV1().Services(service.Namespace).Update(ctx, template, metav1.UpdateOptions{}); err != nil {
+			applyManagedServiceSpec(&template.Spec, desiredSvc.Spec)
+			template.Annotations = annotations
+			if _, err = r.kubeclient.CoreV1().Services(service.Namespace).Update(ctx, template, r.config.updateOptions()); err != nil {
 				return fmt.Errorf("Failed to update public K8s Service: %w", err)
 			}
 		}
 	}
 	logger.Debug("Finished reconciling public K8s service: ", sn)
+	return r.reconcileEndpoints(ctx, desiredSvc)
+}
+
+// serviceConflict returns a message if a service with the name of the desired service
+// exists that must not be overwritten: a service of another type than the generated ones,
+// or a service controlled by another object than the source ingress. Services generated
+// while owner references were copied are adopted after they were disabled.
+func (r *Reconciler) serviceConflict(source *v1alpha1.Ingress, desired *corev1.Service) (string, error) {
+	existing, err := r.serviceLister.Services(desired.Namespace).Get(desired.Name)
+	if apierrs.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("Failed to get async K8s Service: %w", err)
+	}
+	if !generatedService(existing) {
+		return fmt.Sprintf("The service %s exists with type %s, refusing to overwrite it", existing.Name, existing.Spec.Type), nil
+	}
+	if owner := metav1.GetControllerOf(existing); owner != nil && !r.config.adoptable(owner, source) {
+		return fmt.Sprintf("The service %s is controlled by %s %s, refusing to overwrite it", existing.Name, owner.Kind, owner.Name), nil
+	}
+	return "", nil
+}
+
+// deleteService deletes the generated service if it exists.
+func (r *Reconciler) deleteService(ctx context.Context, desiredSvc *corev1.Service) error {
+	logger := logging.FromContext(ctx)
+
+	service, err := r.serviceLister.Services(desiredSvc.Namespace).Get(desiredSvc.Name)
+	if apierrs.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to get async K8s Service: %w", err)
+	}
+	if !generatedService(service) {
+		logger.Warnf("Not deleting K8s service %s, it was not generated", service.Name)
+		return nil
+	}
+	logger.Info("Deleting unused K8s service: ", service.Name)
+	if err := r.kubeclient.CoreV1().Services(service.Namespace).Delete(ctx, service.Name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("Failed to delete async K8s Service: %w", err)
+	}
+	return nil
+}
+
+// reconcilePreferServices reconciles the services of the prefer-producers mappings of the
+// ingress and deletes the services of the mappings that were removed or that no path of
+// the generated ingress routes to.
+func (r *Reconciler) reconcilePreferServices(ctx context.Context, ing, generated *v1alpha1.Ingress, desired []*corev1.Service) error {
+	wanted := sets.NewString()
+	for _, service := range desired {
+		if !routesToService(generated, service.Name) {
+			continue
+		}
+		if err := r.reconcileService(ctx, service); err != nil {
+			return err
+		}
+		wanted.Insert(service.Name)
+	}
+	existing, err := r.serviceLister.Services(ing.Namespace).List(labels.SelectorFromSet(labels.Set{
+		preferProducerIngressLabelKey: ing.Name,
+	}))
+	if err != nil {
+		return fmt.Errorf("Failed to list async K8s Services: %w", err)
+	}
+	for _, service := range existing {
+		if !wanted.Has(service.Name) {
+			if err := r.deleteService(ctx, service); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-// MakeK8sService constructs a K8s service, that is used to route service to the producer service
-func MakeK8sService(ingress *v1alpha1.Ingress) *corev1.Service {
+// routesToService returns true if a path of the ingress routes to the service.
+func routesToService(ingress *v1alpha1.Ingress, serviceName string) bool {
+	for _, rule := range ingress.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			for _, split := range path.Splits {
+				if split.ServiceName == serviceName && split.ServiceNamespace == ingress.Namespace {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// applyManagedServiceSpec copies the fields set by MakeK8sService from src to dst. The
+// fields defaulted by the API server are left untouched, the IP families are only copied
+// when they are set.
+func applyManagedServiceSpec(dst *corev1.ServiceSpec, src corev1.ServiceSpec) {
+	dst.Type = src.Type
+	dst.ExternalName = src.ExternalName
+	dst.Ports = src.Ports
+	dst.Selector = src.Selector
+	dst.SessionAffinity = src.SessionAffinity
+	dst.PublishNotReadyAddresses = src.PublishNotReadyAddresses
+	if src.IPFamilyPolicy != nil {
+		dst.IPFamilyPolicy = src.IPFamilyPolicy
+	}
+	if src.IPFamilies != nil {
+		dst.IPFamilies = src.IPFamilies
+	}
+}
+
+// managedServiceSpec returns the fields of spec set by MakeK8sService.
+func managedServiceSpec(spec corev1.ServiceSpec) corev1.ServiceSpec {
+	managed := corev1.ServiceSpec{}
+	applyManagedServiceSpec(&managed, spec)
+	return managed
+}
+
+// MakeK8sService constructs a K8s service, that is used to route service to the producer service.
+// The service is of type ExternalName by default, which has no cluster IP, so the IP family
+// policy and families are only set on ClusterIP services: the API server rejects them on
+// ExternalName services.
+// ExternalName services have no endpoints either, so no EndpointSlice is generated for it;
+// the producer address is resolved by DNS. With ClusterIP services, the service has no
+// selector and its endpoints mirror the endpoints of the producer instead.
+func MakeK8sService(ingress *v1alpha1.Ingress, ingressClass string, producer Producer, cfg *Config) *corev1.Service {
+	protocol := cfg.producerProtocol()
+	selectorKey, selectorValue := cfg.producerSelector()
 	selector := make(map[string]string)
-	selector["app"] = producerServiceName
-	return &corev1.Service{
+	selector[selectorKey] = selectorValue
+	service := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:            kmeta.ChildName(ingress.ObjectMeta.Name, asyncSuffix),
-			Namespace:       ingress.Namespace,
-			OwnerReferences: ingress.OwnerReferences,
+			Name:      kmeta.ChildName(ingress.ObjectMeta.Name, asyncSuffix),
+			Namespace: ingress.Namespace,
+			Annotations: kmeta.UnionMaps(withManagedKeys(cfg.serviceAnnotations(ingressClass)), forceSyncAnnotation(ingress),
+				map[string]string{asyncSourceKey: ingress.Name}),
+			OwnerReferences: cfg.ownerReferences(ingress),
 		},
 		Spec: corev1.ServiceSpec{
 			Type:         "ExternalName",
-			ExternalName: network.GetServiceHostname(producerServiceName, system.Namespace()),
+			ExternalName: producer.Hostname(),
 			Ports: []corev1.ServicePort{{
-				Name:       networking.ServicePortName(networking.ProtocolHTTP1),
-				Protocol:   corev1.ProtocolTCP,
-				Port:       int32(networking.ServicePort(networking.ProtocolHTTP1)),
-				TargetPort: intstr.FromInt(80),
+				Name:       servicePortName(protocol, cfg.portNamingFor(ingressClass)),
+				Protocol:   cfg.producerPortProtocol(),
+				Port:       int32(networking.ServicePort(protocol)),
+				TargetPort: cfg.producerTargetPort(),
 			}},
-			Selector:        selector,
-			SessionAffinity: "None",
+			Selector:                 selector,
+			SessionAffinity:          "None",
+			PublishNotReadyAddresses: cfg.PublishNotReadyAddresses,
 		},
 	}
+	if cfg.clusterIPServices() {
+		service.Spec.Type = corev1.ServiceTypeClusterIP
+		service.Spec.ExternalName = ""
+		service.Spec.Selector = nil
+		service.Annotations = kmeta.UnionMaps(service.Annotations, map[string]string{
+			asyncProducerKey: producer.Namespace + "/" + producer.Name,
+		})
+		if cfg.ServiceIPFamilyPolicy != "" {
+			policy := corev1.IPFamilyPolicyType(cfg.ServiceIPFamilyPolicy)
+			service.Spec.IPFamilyPolicy = &policy
+		}
+		for _, family := range cfg.ServiceIPFamilies {
+			service.Spec.IPFamilies = append(service.Spec.IPFamilies, corev1.IPFamily(family))
+		}
+	}
+	return service
 }
 
-func validateAsyncModeAnnotation(annotations map[string]string) error {
+// validateIngress validates the async annotations of the ingress. The exemption from
+// validation only covers the annotations that don't change the routing of the ingress,
+// the modes, paths, headers and producers are always validated.
+func validateIngress(ctx context.Context, ing *v1alpha1.Ingress, cfg *Config) error {
+	if err := validateRoutingAnnotations(ing.Annotations, cfg); err != nil {
+		return err
+	}
+	err := validateCosmeticAnnotations(ing.Annotations)
+	if err != nil && ing.Annotations[asyncValidationKey] == skipValidation {
+		logging.FromContext(ctx).Warnf("Ignoring the invalid annotations of %s/%s, it is exempt from validation: %v",
+			ing.Namespace, ing.Name, err)
+		return nil
+	}
+	return err
+}
+
+func validateAsyncModeAnnotation(annotations map[string]string, cfg *Config) error {
+	if err := validateRoutingAnnotations(annotations, cfg); err != nil {
+		return err
+	}
+	return validateCosmeticAnnotations(annotations)
+}
+
+// validateRoutingAnnotations validates the annotations selecting the modes, paths,
+// headers and producers of the async requests.
+func validateRoutingAnnotations(annotations map[string]string, cfg *Config) error {
 	asyncMode := annotations[AsyncModeAnnotationKey]
-	if asyncMode != "" && asyncMode != asyncAlwaysMode && asyncMode != asyncConditionalMode {
+	if asyncMode != "" && asyncMode != asyncAlwaysMode && asyncMode != asyncConditionalMode &&
+		asyncMode != asyncHeaderMode {
 		return fmt.Errorf("Invalid value for key %s: ", AsyncModeAnnotationKey)
 	}
+	if asyncMode == asyncAlwaysMode && cfg.DisableAlwaysMode {
+		return fmt.Errorf("Invalid value for key %s: %s is disabled", AsyncModeAnnotationKey, asyncAlwaysMode)
+	}
+	pathModes, err := parsePathModes(annotations[asyncPathModesKey])
+	if err != nil {
+		return fmt.Errorf("Invalid value for key %s: %w", asyncPathModesKey, err)
+	}
+	for _, prefix := range sets.StringKeySet(pathModes).List() {
+		if pathModes[prefix] == asyncAlwaysMode && cfg.DisableAlwaysMode {
+			return fmt.Errorf("Invalid value for key %s: %s is disabled for path prefix %s",
+				asyncPathModesKey, asyncAlwaysMode, prefix)
+		}
+	}
+	if _, err := parseMethodRoutes(annotations[asyncRoutesKey]); err != nil {
+		return fmt.Errorf("Invalid value for key %s: %w", asyncRoutesKey, err)
+	}
+	if _, err := parsePreferProducers(annotations[asyncPreferProducersKey]); err != nil {
+		return fmt.Errorf("Invalid value for key %s: %w", asyncPreferProducersKey, err)
+	}
+	if err := validateMethodProducers(annotations); err != nil {
+		return err
+	}
+	if percent, err := parseAsyncPercent(annotations); err != nil {
+		return fmt.Errorf("Invalid value for key %s: %w", asyncPercentKey, err)
+	} else if percent < 100 && cfg.ProducerHostRewrite != ruleHostRewrite && !cfg.clusterIPServices() {
+		// The weighted requests keep the host the client requested, which loops back to the
+		// ingress through a producer routed by the gateway, like a Knative Service.
+		return fmt.Errorf("Invalid value for key %s: the requests split to the producer keep the host of the ingress, "+
+			"it requires PRODUCER_HOST_REWRITE=%s or ClusterIP services", asyncPercentKey, ruleHostRewrite)
+	}
+	if name, ok := annotations[asyncProducerServiceKey]; ok {
+		if errs := validation.IsDNS1035Label(name); len(errs) > 0 {
+			return fmt.Errorf("Invalid value for key %s: %s", asyncProducerServiceKey, strings.Join(errs, "; "))
+		}
+	}
+	if err := validateProducerKService(annotations); err != nil {
+		return err
+	}
+	if path, ok := annotations[asyncProducerHealthPathKey]; ok && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("Invalid value for key %s: %s must start with /", asyncProducerHealthPathKey, path)
+	}
+	if asyncMode == asyncHeaderMode {
+		name, value := annotations[asyncHeaderNameKey], annotations[asyncHeaderValueKey]
+		if errs := validation.IsHTTPHeaderName(name); len(errs) > 0 {
+			return fmt.Errorf("Invalid value for key %s: %s", asyncHeaderNameKey, strings.Join(errs, "; "))
+		}
+		if value == "" {
+			return fmt.Errorf("Missing value for key %s", asyncHeaderValueKey)
+		}
+	}
+	return nil
+}
+
+// validateCosmeticAnnotations validates the annotations that only change the headers,
+// status and metrics of the async requests. Exempt ingresses may carry invalid values.
+func validateCosmeticAnnotations(annotations map[string]string) error {
+	if status, ok := annotations[asyncAcceptedStatusKey]; ok {
+		if code, err := strconv.Atoi(status); err != nil || code < 200 || code > 299 {
+			return fmt.Errorf("Invalid value for key %s: %q is not a 2xx status code", asyncAcceptedStatusKey, status)
+		}
+	}
+	if value, ok := annotations[asyncOriginalHostHeaderKey]; ok {
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("Invalid value for key %s: %q is not a boolean", asyncOriginalHostHeaderKey, value)
+		}
+	}
+	switch splitMode := annotations[asyncSplitModeKey]; splitMode {
+	case "", routeSplitMode:
+	case mirrorSplitMode:
+		return fmt.Errorf("Invalid value for key %s: %s is not supported, Knative ingresses can't mirror traffic",
+			asyncSplitModeKey, mirrorSplitMode)
+	default:
+		return fmt.Errorf("Invalid value for key %s: %q must be %s", asyncSplitModeKey, splitMode, routeSplitMode)
+	}
+	if _, err := parseMetricLabels(annotations[asyncMetricLabelsKey]); err != nil {
+		return fmt.Errorf("Invalid value for key %s: %w", asyncMetricLabelsKey, err)
+	}
 	return nil
 }
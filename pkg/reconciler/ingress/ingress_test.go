@@ -18,13 +18,33 @@ package ingress
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	networkingv1listers "k8s.io/client-go/listers/networking/v1"
+	"k8s.io/client-go/tools/cache"
 
 	"knative.dev/net-contour/pkg/reconciler/contour/config"
 	fakenetworkingclient "knative.dev/networking/pkg/client/injection/client/fake"
+	"knative.dev/pkg/apis"
 	duckv1 "knative.dev/pkg/apis/duck/v1"
 	fakekubeclient "knative.dev/pkg/client/injection/kube/client/fake"
 
@@ -37,10 +57,14 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
 	. "knative.dev/async-component/pkg/reconciler/testing"
 	networkpkg "knative.dev/networking/pkg"
+	"knative.dev/pkg/kmeta"
 
 	network "knative.dev/pkg/network"
+	"knative.dev/pkg/system"
 
 	"knative.dev/networking/pkg/apis/networking"
 	"knative.dev/networking/pkg/apis/networking/v1alpha1"
@@ -60,6 +84,7 @@ const (
 	exampleHost            = "example.com"
 	testHost               = "test.com"
 	serviceName            = "servicename"
+	ingressIstio           = "istio.ingress.networking.knative.dev"
 )
 
 var statusReady = v1alpha1.IngressStatus{
@@ -186,6 +211,9 @@ func TestReconcile(t *testing.T) {
 	createdIng.Status.InitializeConditions()
 	changedService := service(defaultNamespace, testingName)
 	changedService.Spec.ExternalName = "changed"
+	// The generated ingress as the API server returns it after a kubectl apply.
+	appliedIng := createdIng.DeepCopy()
+	appliedIng.Annotations[corev1.LastAppliedConfigAnnotation] = `{"kind":"Ingress"}`
 	table := TableTest{{
 		Name: "skip ingress not matching class key",
 		Objects: []runtime.Object{
@@ -239,6 +267,13 @@ func TestReconcile(t *testing.T) {
 		WantErr: true,
 		WantEvents: []string{
 			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key async.knative.dev/mode: "),
+		}}, {
+		Name: "second reconcile of generated children is a no-op",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			appliedIng,
+			service(defaultNamespace, testingName),
 		}},
 	}
 
@@ -259,6 +294,10 @@ func TestIstioIngress(t *testing.T) {
 	changedService := service(defaultNamespace, testingName)
 	changedService.Spec.ExternalName = "changed"
 	defaultIngressClassName := os.Getenv("INGRESS_CLASS_NAME")
+	// The status points to the load balancers of Istio.
+	istioReady := ingSometimesAsync.DeepCopy()
+	istioReady.Status.PublicLoadBalancer.Ingress[0].DomainInternal = "istio-ingressgateway.istio-system.svc.cluster.local"
+	istioReady.Status.PrivateLoadBalancer.Ingress[0].DomainInternal = "knative-local-gateway.istio-system.svc.cluster.local"
 	table := TableTest{{
 		Name: "create new ingress with istio",
 		Key:  "default/testing",
@@ -269,7 +308,10 @@ func TestIstioIngress(t *testing.T) {
 		WantCreates: []runtime.Object{
 			createdIngWithIstio,
 			service(defaultNamespace, testingName),
-		}},
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: istioReady,
+		}}},
 	}
 	// Restores the ingress class to the default after the kourier test
 	// TODO refactor to inject this value in context
@@ -356,6 +398,10 @@ func ingress(namespace, name string, status v1alpha1.IngressStatus, opt ...ingre
 	for _, o := range opt {
 		o(ing)
 	}
+	// The source ingresses carry the finalizer of the controller.
+	if ing.Annotations[networking.IngressClassAnnotationKey] == asyncIngressClassName {
+		ing.Finalizers = []string{finalizerName}
+	}
 	return ing
 }
 
@@ -366,11 +412,11 @@ func withAnnotations(ans map[string]string) ingressCreationOption {
 }
 
 func ingressWithPaths(namespace, name string, status v1alpha1.IngressStatus, paths []netv1alpha1.HTTPIngressPath) *v1alpha1.Ingress {
-	return &netv1alpha1.Ingress{
+	return withIngressSpecHash(&netv1alpha1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        name + newSuffix,
 			Namespace:   namespace,
-			Annotations: map[string]string{networking.IngressClassAnnotationKey: "kourier.ingress.networking.knative.dev"},
+			Annotations: map[string]string{networking.IngressClassAnnotationKey: "kourier.ingress.networking.knative.dev", asyncSourceKey: name},
 		},
 		Spec: netv1alpha1.IngressSpec{
 			Rules: []netv1alpha1.IngressRule{{
@@ -382,15 +428,15 @@ func ingressWithPaths(namespace, name string, status v1alpha1.IngressStatus, pat
 			}},
 		},
 		Status: status,
-	}
+	})
 }
 
 func ingressWithIstio(namespace, name string, status v1alpha1.IngressStatus, paths []netv1alpha1.HTTPIngressPath) *v1alpha1.Ingress {
-	return &netv1alpha1.Ingress{
+	return withIngressSpecHash(&netv1alpha1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        name + newSuffix,
 			Namespace:   namespace,
-			Annotations: map[string]string{networking.IngressClassAnnotationKey: networkpkg.IstioIngressClassName},
+			Annotations: map[string]string{networking.IngressClassAnnotationKey: networkpkg.IstioIngressClassName, asyncSourceKey: name},
 		},
 		Spec: netv1alpha1.IngressSpec{
 			Rules: []netv1alpha1.IngressRule{{
@@ -402,15 +448,15 @@ func ingressWithIstio(namespace, name string, status v1alpha1.IngressStatus, pat
 			}},
 		},
 		Status: status,
-	}
+	})
 }
 
 func ingressWithUnknownLB(namespace, name string, status v1alpha1.IngressStatus, paths []netv1alpha1.HTTPIngressPath) *v1alpha1.Ingress {
-	return &netv1alpha1.Ingress{
+	return withIngressSpecHash(&netv1alpha1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        name + newSuffix,
 			Namespace:   namespace,
-			Annotations: map[string]string{networking.IngressClassAnnotationKey: "fake.ingress.networking.knative.dev"},
+			Annotations: map[string]string{networking.IngressClassAnnotationKey: "fake.ingress.networking.knative.dev", asyncSourceKey: name},
 		},
 		Spec: netv1alpha1.IngressSpec{
 			Rules: []netv1alpha1.IngressRule{{
@@ -422,7 +468,7 @@ func ingressWithUnknownLB(namespace, name string, status v1alpha1.IngressStatus,
 			}},
 		},
 		Status: status,
-	}
+	})
 }
 
 func service(namespace, name string) *corev1.Service {
@@ -430,8 +476,9 @@ func service(namespace, name string) *corev1.Service {
 	selector["app"] = producerServiceName
 	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      name + asyncSuffix,
-			Namespace: namespace,
+			Name:        name + asyncSuffix,
+			Namespace:   namespace,
+			Annotations: map[string]string{asyncSourceKey: name},
 		},
 		Spec: corev1.ServiceSpec{
 			Type:         "ExternalName",
@@ -446,5 +493,3759 @@ func service(namespace, name string) *corev1.Service {
 			SessionAffinity: "None",
 		},
 	}
+	return withServiceSpecHash(svc)
+}
+
+// withIngressSpecHash sets the spec hash annotation the reconciler stamps on the
+// generated ingress, call it again after changing the spec.
+func withIngressSpecHash(ing *netv1alpha1.Ingress) *netv1alpha1.Ingress {
+	hash, _ := ingressSpecHash(&ing.Spec, nil)
+	ing.Annotations = kmeta.UnionMaps(ing.Annotations, map[string]string{specHashKey: hash})
+	return ing
+}
+
+// withServiceSpecHash sets the spec hash annotation the reconciler stamps on the
+// generated service, call it again after changing the spec.
+func withServiceSpecHash(svc *corev1.Service) *corev1.Service {
+	spec := managedServiceSpec(svc.Spec)
+	hash, _ := specHash(&spec, nil)
+	svc.Annotations = kmeta.UnionMaps(svc.Annotations, map[string]string{specHashKey: hash})
 	return svc
 }
+
+func TestProducerProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		wantName string
+		wantPort int
+		wantErr  bool
+	}{{
+		name:     "default protocol",
+		wantName: networking.ServicePortNameHTTP1,
+		wantPort: networking.ServiceHTTPPort,
+	}, {
+		name:     "http1",
+		protocol: "http1",
+		wantName: networking.ServicePortNameHTTP1,
+		wantPort: networking.ServiceHTTPPort,
+	}, {
+		name:     "h2c",
+		protocol: "h2c",
+		wantName: networking.ServicePortNameH2C,
+		wantPort: networking.ServiceHTTP2Port,
+	}, {
+		name:     "unsupported http3",
+		protocol: "http3",
+		wantErr:  true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{ProducerProtocol: test.protocol}
+			if err := cfg.Validate(); (err != nil) != test.wantErr {
+				t.Fatalf("Validate() = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			svc := MakeK8sService(ingAlwaysAsync, ingressKourier, defaultProducer(), cfg)
+			if got := svc.Spec.Ports[0].Name; got != test.wantName {
+				t.Errorf("service port name = %q, want %q", got, test.wantName)
+			}
+			if got := int(svc.Spec.Ports[0].Port); got != test.wantPort {
+				t.Errorf("service port = %d, want %d", got, test.wantPort)
+			}
+			ing := makeNewIngress(ingAlwaysAsync, ingressKourier, defaultProducer(), cfg)
+			for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+				backend := path.Splits[0].IngressBackend
+				if backend.ServiceName != testingAlwaysAsyncName+asyncSuffix {
+					continue
+				}
+				if got := backend.ServicePort.IntValue(); got != test.wantPort {
+					t.Errorf("producer split port = %d, want %d", got, test.wantPort)
+				}
+			}
+		})
+	}
+}
+
+func TestProducerTargetPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    string
+		want    intstr.IntOrString
+		wantErr bool
+	}{{
+		name: "default port",
+		want: intstr.FromInt(80),
+	}, {
+		name: "port number",
+		port: "8080",
+		want: intstr.FromInt(8080),
+	}, {
+		name: "named port",
+		port: "http",
+		want: intstr.FromString("http"),
+	}, {
+		name:    "port number out of range",
+		port:    "70000",
+		wantErr: true,
+	}, {
+		name:    "invalid port name",
+		port:    "http_port",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{ProducerTargetPort: test.port}
+			if err := cfg.Validate(); (err != nil) != test.wantErr {
+				t.Fatalf("Validate() = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			svc := MakeK8sService(ingAlwaysAsync, ingressKourier, defaultProducer(), cfg)
+			if got := svc.Spec.Ports[0].TargetPort; got != test.want {
+				t.Errorf("service target port = %v, want %v", got.String(), test.want.String())
+			}
+		})
+	}
+}
+
+func TestProducerPortProtocol(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		want     corev1.Protocol
+		wantErr  bool
+	}{{
+		name: "default protocol",
+		want: corev1.ProtocolTCP,
+	}, {
+		name:     "UDP producer",
+		protocol: "UDP",
+		want:     corev1.ProtocolUDP,
+	}, {
+		name:     "SCTP producer",
+		protocol: "SCTP",
+		want:     corev1.ProtocolSCTP,
+	}, {
+		name:     "lower case protocol",
+		protocol: "udp",
+		wantErr:  true,
+	}, {
+		name:     "unknown protocol",
+		protocol: "QUIC",
+		wantErr:  true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{ProducerPortProtocol: test.protocol}
+			if err := cfg.Validate(); (err != nil) != test.wantErr {
+				t.Fatalf("Validate() = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			svc := MakeK8sService(ingAlwaysAsync, ingressKourier, defaultProducer(), cfg)
+			if got := svc.Spec.Ports[0].Protocol; got != test.want {
+				t.Errorf("service port protocol = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProducerSelector(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    map[string]string
+		wantErr bool
+	}{{
+		name: "default selector",
+		want: map[string]string{"app": producerServiceName},
+	}, {
+		name: "configured selector",
+		cfg: Config{
+			ProducerSelectorKey:   "app.kubernetes.io/name",
+			ProducerSelectorValue: "redis-producer",
+		},
+		want: map[string]string{"app.kubernetes.io/name": "redis-producer"},
+	}, {
+		name:    "invalid selector key",
+		cfg:     Config{ProducerSelectorKey: "not a key"},
+		wantErr: true,
+	}, {
+		name:    "invalid selector value",
+		cfg:     Config{ProducerSelectorValue: "-invalid-"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.cfg.Validate(); (err != nil) != test.wantErr {
+				t.Fatalf("Validate() = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			svc := MakeK8sService(ingWithAsyncAnnotation, ingressKourier, defaultProducer(), &test.cfg)
+			if !reflect.DeepEqual(svc.Spec.Selector, test.want) {
+				t.Errorf("selector = %v, want %v", svc.Spec.Selector, test.want)
+			}
+		})
+	}
+}
+
+func TestTLSHosts(t *testing.T) {
+	certificate := v1alpha1.IngressTLS{
+		Hosts:           []string{exampleHost},
+		SecretName:      "example-cert",
+		SecretNamespace: defaultNamespace,
+	}
+	withTLS := func(source *v1alpha1.Ingress, tls ...v1alpha1.IngressTLS) *v1alpha1.Ingress {
+		source = source.DeepCopy()
+		source.Spec.TLS = tls
+		return source
+	}
+	stale := v1alpha1.IngressTLS{
+		Hosts:           []string{"stale.example.com"},
+		SecretName:      "stale-cert",
+		SecretNamespace: defaultNamespace,
+	}
+	mixed := *certificate.DeepCopy()
+	mixed.Hosts = append(mixed.Hosts, "stale.example.com")
+
+	tests := []struct {
+		name   string
+		source *v1alpha1.Ingress
+		want   []v1alpha1.IngressTLS
+	}{{
+		name:   "no TLS",
+		source: ingSometimesAsync,
+	}, {
+		name:   "conditional mode",
+		source: withTLS(ingSometimesAsync, certificate),
+		want:   []v1alpha1.IngressTLS{certificate},
+	}, {
+		name:   "always mode",
+		source: withTLS(ingAlwaysAsync, certificate),
+		want:   []v1alpha1.IngressTLS{certificate},
+	}, {
+		name:   "hosts without rules are dropped",
+		source: withTLS(ingSometimesAsync, mixed, stale),
+		want:   []v1alpha1.IngressTLS{certificate},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ing := makeNewIngress(test.source, ingressKourier, defaultProducer(), &Config{})
+			if !equality.Semantic.DeepEqual(ing.Spec.TLS, test.want) {
+				t.Errorf("TLS = %+v, want %+v", ing.Spec.TLS, test.want)
+			}
+			if err := ing.Validate(context.Background()); err != nil {
+				t.Errorf("Validate() = %v", err)
+			}
+			// The producer is routed to by the rule of the TLS host, the requests to it
+			// are terminated with the certificate of that host.
+			producerService := kmeta.ChildName(test.source.Name, asyncSuffix)
+			for _, rule := range ing.Spec.Rules {
+				if !routesToService(&v1alpha1.Ingress{
+					ObjectMeta: ing.ObjectMeta,
+					Spec:       v1alpha1.IngressSpec{Rules: []v1alpha1.IngressRule{rule}},
+				}, producerService) {
+					t.Errorf("rule %v doesn't route to the producer", rule.Hosts)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeIngressUpdate(t *testing.T) {
+	foreignRule := netv1alpha1.IngressRule{
+		Hosts:      []string{"foreign.example.com"},
+		Visibility: netv1alpha1.IngressVisibilityClusterLocal,
+		HTTP: &netv1alpha1.HTTPIngressRuleValue{
+			Paths: []netv1alpha1.HTTPIngressPath{{
+				Splits: []netv1alpha1.IngressBackendSplit{{
+					Percent: 100,
+					IngressBackend: netv1alpha1.IngressBackend{
+						ServiceName:      "foreign",
+						ServiceNamespace: defaultNamespace,
+						ServicePort:      intstr.FromInt(80),
+					},
+				}},
+			}},
+		},
+	}
+	staleRule := foreignRule.DeepCopy()
+	staleRule.Hosts = []string{"removed.example.com"}
+
+	existing := createdIng.DeepCopy()
+	existing.Annotations[ownedHostsAnnotationKey] = "example.com,removed.example.com"
+	existing.Annotations["foreign.dev/annotation"] = "kept"
+	// A mesh annotation configured before, it is removed.
+	existing.Annotations["sidecar.istio.io/inject"] = "false"
+	existing.Annotations[managedAnnotationsKey] = "sidecar.istio.io/inject"
+	existing.Spec.Rules[0].HTTP.Paths = existing.Spec.Rules[0].HTTP.Paths[1:]
+	existing.Spec.Rules = append(existing.Spec.Rules, foreignRule, *staleRule)
+	existing.Spec.HTTPOption = netv1alpha1.HTTPOptionRedirected
+	foreignTLS := netv1alpha1.IngressTLS{
+		Hosts:           []string{"foreign.example.com"},
+		SecretName:      "foreign-cert",
+		SecretNamespace: defaultNamespace,
+	}
+	existing.Spec.TLS = []netv1alpha1.IngressTLS{foreignTLS, {
+		Hosts:           []string{"removed.example.com"},
+		SecretName:      "removed-cert",
+		SecretNamespace: defaultNamespace,
+	}}
+
+	merged := createdIng.DeepCopy()
+	merged.Annotations[ownedHostsAnnotationKey] = exampleHost
+	merged.Annotations["foreign.dev/annotation"] = "kept"
+	merged.Spec.Rules = append(merged.Spec.Rules, foreignRule)
+	merged.Spec.HTTPOption = netv1alpha1.HTTPOptionRedirected
+	merged.Spec.TLS = []netv1alpha1.IngressTLS{foreignTLS}
+	withIngressSpecHash(merged)
+
+	table := TableTest{{
+		Name: "merge keeps foreign rules and fields",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressUpdateStrategy: mergeUpdateStrategy}),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			existing,
+			service(defaultNamespace, testingName),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: merged,
+		}}}, {
+		Name: "merge is a no-op once merged",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressUpdateStrategy: mergeUpdateStrategy}),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			merged,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "replace overwrites foreign rules",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			existing,
+			service(defaultNamespace, testingName),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: createdIng,
+		}}},
+	}
+
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+type testConfigKey struct{}
+
+// withTestConfig returns a context carrying the Config used by newTestReconciler.
+func withTestConfig(cfg Config) context.Context {
+	return context.WithValue(context.Background(), testConfigKey{}, cfg)
+}
+
+// newTestReconciler builds the Reconciler from the fakes and the Config in the context.
+func newTestReconciler(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+	cfg, _ := ctx.Value(testConfigKey{}).(Config)
+	// Parse the templates like NewConfigFromEnv, the test configs are valid.
+	cfg.Validate()
+	r := NewReconciler(listers.GetIngressLister(), listers.GetK8sServiceLister(), listers.GetEndpointsLister(),
+		fakenetworkingclient.Get(ctx), fakekubeclient.Get(ctx), cfg)
+	r.policyLister = listers.GetNetworkPolicyLister()
+	r.secretLister = listers.GetSecretLister()
+	return ingressreconciler.NewReconciler(ctx, logging.FromContext(ctx), fakenetworkingclient.Get(ctx),
+		listers.GetIngressLister(), controller.GetEventRecorder(ctx), reconcilerFor(r), asyncIngressClassName,
+		controller.Options{FinalizerName: finalizerFor(&cfg)})
+}
+
+func TestHeaderMode(t *testing.T) {
+	headerAnnotations := map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		AsyncModeAnnotationKey:               asyncHeaderMode,
+		asyncHeaderNameKey:                   "X-User-Tier",
+		asyncHeaderValueKey:                  "premium",
+	}
+	// Requests carrying the claim match the producer path, all others fall
+	// through to the original paths.
+	headerPaths := []netv1alpha1.HTTPIngressPath{*conditionalAsyncPaths[0].DeepCopy(), *conditionalAsyncPaths[1].DeepCopy()}
+	headerPaths[0].Headers = map[string]v1alpha1.HeaderMatch{"X-User-Tier": {Exact: "premium"}}
+
+	missingValue := kmeta.CopyMap(headerAnnotations)
+	delete(missingValue, asyncHeaderValueKey)
+	invalidName := kmeta.CopyMap(headerAnnotations)
+	invalidName[asyncHeaderNameKey] = "X User Tier"
+
+	table := TableTest{{
+		Name: "header mode routes matching requests to the producer",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingress(defaultNamespace, testingName, statusReady, withAnnotations(headerAnnotations)),
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, headerPaths),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "header mode without a header value",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingress(defaultNamespace, testingName, statusReady, withAnnotations(missingValue)),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Missing value for key async.knative.dev/header-value"),
+		}}, {
+		Name: "header mode with an invalid header name",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingress(defaultNamespace, testingName, statusReady, withAnnotations(invalidName)),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key async.knative.dev/header-name: "+
+				"a valid HTTP header must consist of alphanumeric characters or '-' (e.g. 'X-Header-Name', regex used for validation is '[-A-Za-z0-9]+')"),
+		}},
+	}
+
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestNamespaceFilter(t *testing.T) {
+	allowlist := Config{NamespaceAllowlist: []string{"team-a"}}
+	denylist := Config{NamespaceDenylist: []string{defaultNamespace}}
+	table := TableTest{{
+		Name: "skip ingress outside the allowlist",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(allowlist),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+		}}, {
+		Name: "skip ingress in the denylist",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(denylist),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+		}}, {
+		Name: "reconcile ingress in the allowlist",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{NamespaceAllowlist: []string{"team-a", defaultNamespace}}),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+
+	for _, test := range []struct {
+		name      string
+		cfg       Config
+		namespace string
+		want      bool
+	}{
+		{"no lists", Config{}, defaultNamespace, true},
+		{"in allowlist", allowlist, "team-a", true},
+		{"not in allowlist", allowlist, defaultNamespace, false},
+		{"in denylist", denylist, defaultNamespace, false},
+		{"not in denylist", denylist, "team-a", true},
+	} {
+		ing := ingress(test.namespace, testingName, statusReady)
+		if got := test.cfg.namespaceFilter()(ing); got != test.want {
+			t.Errorf("%s: namespaceFilter(%s) = %v, want %v", test.name, test.namespace, got, test.want)
+		}
+		tombstone := cache.DeletedFinalStateUnknown{Key: test.namespace + "/" + testingName, Obj: ing}
+		if got := test.cfg.namespaceFilter()(tombstone); got != test.want {
+			t.Errorf("%s: namespaceFilter(tombstone in %s) = %v, want %v", test.name, test.namespace, got, test.want)
+		}
+	}
+}
+
+func TestProducerLoop(t *testing.T) {
+	asyncAnnotations := map[string]string{networking.IngressClassAnnotationKey: asyncIngressClassName}
+	loopStatus := func(ing *v1alpha1.Ingress) *v1alpha1.Ingress {
+		ing = ing.DeepCopy()
+		ing.GetConditionSet().Manage(&ing.Status).MarkFalse(v1alpha1.IngressConditionNetworkConfigured, "ProducerLoop",
+			"The producer host %s routes to this ingress itself, refusing to generate a routing loop",
+			network.GetServiceHostname(producerServiceName, knativeTesting))
+		return ing
+	}
+	selfIng := ingress(knativeTesting, producerServiceName, statusReady, withAnnotations(asyncAnnotations))
+	selfHostIng := ingress(defaultNamespace, testingName, statusReady, withAnnotations(asyncAnnotations))
+	selfHostIng.Spec.Rules[0].Hosts = []string{producerServiceName + "." + knativeTesting + ".svc"}
+
+	table := TableTest{{
+		Name: "producer is the ingress itself",
+		Key:  knativeTesting + "/" + producerServiceName,
+		Objects: []runtime.Object{
+			selfIng,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: loopStatus(selfIng),
+		}}}, {
+		Name: "rule host resolves to the producer",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			selfHostIng,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: loopStatus(selfHostIng),
+		}}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestMixedPathModes(t *testing.T) {
+	original := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		asyncPathModesKey: "/reports=always.async.knative.dev,/search=conditional.async.knative.dev," +
+			"/health=never.async.knative.dev",
+	}))
+	backend := original.Spec.Rules[0].HTTP.Paths[0]
+	originalPath := func(path string) netv1alpha1.HTTPIngressPath {
+		p := *backend.DeepCopy()
+		p.Path = path
+		return p
+	}
+	producerPath := func(path string, headers map[string]v1alpha1.HeaderMatch) netv1alpha1.HTTPIngressPath {
+		p := *conditionalAsyncPaths[0].DeepCopy()
+		p.Path = path
+		p.Headers = headers
+		return p
+	}
+	original.Spec.Rules[0].HTTP.Paths = []netv1alpha1.HTTPIngressPath{
+		originalPath("/reports"), originalPath("/search"), originalPath("/health"),
+	}
+
+	syncReports := originalPath("/reports")
+	syncReports.Headers = map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferSyncValue}}
+	want := []netv1alpha1.HTTPIngressPath{
+		syncReports,
+		producerPath("/reports", nil),
+		producerPath("/search", map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferAsyncValue}}),
+		originalPath("/search"),
+		originalPath("/health"),
+	}
+
+	table := TableTest{{
+		Name: "paths in always, conditional and never mode",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			original,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, want),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "invalid path modes",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+				networking.IngressClassAnnotationKey: asyncIngressClassName,
+				asyncPathModesKey:                    "/reports=sometimes",
+			})),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError",
+				"Invalid value for key async.knative.dev/path-modes: unsupported mode \"sometimes\" for path prefix /reports"),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestRequireAnnotation(t *testing.T) {
+	table := TableTest{{
+		Name: "skip ingress without mode annotation when required",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{RequireAnnotation: true}),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+		}}, {
+		Name: "reconcile ingress with mode annotation when required",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{RequireAnnotation: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "default ingress without mode annotation to conditional",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestOriginClusterHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want map[string]string
+	}{{
+		name: "not configured",
+		want: map[string]string{
+			asyncOriginalHostHeader: network.GetServiceHostname(testingName, defaultNamespace),
+		},
+	}, {
+		name: "cluster name only",
+		cfg:  Config{ClusterName: "east-1"},
+		want: map[string]string{
+			asyncOriginalHostHeader:  network.GetServiceHostname(testingName, defaultNamespace),
+			asyncOriginClusterHeader: "east-1",
+		},
+	}, {
+		name: "cluster name and region",
+		cfg:  Config{ClusterName: "east-1", ClusterRegion: "us-east"},
+		want: map[string]string{
+			asyncOriginalHostHeader:  network.GetServiceHostname(testingName, defaultNamespace),
+			asyncOriginClusterHeader: "east-1",
+			asyncOriginRegionHeader:  "us-east",
+		},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ing := makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &test.cfg)
+			producer := ing.Spec.Rules[0].HTTP.Paths[0]
+			if !reflect.DeepEqual(producer.AppendHeaders, test.want) {
+				t.Errorf("producer AppendHeaders = %v, want %v", producer.AppendHeaders, test.want)
+			}
+			if original := ing.Spec.Rules[0].HTTP.Paths[1]; original.AppendHeaders != nil {
+				t.Errorf("original path AppendHeaders = %v, want none", original.AppendHeaders)
+			}
+		})
+	}
+}
+
+func TestForwardRequestID(t *testing.T) {
+	cfg := &Config{RequestIDHeader: "X-Request-Id"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() = %v", err)
+	}
+	for _, original := range []*v1alpha1.Ingress{ingSometimesAsync, ingAlwaysAsync} {
+		ing := makeNewIngress(original, ingressKourier, defaultProducer(), cfg)
+		for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+			got, ok := path.AppendHeaders[asyncOriginalRequestIDHeader]
+			isProducer := path.RewriteHost != ""
+			if isProducer && got != "%REQ(X-Request-Id)%" {
+				t.Errorf("%s: producer %s = %q, want %q", original.Name, asyncOriginalRequestIDHeader, got, "%REQ(X-Request-Id)%")
+			}
+			if !isProducer && ok {
+				t.Errorf("%s: original path sets %s", original.Name, asyncOriginalRequestIDHeader)
+			}
+		}
+	}
+
+	ing := makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &Config{})
+	if _, ok := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders[asyncOriginalRequestIDHeader]; ok {
+		t.Errorf("%s set without a configured request ID header", asyncOriginalRequestIDHeader)
+	}
+	if err := (&Config{RequestIDHeader: "X Request Id"}).Validate(); err == nil {
+		t.Error("Validate() = nil, want an error for an invalid request ID header")
+	}
+}
+
+func TestIdempotencyKeyHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *Config
+		want string
+	}{{
+		name: "key or the Envoy request ID",
+		cfg:  &Config{IdempotencyKeyHeader: "Idempotency-Key"},
+		want: "%REQ(Idempotency-Key?x-request-id)%",
+	}, {
+		name: "key or the configured request ID",
+		cfg:  &Config{IdempotencyKeyHeader: "Idempotency-Key", RequestIDHeader: "X-Correlation-Id"},
+		want: "%REQ(Idempotency-Key?X-Correlation-Id)%",
+	}, {
+		name: "set whatever the informational header policy",
+		cfg:  &Config{IdempotencyKeyHeader: "Idempotency-Key", InformationalHeaderPolicy: clientHeaderPolicy},
+		want: "%REQ(Idempotency-Key?x-request-id)%",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.cfg.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			for _, original := range []*v1alpha1.Ingress{ingSometimesAsync, ingAlwaysAsync} {
+				ing := makeNewIngress(original, ingressKourier, defaultProducer(), test.cfg)
+				for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+					got, ok := path.AppendHeaders["Idempotency-Key"]
+					isProducer := path.RewriteHost != ""
+					if isProducer && got != test.want {
+						t.Errorf("%s: producer Idempotency-Key = %q, want %q", original.Name, got, test.want)
+					}
+					if !isProducer && ok {
+						t.Errorf("%s: original path sets Idempotency-Key", original.Name)
+					}
+				}
+			}
+		})
+	}
+
+	ing := makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &Config{})
+	if got, ok := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders["Idempotency-Key"]; ok {
+		t.Errorf("Idempotency-Key = %q, want no header by default", got)
+	}
+	if err := (&Config{IdempotencyKeyHeader: "Idempotency Key"}).Validate(); err == nil {
+		t.Error("Validate() = nil, want an error for an invalid idempotency key header")
+	}
+}
+
+func TestServiceIdempotency(t *testing.T) {
+	// The service as returned by the API server, with defaulted fields.
+	defaulted := service(defaultNamespace, testingName)
+	defaulted.Spec.ClusterIP = corev1.ClusterIPNone
+	defaulted.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv4Protocol}
+	defaulted.Spec.SessionAffinityConfig = &corev1.SessionAffinityConfig{}
+
+	changed := defaulted.DeepCopy()
+	changed.Spec.ExternalName = "changed"
+	updated := defaulted.DeepCopy()
+
+	table := TableTest{{
+		Name: "server defaulted service fields are not drift",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			createdIng,
+			defaulted,
+		}}, {
+		Name: "update keeps server defaulted service fields",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			createdIng,
+			changed,
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: updated,
+		}}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestIngressIdempotency(t *testing.T) {
+	// A source without the webhook defaults, the generated ingress as returned by the API
+	// server has them set.
+	undefaulted := ingSometimesAsync.DeepCopy()
+	undefaulted.Spec.Rules[0].Visibility = ""
+	undefaulted.Spec.Rules[0].HTTP.Paths[0].Splits[0].Percent = 0
+	// The generated ingress as seen by the reconciler, with the status of the data plane.
+	withStatus := createdIng.DeepCopy()
+	withStatus.Status = *statusReady.DeepCopy()
+	withStatus.Status.ObservedGeneration = 3
+	changed := withStatus.DeepCopy()
+	changed.Spec.Rules[0].HTTP.Paths[0].RewriteHost = "changed"
+	updated := withStatus.DeepCopy()
+
+	table := TableTest{{
+		Name: "status of the generated ingress is not drift",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			withStatus,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "server defaulted ingress fields are not drift",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			undefaulted,
+			withStatus,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "update keeps the status of the generated ingress",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			changed,
+			service(defaultNamespace, testingName),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: updated,
+		}}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestMakeNewIngressIdempotent(t *testing.T) {
+	cfg := &Config{
+		NormalizePreferHeader: true,
+		AsyncModeHeader:       true,
+		IdempotencyKeyHeader:  "Idempotency-Key",
+	}
+	// Source paths with headers of their own, e.g. set by the networking layer.
+	withHeaders := ingSometimesAsync.DeepCopy()
+	for i := range withHeaders.Spec.Rules[0].HTTP.Paths {
+		withHeaders.Spec.Rules[0].HTTP.Paths[i].AppendHeaders = map[string]string{"K-Network-Hash": "abc"}
+	}
+	withPreferProducers := ingSometimesAsync.DeepCopy()
+	withPreferProducers.Annotations[asyncPreferProducersKey] = "respond-batch=batch-producer"
+
+	for name, source := range map[string]*v1alpha1.Ingress{
+		"conditional mode": ingSometimesAsync,
+		"always mode":      ingAlwaysAsync,
+		"source headers":   withHeaders,
+		"prefer producers": withPreferProducers,
+	} {
+		t.Run(name, func(t *testing.T) {
+			original := source.DeepCopy()
+			first := makeNewIngress(source, ingressKourier, defaultProducer(), cfg)
+			second := makeNewIngress(source, ingressKourier, defaultProducer(), cfg)
+			if !equality.Semantic.DeepEqual(first, second) {
+				t.Errorf("makeNewIngress() = %+v, then %+v, want identical ingresses", first.Spec, second.Spec)
+			}
+			// The generated headers are not written back to the source paths, so they
+			// don't stack up over the reconciles.
+			if !equality.Semantic.DeepEqual(source, original) {
+				t.Errorf("makeNewIngress() changed the source to %+v, want %+v", source.Spec, original.Spec)
+			}
+		})
+	}
+}
+
+func TestFallbackProducer(t *testing.T) {
+	const standby = "async-producer-standby"
+	cfg := Config{FallbackProducerService: standby}
+	readyEndpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: producerServiceName, Namespace: knativeTesting},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+		}},
+	}
+	notReadyEndpoints := readyEndpoints.DeepCopy()
+	notReadyEndpoints.Subsets[0].NotReadyAddresses = notReadyEndpoints.Subsets[0].Addresses
+	notReadyEndpoints.Subsets[0].Addresses = nil
+
+	// The default producer is a Knative Service, its route has no endpoints but its
+	// revisions have.
+	placeholder := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      producerServiceName,
+			Namespace: knativeTesting,
+			Labels:    map[string]string{routeLabelKey: producerServiceName},
+		},
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, ExternalName: privateLBDomain},
+	}
+	revisionLabels := map[string]string{kserviceLabelKey: producerServiceName, serviceTypeLabelKey: publicServiceType}
+	revisionService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: producerServiceName + "-00001", Namespace: knativeTesting, Labels: revisionLabels},
+	}
+	revisionEndpoints := readyEndpoints.DeepCopy()
+	revisionEndpoints.Name, revisionEndpoints.Labels = revisionService.Name, revisionLabels
+	notReadyRevisionEndpoints := notReadyEndpoints.DeepCopy()
+	notReadyRevisionEndpoints.Name, notReadyRevisionEndpoints.Labels = revisionService.Name, revisionLabels
+
+	standbyHost := network.GetServiceHostname(standby, knativeTesting)
+	fallbackPaths := []netv1alpha1.HTTPIngressPath{*conditionalAsyncPaths[0].DeepCopy(), *conditionalAsyncPaths[1].DeepCopy()}
+	fallbackPaths[0].RewriteHost = standbyHost
+	fallbackService := service(defaultNamespace, testingName)
+	fallbackService.Spec.ExternalName = standbyHost
+	withServiceSpecHash(fallbackService)
+
+	table := TableTest{{
+		Name: "primary producer is ready",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			readyEndpoints,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "Knative Service producer has a ready revision",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			placeholder,
+			revisionService,
+			revisionEndpoints,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "Knative Service producer has no ready revision",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			placeholder,
+			revisionService,
+			notReadyRevisionEndpoints,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, fallbackPaths),
+			fallbackService,
+		}}, {
+		Name: "primary producer has no ready endpoints",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			notReadyEndpoints,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, fallbackPaths),
+			fallbackService,
+		}}, {
+		Name: "primary producer has no endpoints",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: ingressWithPaths(defaultNamespace, testingName, statusUnknown, fallbackPaths),
+		}, {
+			Object: fallbackService,
+		}}}, {
+		Name: "no fallback configured",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestClientAsyncHeadersOverwritten(t *testing.T) {
+	spoofed := ingress(defaultNamespace, testingName, statusReady, func(ing *v1alpha1.Ingress) {
+		ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders = map[string]string{
+			asyncOriginalHostHeader:  "attacker.example.com",
+			asyncOriginClusterHeader: "spoofed",
+		}
+	})
+	wantHost := network.GetServiceHostname(testingName, defaultNamespace)
+	tests := []struct {
+		name        string
+		mode        string
+		cfg         Config
+		wantCluster string
+	}{{
+		name:        "conditional, overwrite",
+		mode:        asyncConditionalMode,
+		cfg:         Config{ClusterName: "east-1"},
+		wantCluster: "east-1",
+	}, {
+		name:        "always, overwrite",
+		mode:        asyncAlwaysMode,
+		cfg:         Config{ClusterName: "east-1"},
+		wantCluster: "east-1",
+	}, {
+		name: "conditional, client",
+		mode: asyncConditionalMode,
+		cfg:  Config{ClusterName: "east-1", InformationalHeaderPolicy: clientHeaderPolicy},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			original := spoofed.DeepCopy()
+			original.Annotations = map[string]string{AsyncModeAnnotationKey: test.mode}
+			ing := makeNewIngress(original, ingressKourier, defaultProducer(), &test.cfg)
+			for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+				if path.RewriteHost == "" {
+					continue
+				}
+				if got := path.AppendHeaders[asyncOriginalHostHeader]; got != wantHost {
+					t.Errorf("producer %s = %q, want %q", asyncOriginalHostHeader, got, wantHost)
+				}
+				if got := path.AppendHeaders[asyncOriginClusterHeader]; got != test.wantCluster {
+					t.Errorf("producer %s = %q, want %q", asyncOriginClusterHeader, got, test.wantCluster)
+				}
+			}
+		})
+	}
+}
+
+func TestCrossNamespaceBackend(t *testing.T) {
+	const backendNamespace = "backends"
+	// Knative validates the backend namespaces of the source too, so such an ingress only
+	// exists in clusters without the networking webhook.
+	crossNamespace := ingSometimesAsync.DeepCopy()
+	crossNamespace.Spec.Rules[0].HTTP.Paths[0].Splits[0].ServiceNamespace = backendNamespace
+	backend, ok := crossNamespaceBackend(crossNamespace)
+	if !ok || backend.ServiceNamespace != backendNamespace || backend.ServiceName != serviceName {
+		t.Errorf("crossNamespaceBackend() = %+v, %v, want %s/%s", backend, ok, backendNamespace, serviceName)
+	}
+	if backend, ok := crossNamespaceBackend(ingSometimesAsync); ok {
+		t.Errorf("crossNamespaceBackend() = %+v, want none", backend)
+	}
+
+	// The sync paths keep their backends, only the producer path routes to the generated
+	// service, and the original host is the host of the route.
+	ing := makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &Config{})
+	if backend, ok := crossNamespaceBackend(ing); ok {
+		t.Errorf("generated ingress routes to %+v, want the namespace %s only", backend, defaultNamespace)
+	}
+	if got, want := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders[asyncOriginalHostHeader],
+		network.GetServiceHostname(testingName, defaultNamespace); got != want {
+		t.Errorf("%s = %q, want the host of the route %q", asyncOriginalHostHeader, got, want)
+	}
+}
+
+func TestInvalidSplitPercents(t *testing.T) {
+	withPercents := func(percents ...int) *v1alpha1.Ingress {
+		ing := makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &Config{})
+		path := &ing.Spec.Rules[0].HTTP.Paths[1]
+		path.Splits = nil
+		for i, percent := range percents {
+			path.Splits = append(path.Splits, v1alpha1.IngressBackendSplit{
+				IngressBackend: v1alpha1.IngressBackend{
+					ServiceName:      fmt.Sprintf("%s-%d", serviceName, i),
+					ServiceNamespace: defaultNamespace,
+					ServicePort:      intstr.FromInt(80),
+				},
+				Percent: percent,
+			})
+		}
+		return ing
+	}
+
+	tests := []struct {
+		name  string
+		ing   *v1alpha1.Ingress
+		total int
+		want  bool
+	}{{
+		name: "generated ingress",
+		ing:  makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &Config{}),
+	}, {
+		name: "weights total 100",
+		ing:  withPercents(30, 70),
+	}, {
+		name: "single split without percent",
+		ing:  withPercents(0),
+	}, {
+		name:  "weights over 100",
+		ing:   withPercents(60, 70),
+		total: 130,
+		want:  true,
+	}, {
+		name:  "weights under 100",
+		ing:   withPercents(20, 30),
+		total: 50,
+		want:  true,
+	}, {
+		name:  "single split under 100",
+		ing:   withPercents(90),
+		total: 90,
+		want:  true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, total, got := invalidSplitPercents(test.ing)
+			if got != test.want || total != test.total {
+				t.Errorf("invalidSplitPercents() = %q, %d, %v, want %d, %v", path, total, got, test.total, test.want)
+			}
+		})
+	}
+}
+
+func TestSourceSplits(t *testing.T) {
+	// A source path splitting the traffic between two revisions.
+	withSplits := func(ing *v1alpha1.Ingress) *v1alpha1.Ingress {
+		ing = ing.DeepCopy()
+		path := &ing.Spec.Rules[0].HTTP.Paths[0]
+		second := *path.Splits[0].DeepCopy()
+		second.ServiceName = serviceName + "-v2"
+		second.AppendHeaders = map[string]string{"Knative-Serving-Revision": serviceName + "-v2"}
+		path.Splits[0].Percent = 80
+		second.Percent = 20
+		path.Splits = append(path.Splits, second)
+		return ing
+	}
+	neverMode := ingSometimesAsync.DeepCopy()
+	neverMode.Annotations[AsyncModeAnnotationKey] = asyncNeverMode
+
+	for name, source := range map[string]*v1alpha1.Ingress{
+		"conditional mode": withSplits(ingSometimesAsync),
+		"always mode":      withSplits(ingAlwaysAsync),
+		"never mode":       withSplits(neverMode),
+	} {
+		t.Run(name, func(t *testing.T) {
+			want := source.Spec.Rules[0].HTTP.Paths[0].Splits
+			ing := makeNewIngress(source, ingressKourier, defaultProducer(), &Config{ExplicitSyncPath: true})
+			producerService := source.Name + asyncSuffix
+			for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+				if path.RewriteHost != "" {
+					// The producer path has the producer split only.
+					if len(path.Splits) != 1 || path.Splits[0].ServiceName != producerService || path.Splits[0].Percent != 100 {
+						t.Errorf("producer splits = %+v, want a single split to %s", path.Splits, producerService)
+					}
+				} else if !equality.Semantic.DeepEqual(path.Splits, want) {
+					t.Errorf("sync splits = %+v, want the source splits %+v", path.Splits, want)
+				}
+			}
+			if _, total, ok := invalidSplitPercents(ing); ok {
+				t.Errorf("splits total %d%%, want 100%%", total)
+			}
+		})
+	}
+}
+
+func TestAsyncPercent(t *testing.T) {
+	withPercent := func(percent string, revisions ...int) *v1alpha1.Ingress {
+		ing := ingAlwaysAsync.DeepCopy()
+		ing.Annotations[asyncPercentKey] = percent
+		path := &ing.Spec.Rules[0].HTTP.Paths[0]
+		if len(revisions) == 2 {
+			second := *path.Splits[0].DeepCopy()
+			second.ServiceName = serviceName + "-v2"
+			path.Splits[0].Percent, second.Percent = revisions[0], revisions[1]
+			path.Splits = append(path.Splits, second)
+		}
+		return ing
+	}
+	producerService := kmeta.ChildName(testingAlwaysAsyncName, asyncSuffix)
+
+	tests := []struct {
+		name   string
+		source *v1alpha1.Ingress
+		// want maps the services of the weighted path to their percents.
+		want map[string]int
+	}{{
+		name:   "quarter async",
+		source: withPercent("25"),
+		want:   map[string]int{serviceName: 75, producerService: 25},
+	}, {
+		name:   "half async",
+		source: withPercent("50"),
+		want:   map[string]int{serviceName: 50, producerService: 50},
+	}, {
+		name:   "almost all async",
+		source: withPercent("99"),
+		want:   map[string]int{serviceName: 1, producerService: 99},
+	}, {
+		name:   "no async",
+		source: withPercent("0"),
+		want:   map[string]int{serviceName: 100},
+	}, {
+		name:   "revisions keep their ratio",
+		source: withPercent("25", 70, 30),
+		want:   map[string]int{serviceName: 52, serviceName + "-v2": 23, producerService: 25},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ing := makeNewIngress(test.source, ingressKourier, defaultProducer(), &Config{})
+			paths := ing.Spec.Rules[0].HTTP.Paths
+			if len(paths) != 3 {
+				t.Fatalf("got %d paths, want the sync, the explicit async and the weighted path", len(paths))
+			}
+			if got := paths[1].Headers[preferHeaderField].Exact; got != preferAsyncValue || paths[1].Splits[0].ServiceName != producerService {
+				t.Errorf("explicit async path = %+v, want Prefer: %s routed to %s", paths[1], preferAsyncValue, producerService)
+			}
+			weighted := paths[2]
+			got := make(map[string]int, len(weighted.Splits))
+			for _, split := range weighted.Splits {
+				got[split.ServiceName] = split.Percent
+				if split.ServiceName == producerService {
+					// The producer split routes to the generated service next to the
+					// ingress, like the explicit async path.
+					async := paths[1].Splits[0]
+					if split.ServiceNamespace != defaultNamespace || split.ServicePort != async.ServicePort {
+						t.Errorf("producer split = %s/%s:%s, want %s/%s:%s", split.ServiceNamespace, split.ServiceName,
+							split.ServicePort.String(), async.ServiceNamespace, async.ServiceName, async.ServicePort.String())
+					}
+					if split.AppendHeaders[asyncOriginalHostHeader] == "" {
+						t.Errorf("producer split headers = %v, want the producer headers", split.AppendHeaders)
+					}
+				} else if _, ok := split.AppendHeaders[asyncOriginalHostHeader]; ok {
+					t.Errorf("backend split %s has the producer headers %v", split.ServiceName, split.AppendHeaders)
+				} else if split.ServiceNamespace != defaultNamespace {
+					t.Errorf("backend split %s namespace = %s, want %s", split.ServiceName, split.ServiceNamespace, defaultNamespace)
+				}
+			}
+			if !equality.Semantic.DeepEqual(got, test.want) {
+				t.Errorf("weighted splits = %v, want %v", got, test.want)
+			}
+			if weighted.RewriteHost != "" {
+				t.Errorf("RewriteHost = %q, want the host of the source path", weighted.RewriteHost)
+			}
+			if _, total, ok := invalidSplitPercents(ing); ok {
+				t.Errorf("splits total %d%%, want 100%%", total)
+			}
+		})
+	}
+
+	// The method producers only replace the producer split of the weighted paths.
+	withReadProducer := withPercent("25")
+	withReadProducer.Annotations[asyncReadProducerKey] = "read-producer"
+	for _, path := range makeNewIngress(withReadProducer, ingressKourier, defaultProducer(), &Config{}).Spec.Rules[0].HTTP.Paths {
+		if len(path.Splits) == 2 && path.Splits[0].ServiceName != serviceName {
+			t.Errorf("weighted backend split = %s, want %s", path.Splits[0].ServiceName, serviceName)
+		}
+	}
+
+	ruleRewrite := &Config{ProducerHostRewrite: ruleHostRewrite}
+	for _, value := range []string{"-1", "101", "half"} {
+		if err := validateAsyncModeAnnotation(map[string]string{asyncPercentKey: value}, ruleRewrite); err == nil {
+			t.Errorf("validateAsyncModeAnnotation(%q) = nil, want error", value)
+		}
+	}
+	// The weighted requests keep their host, a producer routed by the gateway would send
+	// them back to the ingress.
+	for _, test := range []struct {
+		cfg     *Config
+		percent string
+		valid   bool
+	}{
+		{cfg: &Config{}, percent: "25"},
+		{cfg: &Config{ProducerHostRewrite: producerHostRewrite}, percent: "0"},
+		{cfg: &Config{}, percent: "100", valid: true},
+		{cfg: ruleRewrite, percent: "25", valid: true},
+		{cfg: &Config{ProducerServiceType: clusterIPServiceType}, percent: "25", valid: true},
+	} {
+		err := validateAsyncModeAnnotation(map[string]string{asyncPercentKey: test.percent}, test.cfg)
+		if test.valid != (err == nil) {
+			t.Errorf("validateAsyncModeAnnotation(%s, %+v) = %v, want valid %v", test.percent, test.cfg, err, test.valid)
+		}
+	}
+}
+
+func TestRewriteHostMatchesService(t *testing.T) {
+	withAnnotations := func(annotations map[string]string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		for k, v := range annotations {
+			ing.Annotations[k] = v
+		}
+		return ing
+	}
+	sources := map[string]*v1alpha1.Ingress{
+		"default producer":  ingSometimesAsync,
+		"always mode":       ingAlwaysAsync,
+		"producer service":  withAnnotations(map[string]string{asyncProducerServiceKey: "team-producer"}),
+		"prefer producers":  withAnnotations(map[string]string{asyncPreferProducersKey: "respond-batch=batch-producer"}),
+		"producer and more": withAnnotations(map[string]string{asyncProducerServiceKey: "team-producer", asyncRoutesKey: "POST /orders"}),
+	}
+	r := &Reconciler{}
+	for name, source := range sources {
+		producer, err := r.resolveProducer(source)
+		if err != nil {
+			t.Fatalf("%s: resolveProducer() = %v", name, err)
+		}
+		ing, svc, preferSvcs := makeChildren(source, ingressKourier, producer, &Config{})
+		externalNames := map[string]string{svc.Name: svc.Spec.ExternalName}
+		for _, preferSvc := range preferSvcs {
+			externalNames[preferSvc.Name] = preferSvc.Spec.ExternalName
+		}
+		for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+			externalName, ok := externalNames[path.Splits[0].ServiceName]
+			if !ok {
+				continue
+			}
+			if path.RewriteHost != externalName {
+				t.Errorf("%s: RewriteHost = %q, want the ExternalName %q of service %s",
+					name, path.RewriteHost, externalName, path.Splits[0].ServiceName)
+			}
+		}
+	}
+}
+
+func TestProducerHostRewrite(t *testing.T) {
+	producerHost := network.GetServiceHostname(producerServiceName, knativeTesting)
+	tests := []struct {
+		name string
+		cfg  Config
+		want string
+	}{{
+		name: "default",
+		want: producerHost,
+	}, {
+		name: "producer host",
+		cfg:  Config{ProducerHostRewrite: producerHostRewrite},
+		want: producerHost,
+	}, {
+		name: "rule host",
+		cfg:  Config{ProducerHostRewrite: ruleHostRewrite},
+		want: "",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.cfg.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			for _, original := range []*v1alpha1.Ingress{ingSometimesAsync, ingAlwaysAsync} {
+				ing := makeNewIngress(original, ingressKourier, defaultProducer(), &test.cfg)
+				for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+					if path.Splits[0].ServiceName != kmeta.ChildName(original.Name, asyncSuffix) {
+						if path.RewriteHost != "" {
+							t.Errorf("%s: original path RewriteHost = %q, want none", original.Name, path.RewriteHost)
+						}
+						continue
+					}
+					if path.RewriteHost != test.want {
+						t.Errorf("%s: producer RewriteHost = %q, want %q", original.Name, path.RewriteHost, test.want)
+					}
+				}
+				svc := MakeK8sService(original, ingressKourier, defaultProducer(), &test.cfg)
+				if svc.Spec.ExternalName != producerHost {
+					t.Errorf("%s: ExternalName = %q, want %q", original.Name, svc.Spec.ExternalName, producerHost)
+				}
+			}
+		})
+	}
+
+	if err := (&Config{ProducerHostRewrite: "client"}).Validate(); err == nil {
+		t.Error("Validate() = nil, want error for unsupported producer host rewrite")
+	}
+}
+
+func TestNamespacePolicy(t *testing.T) {
+	forced := policyToContext(context.Background(), &Policy{ForceAsyncNamespaces: sets.NewString(defaultNamespace)})
+	notForced := policyToContext(context.Background(), &Policy{ForceAsyncNamespaces: sets.NewString("other")})
+
+	forcedPaths := []netv1alpha1.HTTPIngressPath{*alwaysAsyncPaths[0].DeepCopy(), *alwaysAsyncPaths[1].DeepCopy()}
+	forcedPaths[1].Splits[0].ServiceName = testingName + asyncSuffix
+	forcedPaths[1].AppendHeaders = map[string]string{
+		asyncOriginalHostHeader: network.GetServiceHostname(testingName, defaultNamespace),
+	}
+	overridden := ingSometimesAsync.DeepCopy()
+	overridden.GetConditionSet().Manage(&overridden.Status).MarkTrueWithReason(asyncModeOverriddenCondition, "NamespacePolicy",
+		"The namespace %s is forced to %s by the cluster policy", defaultNamespace, asyncAlwaysMode)
+
+	table := TableTest{{
+		Name: "conditional ingress in a forced namespace",
+		Key:  "default/testing",
+		Ctx:  forced,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, forcedPaths),
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: overridden,
+		}}}, {
+		Name: "always ingress in a forced namespace",
+		Key:  "default/testing-always",
+		Ctx:  forced,
+		Objects: []runtime.Object{
+			ingAlwaysAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIngWithAsyncAlways,
+			service(defaultNamespace, testingAlwaysAsyncName),
+		}}, {
+		Name: "conditional ingress outside the forced namespaces",
+		Key:  "default/testing",
+		Ctx:  notForced,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestNewPolicyFromConfigMap(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    sets.String
+		wantErr bool
+	}{{
+		name: "empty",
+		want: sets.NewString(),
+	}, {
+		name: "namespaces",
+		data: map[string]string{forceAsyncNamespacesKey: "payments, billing,,"},
+		want: sets.NewString("payments", "billing"),
+	}, {
+		name:    "invalid namespace",
+		data:    map[string]string{forceAsyncNamespacesKey: "payments,Billing"},
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := NewPolicyFromConfigMap(&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: PolicyConfigName},
+				Data:       test.data,
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("NewPolicyFromConfigMap() = %v, wantErr %v", err, test.wantErr)
+			}
+			if err == nil && !p.ForceAsyncNamespaces.Equal(test.want) {
+				t.Errorf("ForceAsyncNamespaces = %v, want %v", p.ForceAsyncNamespaces.List(), test.want.List())
+			}
+		})
+	}
+}
+
+func TestTooManyPaths(t *testing.T) {
+	big := ingAlwaysAsync.DeepCopy()
+	backend := big.Spec.Rules[0].HTTP.Paths[0]
+	big.Spec.Rules[0].HTTP.Paths = make([]netv1alpha1.HTTPIngressPath, 0, 600)
+	for i := 0; i < 600; i++ {
+		path := *backend.DeepCopy()
+		path.Path = fmt.Sprintf("/api/v1/resource-%d", i)
+		big.Spec.Rules[0].HTTP.Paths = append(big.Spec.Rules[0].HTTP.Paths, path)
+	}
+	created := withIngressSpecHash(makeNewIngress(big, ingressKourier, defaultProducer(), &Config{}))
+	created.Status = statusUnknown
+	warned := big.DeepCopy()
+	warned.GetConditionSet().Manage(&warned.Status).SetCondition(apis.Condition{
+		Type:     tooManyPathsCondition,
+		Status:   corev1.ConditionTrue,
+		Severity: apis.ConditionSeverityWarning,
+		Reason:   "TooManyPaths",
+		Message:  "The generated ingress has 1200 paths, more than the limit of 1000",
+	})
+
+	table := TableTest{{
+		Name: "always mode doubles the paths above the limit",
+		Key:  "default/testing-always",
+		Objects: []runtime.Object{
+			big,
+		},
+		WantCreates: []runtime.Object{
+			created,
+			service(defaultNamespace, testingAlwaysAsyncName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: warned,
+		}}}, {
+		Name: "paths within a raised limit",
+		Key:  "default/testing-always",
+		Ctx:  withTestConfig(Config{MaxGeneratedPaths: 2000}),
+		Objects: []runtime.Object{
+			big,
+		},
+		WantCreates: []runtime.Object{
+			created,
+			service(defaultNamespace, testingAlwaysAsyncName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+
+	if got := countPaths(created); got != 1200 {
+		t.Errorf("countPaths() = %d, want 1200", got)
+	}
+}
+
+func TestPublishNotReadyAddresses(t *testing.T) {
+	publishing := service(defaultNamespace, testingName)
+	publishing.Spec.PublishNotReadyAddresses = true
+	withServiceSpecHash(publishing)
+
+	if svc := MakeK8sService(ingWithAsyncAnnotation, ingressKourier, defaultProducer(), &Config{}); svc.Spec.PublishNotReadyAddresses {
+		t.Error("PublishNotReadyAddresses = true, want false by default")
+	}
+
+	table := TableTest{{
+		Name: "create service publishing not ready addresses",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{PublishNotReadyAddresses: true}),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			publishing,
+		}}, {
+		Name: "enable on an existing service",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{PublishNotReadyAddresses: true}),
+		Objects: []runtime.Object{
+			ingWithAsyncAnnotation,
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: publishing,
+		}}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestCheckProducerService(t *testing.T) {
+	producer := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      producerServiceName,
+			Namespace: knativeTesting,
+		},
+	}
+	overridden := ingSometimesAsync.DeepCopy()
+	overridden.Annotations[asyncProducerServiceKey] = "team-producer"
+	waiting := func(ing *v1alpha1.Ingress, name string) *v1alpha1.Ingress {
+		ing = ing.DeepCopy()
+		conditionsOf(ing).markWaitingForProducer("ProducerServiceNotFound",
+			"Waiting for the producer service knative-testing/"+name+" to be created")
+		return ing
+	}
+
+	table := TableTest{{
+		Name: "wait for a missing producer service",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{CheckProducerService: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: waiting(ingSometimesAsync, producerServiceName),
+		}}}, {
+		Name: "wait for the missing service of an overridden producer",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{CheckProducerService: true}),
+		Objects: []runtime.Object{
+			overridden,
+			producer,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: waiting(overridden, "team-producer"),
+		}}}, {
+		Name: "reconcile once the producer service exists",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{CheckProducerService: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			producer,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "missing producer service without the check",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestOriginalHostFormat(t *testing.T) {
+	clusterLocal := ingSometimesAsync.DeepCopy()
+	clusterLocal.Spec.Rules[0].Visibility = v1alpha1.IngressVisibilityClusterLocal
+	labeled := ingSometimesAsync.DeepCopy()
+	labeled.Labels = map[string]string{networkpkg.VisibilityLabelKey: clusterLocalVisibility}
+
+	tests := []struct {
+		name    string
+		format  string
+		ingress *v1alpha1.Ingress
+		want    string
+	}{{
+		name:    "default",
+		ingress: ingSometimesAsync,
+		want:    network.GetServiceHostname(testingName, defaultNamespace),
+	}, {
+		name:    "fqdn",
+		format:  fqdnOriginalHost,
+		ingress: ingSometimesAsync,
+		want:    network.GetServiceHostname(testingName, defaultNamespace),
+	}, {
+		name:    "short",
+		format:  shortOriginalHost,
+		ingress: ingSometimesAsync,
+		want:    testingName + "." + defaultNamespace,
+	}, {
+		name:    "external",
+		format:  externalOriginalHost,
+		ingress: ingSometimesAsync,
+		want:    exampleHost,
+	}, {
+		name:    "external without public rule",
+		format:  externalOriginalHost,
+		ingress: clusterLocal,
+		want:    network.GetServiceHostname(testingName, defaultNamespace),
+	}, {
+		name:    "external labeled cluster-local",
+		format:  externalOriginalHost,
+		ingress: labeled,
+		want:    network.GetServiceHostname(testingName, defaultNamespace),
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{OriginalHostFormat: test.format}
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			ing := makeNewIngress(test.ingress, ingressKourier, defaultProducer(), cfg)
+			if got := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders[asyncOriginalHostHeader]; got != test.want {
+				t.Errorf("%s = %q, want %q", asyncOriginalHostHeader, got, test.want)
+			}
+		})
+	}
+
+	if err := (&Config{OriginalHostFormat: "ip"}).Validate(); err == nil {
+		t.Error("Validate() = nil, want error for unsupported original host format")
+	}
+}
+
+func TestDisableAlwaysMode(t *testing.T) {
+	alwaysPath := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		asyncPathModesKey:                    "/reports=always.async.knative.dev",
+	}))
+	disabled := withTestConfig(Config{DisableAlwaysMode: true})
+
+	table := TableTest{{
+		Name: "always mode rejected when disabled",
+		Key:  "default/testing-always",
+		Ctx:  disabled,
+		Objects: []runtime.Object{
+			ingAlwaysAsync,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError",
+				"Invalid value for key async.knative.dev/mode: always.async.knative.dev is disabled"),
+		}}, {
+		Name: "always path mode rejected when disabled",
+		Key:  "default/testing",
+		Ctx:  disabled,
+		Objects: []runtime.Object{
+			alwaysPath,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError",
+				"Invalid value for key async.knative.dev/path-modes: always.async.knative.dev is disabled for path prefix /reports"),
+		}}, {
+		Name: "conditional mode accepted when always mode is disabled",
+		Key:  "default/testing",
+		Ctx:  disabled,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "always mode accepted by default",
+		Key:  "default/testing-always",
+		Objects: []runtime.Object{
+			ingAlwaysAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIngWithAsyncAlways,
+			service(defaultNamespace, testingAlwaysAsyncName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestProducerNetworkPolicy(t *testing.T) {
+	producer := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      producerServiceName,
+			Namespace: knativeTesting,
+			UID:       "producer-uid",
+		},
+	}
+	podSelector, _ := producerPodSelector(producer, &Config{})
+	policy := MakeProducerNetworkPolicy(producer, podSelector, &Config{})
+	stale := policy.DeepCopy()
+	stale.Spec.Ingress = nil
+	enabled := withTestConfig(Config{ProducerNetworkPolicy: true})
+
+	namespacesOf := func(policy *networkingv1.NetworkPolicy) []string {
+		selector := policy.Spec.Ingress[0].From[0].NamespaceSelector
+		if len(selector.MatchLabels) != 0 || len(selector.MatchExpressions) != 1 ||
+			selector.MatchExpressions[0].Key != namespaceNameLabelKey || selector.MatchExpressions[0].Operator != metav1.LabelSelectorOpIn {
+			t.Fatalf("namespace selector = %+v, want a single In expression on %s", selector, namespaceNameLabelKey)
+		}
+		return selector.MatchExpressions[0].Values
+	}
+	if got, want := namespacesOf(policy), []string{"kourier-system"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("namespaces = %v, want %v", got, want)
+	}
+	// The policy is shared by the ingresses of all classes, it allows all their gateways.
+	multiClass := &Config{IngressClasses: []string{"istio.ingress.networking.knative.dev"}}
+	if got, want := namespacesOf(MakeProducerNetworkPolicy(producer, podSelector, multiClass)),
+		[]string{"istio-system", "kourier-system"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("namespaces = %v, want %v for all managed classes", got, want)
+	}
+	if got, want := policy.Spec.PodSelector.MatchLabels, map[string]string{"app": producerServiceName}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pod selector = %v, want %v", got, want)
+	}
+	if got := policy.OwnerReferences; len(got) != 1 || got[0].UID != producer.UID {
+		t.Errorf("owner references = %v, want the producer service", got)
+	}
+	if got := gatewayNamespace("istio.ingress.networking.knative.dev"); got != "istio-system" {
+		t.Errorf("gatewayNamespace(istio) = %q, want istio-system", got)
+	}
+
+	table := TableTest{{
+		Name: "create network policy",
+		Key:  "default/testing",
+		Ctx:  enabled,
+		// The network policy is created in the namespace of the producer.
+		SkipNamespaceValidation: true,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			producer,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+			policy,
+		}}, {
+		Name:                    "update stale network policy",
+		Key:                     "default/testing",
+		Ctx:                     enabled,
+		SkipNamespaceValidation: true,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			service(defaultNamespace, testingName),
+			producer,
+			stale,
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: policy,
+		}}}, {
+		Name: "missing producer service",
+		Key:  "default/testing",
+		Ctx:  enabled,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError",
+				"producer service knative-testing/async-producer does not exist"),
+		}}, {
+		Name: "disabled by default",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			service(defaultNamespace, testingName),
+			producer,
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestProducerNetworkPolicyProducers(t *testing.T) {
+	withSelector := func(name string, selector map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: knativeTesting},
+			Spec:       corev1.ServiceSpec{Selector: selector},
+		}
+	}
+	ksvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "orders-producer",
+			Namespace: "producers",
+			Labels:    map[string]string{routeLabelKey: "orders-producer"},
+		},
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, ExternalName: privateLBDomain},
+	}
+	services := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, svc := range []*corev1.Service{
+		withSelector(producerServiceName, nil),
+		withSelector("team-producer", map[string]string{"app": "team-producer"}),
+		withSelector("v2-producer", map[string]string{"app": "v2-producer"}),
+		withSelector("read-producer", map[string]string{"app": "read-producer"}),
+		withSelector("headless-producer", nil),
+		ksvc,
+	} {
+		services.Add(svc)
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		producer    Producer
+		// want maps the namespace/name of the created policies to their pod selectors.
+		want map[string]map[string]string
+	}{{
+		name:     "default producer",
+		producer: defaultProducer(),
+		want: map[string]map[string]string{
+			knativeTesting + "/async-producer-gateway": {"app": producerServiceName},
+		},
+	}, {
+		name:     "overridden producer",
+		producer: Producer{Name: "team-producer", Namespace: knativeTesting},
+		want: map[string]map[string]string{
+			knativeTesting + "/team-producer-gateway": {"app": "team-producer"},
+		},
+	}, {
+		name:        "prefer and method producers",
+		annotations: map[string]string{asyncPreferProducersKey: "v2=v2-producer", asyncReadProducerKey: "read-producer"},
+		producer:    defaultProducer(),
+		want: map[string]map[string]string{
+			knativeTesting + "/async-producer-gateway": {"app": producerServiceName},
+			knativeTesting + "/v2-producer-gateway":    {"app": "v2-producer"},
+			knativeTesting + "/read-producer-gateway":  {"app": "read-producer"},
+		},
+	}, {
+		name:     "Knative Service producer",
+		producer: Producer{Name: ksvc.Name, Namespace: ksvc.Namespace},
+		want: map[string]map[string]string{
+			"producers/orders-producer-gateway": {kserviceLabelKey: "orders-producer"},
+		},
+	}, {
+		name:     "producer without selector",
+		producer: Producer{Name: "headless-producer", Namespace: knativeTesting},
+		want:     map[string]map[string]string{},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, _ := SetupFakeContext(t)
+			client := fakekubeclient.Get(ctx)
+			r := &Reconciler{
+				serviceLister: corev1listers.NewServiceLister(services),
+				policyLister:  networkingv1listers.NewNetworkPolicyLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+				kubeclient:    client,
+				config:        Config{ProducerNetworkPolicy: true},
+			}
+			ing := ingSometimesAsync.DeepCopy()
+			for k, v := range test.annotations {
+				ing.Annotations[k] = v
+			}
+			if err := r.reconcileNetworkPolicy(ctx, ing, test.producer); err != nil {
+				t.Fatalf("reconcileNetworkPolicy() = %v", err)
+			}
+			policies, err := client.NetworkingV1().NetworkPolicies(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				t.Fatalf("List(policies) = %v", err)
+			}
+			got := make(map[string]map[string]string, len(policies.Items))
+			for _, policy := range policies.Items {
+				got[policy.Namespace+"/"+policy.Name] = policy.Spec.PodSelector.MatchLabels
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("policies = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAcceptedStatus(t *testing.T) {
+	for _, original := range []*v1alpha1.Ingress{ingSometimesAsync, ingAlwaysAsync} {
+		original = original.DeepCopy()
+		original.Annotations[asyncAcceptedStatusKey] = "202"
+		if err := validateAsyncModeAnnotation(original.Annotations, &Config{}); err != nil {
+			t.Fatalf("%s: validateAsyncModeAnnotation() = %v", original.Name, err)
+		}
+		ing := makeNewIngress(original, ingressKourier, defaultProducer(), &Config{})
+		for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+			got, ok := path.AppendHeaders[asyncAcceptedStatusHeader]
+			if path.RewriteHost != "" && got != "202" {
+				t.Errorf("%s: producer %s = %q, want 202", original.Name, asyncAcceptedStatusHeader, got)
+			}
+			if path.RewriteHost == "" && ok {
+				t.Errorf("%s: original path sets %s", original.Name, asyncAcceptedStatusHeader)
+			}
+		}
+	}
+
+	ing := makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &Config{})
+	if _, ok := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders[asyncAcceptedStatusHeader]; ok {
+		t.Errorf("%s set without the annotation", asyncAcceptedStatusHeader)
+	}
+
+	for _, invalid := range []string{"", "accepted", "404", "2020"} {
+		annotations := map[string]string{asyncAcceptedStatusKey: invalid}
+		if err := validateAsyncModeAnnotation(annotations, &Config{}); err == nil {
+			t.Errorf("validateAsyncModeAnnotation(%q) = nil, want error", invalid)
+		}
+	}
+}
+
+func TestMixedIngressClasses(t *testing.T) {
+	t.Setenv(ingressClassName, ingressKourier)
+	withClass := func(ingressClass string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		ing.Annotations[asyncIngressClassKey] = ingressClass
+		return ing
+	}
+	istioSource := withClass(networkpkg.IstioIngressClassName)
+	istioReady := istioSource.DeepCopy()
+	istioReady.Status.PublicLoadBalancer.Ingress[0].DomainInternal = "istio-ingressgateway.istio-system.svc.cluster.local"
+	istioReady.Status.PrivateLoadBalancer.Ingress[0].DomainInternal = "knative-local-gateway.istio-system.svc.cluster.local"
+	both := withTestConfig(Config{IngressClasses: []string{networkpkg.IstioIngressClassName}})
+
+	table := TableTest{{
+		Name: "ingress selecting istio",
+		Key:  "default/testing",
+		Ctx:  both,
+		Objects: []runtime.Object{
+			istioSource,
+		},
+		WantCreates: []runtime.Object{
+			createdIngWithIstio,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: istioReady,
+		}}}, {
+		Name: "ingress selecting the default class",
+		Key:  "default/testing",
+		Ctx:  both,
+		Objects: []runtime.Object{
+			withClass(ingressKourier),
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "ingress without class annotation",
+		Key:  "default/testing",
+		Ctx:  both,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "ingress selecting an unmanaged class",
+		Key:  "default/testing",
+		Ctx:  both,
+		Objects: []runtime.Object{
+			withClass("contour.ingress.networking.knative.dev"),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError",
+				"Invalid value for key async.knative.dev/ingress-class: ingress class \"contour.ingress.networking.knative.dev\" is not managed by the controller"),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestInvalidHostname(t *testing.T) {
+	longName := "a-very-long-route-name-that-exceeds-the-dns-label-limit-of-63-characters"
+	long := ingress(defaultNamespace, longName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+	}))
+	err := validateGeneratedHostnames(long, defaultProducer(), &Config{})
+	if err == nil {
+		t.Fatal("validateGeneratedHostnames() = nil, want error for an over-long name")
+	}
+	invalid := long.DeepCopy()
+	invalid.GetConditionSet().Manage(&invalid.Status).MarkFalse(v1alpha1.IngressConditionNetworkConfigured, "InvalidHostname",
+		"The generated routes are invalid, the ingress name or namespace may be too long: %v", err)
+
+	if err := validateGeneratedHostnames(ingSometimesAsync, defaultProducer(), &Config{}); err != nil {
+		t.Errorf("validateGeneratedHostnames() = %v, want nil", err)
+	}
+
+	table := TableTest{{
+		Name: "over-long ingress name",
+		Key:  "default/" + longName,
+		Objects: []runtime.Object{
+			long,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: invalid,
+		}}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestProducerServiceOverride(t *testing.T) {
+	teamHost := network.GetServiceHostname("team-producer", knativeTesting)
+	withProducer := func(name string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		ing.Annotations[asyncProducerServiceKey] = name
+		return ing
+	}
+	teamIng := createdIng.DeepCopy()
+	teamIng.Spec.Rules[0].HTTP.Paths[0].RewriteHost = teamHost
+	withIngressSpecHash(teamIng)
+	teamService := service(defaultNamespace, testingName)
+	teamService.Spec.ExternalName = teamHost
+	withServiceSpecHash(teamService)
+
+	table := TableTest{{
+		Name: "producer overridden by annotation",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withProducer("team-producer"),
+		},
+		WantCreates: []runtime.Object{
+			teamIng,
+			teamService,
+		}}, {
+		Name: "annotation takes precedence over the fallback producer",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{FallbackProducerService: "standby-producer"}),
+		Objects: []runtime.Object{
+			withProducer("team-producer"),
+		},
+		WantCreates: []runtime.Object{
+			teamIng,
+			teamService,
+		}}, {
+		Name: "invalid producer service",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withProducer("Team_Producer"),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key %s: %s", asyncProducerServiceKey,
+				strings.Join(validation.IsDNS1035Label("Team_Producer"), "; ")),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestMethodRoutes(t *testing.T) {
+	original := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		asyncRoutesKey:                       "POST /orders",
+	}))
+	postOrders := *conditionalAsyncPaths[0].DeepCopy()
+	postOrders.Path = "/orders"
+	postOrders.Headers = map[string]v1alpha1.HeaderMatch{methodHeaderField: {Exact: "POST"}}
+	want := []netv1alpha1.HTTPIngressPath{postOrders, conditionalAsyncPaths[0], conditionalAsyncPaths[1]}
+
+	table := TableTest{{
+		Name: "POST /orders is async, other requests follow the conditional mode",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			original,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, want),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "invalid async routes",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+				networking.IngressClassAnnotationKey: asyncIngressClassName,
+				asyncRoutesKey:                       "SEND /orders",
+			})),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key %s: unsupported method %q: must be one of %s",
+				asyncRoutesKey, "SEND", "DELETE, GET, HEAD, OPTIONS, PATCH, POST, PUT"),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestDeleteUnusedService(t *testing.T) {
+	// All paths of the ingress are synchronous.
+	neverAsync := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		asyncPathModesKey:                    "/=never.async.knative.dev",
+	}))
+	syncIng := ingressWithPaths(defaultNamespace, testingName, statusUnknown, neverAsync.Spec.Rules[0].HTTP.Paths)
+	userService := service(defaultNamespace, testingName)
+	userService.Spec.Type = corev1.ServiceTypeClusterIP
+
+	table := TableTest{{
+		Name: "delete the service no longer routed to",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			neverAsync,
+			syncIng,
+			service(defaultNamespace, testingName),
+		},
+		WantDeletes: []ktesting.DeleteActionImpl{{
+			ActionImpl: ktesting.ActionImpl{
+				Namespace: defaultNamespace,
+				Verb:      "delete",
+				Resource:  corev1.SchemeGroupVersion.WithResource("services"),
+			},
+			Name: testingName + asyncSuffix,
+		}}}, {
+		Name: "no service created for synchronous paths",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			neverAsync,
+		},
+		WantCreates: []runtime.Object{
+			syncIng,
+		}}, {
+		Name: "keep a service not generated by the reconciler",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			neverAsync,
+			syncIng,
+			userService,
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestServiceConflict(t *testing.T) {
+	conflictStatus := func(msg string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		ing.GetConditionSet().Manage(&ing.Status).MarkFalse(v1alpha1.IngressConditionNetworkConfigured,
+			"ServiceConflict", msg)
+		return ing
+	}
+	clusterIPService := service(defaultNamespace, testingName)
+	clusterIPService.Spec.Type = corev1.ServiceTypeClusterIP
+	foreignService := service(defaultNamespace, testingName)
+	foreignService.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Name:       "other",
+		UID:        "other-uid",
+		Controller: &[]bool{true}[0],
+	}}
+	withFinalizer := func(ing *v1alpha1.Ingress) *v1alpha1.Ingress {
+		ing.Finalizers = []string{finalizerName}
+		return ing
+	}
+	finalized := withFinalizer(ingSometimesAsync.DeepCopy())
+
+	table := TableTest{{
+		Name: "service with another type",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			clusterIPService,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: conflictStatus("The service testing-async exists with type ClusterIP, refusing to overwrite it"),
+		}}}, {
+		Name: "service controlled by another object",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			foreignService,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: conflictStatus("The service testing-async is controlled by Deployment other, refusing to overwrite it"),
+		}}}, {
+		Name: "service controlled by another object without owner references",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{DisableOwnerReferences: true}),
+		Objects: []runtime.Object{
+			finalized,
+			foreignService,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: withFinalizer(conflictStatus("The service testing-async is controlled by Deployment other, refusing to overwrite it")),
+		}}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestGatewaySignature(t *testing.T) {
+	host := network.GetServiceHostname(testingName, defaultNamespace)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(host))
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	signingSecret := func(data map[string][]byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "gateway-signing", Namespace: system.Namespace()},
+			Data:       data,
+		}
+	}
+	signedPaths := make([]netv1alpha1.HTTPIngressPath, 0, len(conditionalAsyncPaths))
+	for _, path := range conditionalAsyncPaths {
+		path := *path.DeepCopy()
+		if _, ok := path.AppendHeaders[asyncOriginalHostHeader]; ok {
+			path.AppendHeaders[asyncGatewaySignatureHeader] = signature
+		}
+		signedPaths = append(signedPaths, path)
+	}
+	notConfigured := func(msg string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		ing.GetConditionSet().Manage(&ing.Status).MarkFalse(v1alpha1.IngressConditionNetworkConfigured,
+			signingSecretReason, msg)
+		return ing
+	}
+	signingConfig := withTestConfig(Config{GatewaySigningSecret: "gateway-signing"})
+
+	table := TableTest{{
+		Name: "routes to the producer are signed",
+		Key:  "default/testing",
+		Ctx:  signingConfig,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			signingSecret(map[string][]byte{gatewaySigningKeyName: []byte("secret")}),
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, signedPaths),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "missing signing secret",
+		Key:  "default/testing",
+		Ctx:  signingConfig,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: notConfigured(fmt.Sprintf("The gateway signing secret %s/gateway-signing does not exist", system.Namespace())),
+		}}}, {
+		Name: "signing secret without key",
+		Key:  "default/testing",
+		Ctx:  signingConfig,
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			signingSecret(map[string][]byte{"other": []byte("secret")}),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: notConfigured(fmt.Sprintf("The gateway signing secret %s/gateway-signing has no %s",
+				system.Namespace(), gatewaySigningKeyName)),
+		}}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+
+	ing := makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &Config{})
+	if got, ok := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders[asyncGatewaySignatureHeader]; ok {
+		t.Errorf("%s = %q, want no header without signing secret", asyncGatewaySignatureHeader, got)
+	}
+	if err := (&Config{GatewaySigningSecret: "Gateway_Signing"}).Validate(); err == nil {
+		t.Error("Validate() = nil, want error for an invalid secret name")
+	}
+}
+
+func TestAsyncModeHeader(t *testing.T) {
+	withAnnotations := func(annotations map[string]string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		for k, v := range annotations {
+			ing.Annotations[k] = v
+		}
+		return ing
+	}
+	tests := []struct {
+		name   string
+		source *v1alpha1.Ingress
+		want   string
+	}{{
+		name:   "conditional mode",
+		source: ingSometimesAsync,
+		want:   "conditional",
+	}, {
+		name:   "always mode",
+		source: ingAlwaysAsync,
+		want:   "always",
+	}, {
+		name: "header mode",
+		source: withAnnotations(map[string]string{
+			AsyncModeAnnotationKey: asyncHeaderMode,
+			asyncHeaderNameKey:     "X-User-Tier",
+			asyncHeaderValueKey:    "premium",
+		}),
+		want: "header",
+	}, {
+		name:   "mode of the path",
+		source: withAnnotations(map[string]string{asyncPathModesKey: "/=" + asyncAlwaysMode}),
+		want:   "always",
+	}, {
+		name:   "method route on a path in never mode",
+		source: withAnnotations(map[string]string{asyncPathModesKey: "/=" + asyncNeverMode, asyncRoutesKey: "POST /orders"}),
+		want:   "never",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ing := makeNewIngress(test.source, ingressKourier, defaultProducer(), &Config{AsyncModeHeader: true})
+			producerPaths := 0
+			for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+				got, ok := path.AppendHeaders[asyncModeHeader]
+				if path.RewriteHost != "" {
+					producerPaths++
+					if got != test.want {
+						t.Errorf("producer %s = %q, want %q", asyncModeHeader, got, test.want)
+					}
+				} else if ok {
+					t.Errorf("original path sets %s", asyncModeHeader)
+				}
+			}
+			if producerPaths == 0 {
+				t.Error("no path routes to the producer")
+			}
+		})
+	}
+
+	ing := makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &Config{})
+	if got, ok := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders[asyncModeHeader]; ok {
+		t.Errorf("%s = %q, want no header by default", asyncModeHeader, got)
+	}
+}
+
+func TestOriginalIngressClassHeader(t *testing.T) {
+	withClassHeader := func(ing *v1alpha1.Ingress, ingressClass string) *v1alpha1.Ingress {
+		ing = ing.DeepCopy()
+		for i, path := range ing.Spec.Rules[0].HTTP.Paths {
+			if _, ok := path.AppendHeaders[asyncOriginalHostHeader]; ok {
+				ing.Spec.Rules[0].HTTP.Paths[i].AppendHeaders[asyncOriginalIngressClassHeader] = ingressClass
+			}
+		}
+		return withIngressSpecHash(ing)
+	}
+	istioSource := ingSometimesAsync.DeepCopy()
+	istioSource.Annotations[asyncIngressClassKey] = networkpkg.IstioIngressClassName
+	istioReady := istioSource.DeepCopy()
+	istioReady.Status.PublicLoadBalancer.Ingress[0].DomainInternal = "istio-ingressgateway.istio-system.svc.cluster.local"
+	istioReady.Status.PrivateLoadBalancer.Ingress[0].DomainInternal = "knative-local-gateway.istio-system.svc.cluster.local"
+
+	ing := makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &Config{})
+	if got, ok := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders[asyncOriginalIngressClassHeader]; ok {
+		t.Errorf("%s = %q, want no header by default", asyncOriginalIngressClassHeader, got)
+	}
+
+	table := TableTest{{
+		Name: "header carries the default class",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{OriginalIngressClassHeader: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			withClassHeader(createdIng, ingressKourier),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "header carries the class selected by the ingress",
+		Key:  "default/testing",
+		Ctx: withTestConfig(Config{
+			OriginalIngressClassHeader: true,
+			IngressClasses:             []string{networkpkg.IstioIngressClassName},
+		}),
+		Objects: []runtime.Object{
+			istioSource,
+		},
+		WantCreates: []runtime.Object{
+			withClassHeader(createdIngWithIstio, networkpkg.IstioIngressClassName),
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: istioReady,
+		}}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestEmptyPath(t *testing.T) {
+	withAnnotations := func(annotations map[string]string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		for k, v := range annotations {
+			ing.Annotations[k] = v
+		}
+		return ing
+	}
+	sources := map[string]*v1alpha1.Ingress{
+		"conditional":   ingSometimesAsync,
+		"always":        ingAlwaysAsync,
+		"method routes": withAnnotations(map[string]string{asyncRoutesKey: "POST /orders"}),
+		"path modes":    withAnnotations(map[string]string{asyncPathModesKey: "/=always.async.knative.dev"}),
+	}
+	for name, source := range sources {
+		if source.Spec.Rules[0].HTTP.Paths[0].Path != "" {
+			t.Fatalf("%s: source path = %q, want an empty path", name, source.Spec.Rules[0].HTTP.Paths[0].Path)
+		}
+		ing := makeNewIngress(source, ingressKourier, defaultProducer(), &Config{NormalizeEmptyPaths: true})
+		producerPaths := 0
+		for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+			if !strings.HasPrefix(path.Path, "/") {
+				t.Errorf("%s: generated path %q, want a path starting with /", name, path.Path)
+			}
+			if path.Splits[0].ServiceName == kmeta.ChildName(source.Name, asyncSuffix) {
+				producerPaths++
+				if path.AppendHeaders[asyncOriginalHostHeader] == "" || path.RewriteHost == "" {
+					t.Errorf("%s: producer path %+v, want the producer headers and host", name, path)
+				}
+			}
+		}
+		if producerPaths == 0 {
+			t.Errorf("%s: no path routes to the producer", name)
+		}
+	}
+
+	normalized := make([]netv1alpha1.HTTPIngressPath, 0, len(conditionalAsyncPaths))
+	for _, path := range conditionalAsyncPaths {
+		path = *path.DeepCopy()
+		path.Path = "/"
+		normalized = append(normalized, path)
+	}
+
+	table := TableTest{{
+		Name: "empty paths are kept by default",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "empty paths are normalized",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{NormalizeEmptyPaths: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, normalized),
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestExplicitSyncPath(t *testing.T) {
+	syncPath := *conditionalAsyncPaths[1].DeepCopy()
+	syncPath.Headers = map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: preferSyncValue}}
+	explicit := ingressWithPaths(defaultNamespace, testingName, statusUnknown,
+		[]netv1alpha1.HTTPIngressPath{conditionalAsyncPaths[0], syncPath, conditionalAsyncPaths[1]})
+
+	table := TableTest{{
+		Name: "conditional mode falls through by default",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "conditional mode with an explicit sync path",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{ExplicitSyncPath: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			explicit,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "always mode is unchanged",
+		Key:  "default/testing-always",
+		Ctx:  withTestConfig(Config{ExplicitSyncPath: true}),
+		Objects: []runtime.Object{
+			ingAlwaysAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIngWithAsyncAlways,
+			service(defaultNamespace, testingAlwaysAsyncName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestSharedPathsAcrossRules(t *testing.T) {
+	shared := *ingSometimesAsync.Spec.Rules[0].HTTP.Paths[0].DeepCopy()
+	shared.Headers = map[string]v1alpha1.HeaderMatch{"X-Tenant": {Exact: "a"}}
+	source := ingSometimesAsync.DeepCopy()
+	source.Annotations[asyncRoutesKey] = "POST /orders"
+	// Both rules alias the same headers map and splits slice.
+	source.Spec.Rules = []netv1alpha1.IngressRule{{
+		Hosts: []string{exampleHost},
+		HTTP:  &netv1alpha1.HTTPIngressRuleValue{Paths: []netv1alpha1.HTTPIngressPath{shared}},
+	}, {
+		Hosts: []string{"other.example.com"},
+		HTTP:  &netv1alpha1.HTTPIngressRuleValue{Paths: []netv1alpha1.HTTPIngressPath{shared}},
+	}}
+
+	ing := makeNewIngress(source, ingressKourier, defaultProducer(), &Config{})
+	first, second := ing.Spec.Rules[0].HTTP.Paths, ing.Spec.Rules[1].HTTP.Paths
+	if len(first) != len(second) {
+		t.Fatalf("rules have %d and %d paths, want the same number", len(first), len(second))
+	}
+	for i := range first {
+		first[i].Headers["X-Tenant"] = v1alpha1.HeaderMatch{Exact: "b"}
+		first[i].Splits[0].ServiceName = "changed"
+		if first[i].AppendHeaders != nil {
+			first[i].AppendHeaders[asyncOriginalHostHeader] = "changed"
+		}
+	}
+	for i, path := range second {
+		if got := path.Headers["X-Tenant"].Exact; got != "a" {
+			t.Errorf("path %d of the second rule has X-Tenant %q, want %q", i, got, "a")
+		}
+		if path.Splits[0].ServiceName == "changed" {
+			t.Errorf("path %d of the second rule shares its splits with the first rule", i)
+		}
+		if path.AppendHeaders[asyncOriginalHostHeader] == "changed" {
+			t.Errorf("path %d of the second rule shares its append headers with the first rule", i)
+		}
+	}
+	if got := shared.Headers["X-Tenant"].Exact; got != "a" {
+		t.Errorf("source path has X-Tenant %q, want %q", got, "a")
+	}
+}
+
+func TestOriginalHostHeaderAnnotation(t *testing.T) {
+	disabled := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		asyncOriginalHostHeaderKey:           "false",
+	}))
+	ing := makeNewIngress(disabled, ingressKourier, defaultProducer(), &Config{})
+	if got, ok := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders[asyncOriginalHostHeader]; ok {
+		t.Errorf("%s = %q, want no header when disabled", asyncOriginalHostHeader, got)
+	}
+
+	ing = makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), &Config{})
+	if _, ok := ing.Spec.Rules[0].HTTP.Paths[0].AppendHeaders[asyncOriginalHostHeader]; !ok {
+		t.Errorf("%s is missing, want the header by default", asyncOriginalHostHeader)
+	}
+
+	invalid := map[string]string{asyncOriginalHostHeaderKey: "off"}
+	if err := validateAsyncModeAnnotation(invalid, &Config{}); err == nil {
+		t.Error("validateAsyncModeAnnotation() = nil, want error for a non boolean value")
+	}
+}
+
+func TestSplitModeAnnotation(t *testing.T) {
+	route := ingSometimesAsync.DeepCopy()
+	route.Annotations[asyncSplitModeKey] = routeSplitMode
+	if err := validateAsyncModeAnnotation(route.Annotations, &Config{}); err != nil {
+		t.Errorf("validateAsyncModeAnnotation() = %v, want nil for route mode", err)
+	}
+	for _, mode := range []string{mirrorSplitMode, "shadow"} {
+		invalid := map[string]string{asyncSplitModeKey: mode}
+		if err := validateAsyncModeAnnotation(invalid, &Config{}); err == nil {
+			t.Errorf("validateAsyncModeAnnotation() = nil, want error for split mode %s", mode)
+		}
+	}
+
+	mirror := ingSometimesAsync.DeepCopy()
+	mirror.Annotations[asyncSplitModeKey] = mirrorSplitMode
+
+	table := TableTest{{
+		Name: "route mode routes async requests to the producer",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			route,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "mirror mode is rejected",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			mirror,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key %s: mirror is not supported, "+
+				"Knative ingresses can't mirror traffic", asyncSplitModeKey),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestValidationExemption(t *testing.T) {
+	withAnnotations := func(annotations map[string]string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		for k, v := range annotations {
+			ing.Annotations[k] = v
+		}
+		return ing
+	}
+	invalid := withAnnotations(map[string]string{asyncPathModesKey: "/=sometimes"})
+	exempt := withAnnotations(map[string]string{asyncMetricLabelsKey: "team", asyncValidationKey: skipValidation})
+	// The exemption doesn't cover the annotations changing the routing.
+	exemptRouting := withAnnotations(map[string]string{asyncPathModesKey: "/=sometimes", asyncValidationKey: skipValidation})
+
+	logFile := filepath.Join(t.TempDir(), "controller.log")
+	logger, _ := logging.NewLogger(fmt.Sprintf(`{"level": "warn", "encoding": "json", "outputPaths": [%q]}`, logFile), "")
+	ctx := logging.WithLogger(context.Background(), logger)
+	readLogs := func() string {
+		logger.Sync()
+		logs, err := ioutil.ReadFile(logFile)
+		if err != nil {
+			t.Fatalf("Error reading the logs: %v", err)
+		}
+		return string(logs)
+	}
+	if err := validateIngress(ctx, invalid, &Config{}); err == nil {
+		t.Error("validateIngress() = nil, want error without the exemption")
+	}
+	if err := validateIngress(ctx, ingSometimesAsync, &Config{}); err != nil {
+		t.Errorf("validateIngress() = %v, want nil for a valid ingress", err)
+	}
+	if logs := readLogs(); logs != "" {
+		t.Errorf("validateIngress() logged %q, want no warning without the exemption", logs)
+	}
+	if err := validateIngress(ctx, exempt, &Config{}); err != nil {
+		t.Errorf("validateIngress() = %v, want nil for an exempt ingress", err)
+	}
+	if logs := readLogs(); !strings.Contains(logs, `"severity":"WARNING"`) || !strings.Contains(logs, "exempt from validation") {
+		t.Errorf("validateIngress() logged %q, want a warning", logs)
+	}
+	if err := validateIngress(ctx, exemptRouting, &Config{}); err == nil {
+		t.Error("validateIngress() = nil, want error for an exempt ingress with an invalid path mode")
+	}
+	alwaysDisabled := withAnnotations(map[string]string{AsyncModeAnnotationKey: asyncAlwaysMode, asyncValidationKey: skipValidation})
+	if err := validateIngress(ctx, alwaysDisabled, &Config{DisableAlwaysMode: true}); err == nil {
+		t.Error("validateIngress() = nil, want error for an exempt ingress in the disabled always mode")
+	}
+
+	table := TableTest{{
+		Name: "exempt ingress is reconciled",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			exempt,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "invalid ingress is rejected",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			invalid,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key %s: unsupported mode %q for path prefix /",
+				asyncPathModesKey, "sometimes"),
+		}}, {
+		Name: "exempt ingress with an invalid path mode is rejected",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			exemptRouting,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key %s: unsupported mode %q for path prefix /",
+				asyncPathModesKey, "sometimes"),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestPortNaming(t *testing.T) {
+	tests := []struct {
+		name     string
+		class    string
+		cfg      Config
+		wantName string
+	}{{
+		name:     "kourier",
+		class:    ingressKourier,
+		wantName: networking.ServicePortNameHTTP1,
+	}, {
+		name:     "istio keeps the knative naming by default",
+		class:    ingressIstio,
+		wantName: networking.ServicePortNameHTTP1,
+	}, {
+		name:     "istio with istio naming",
+		class:    ingressIstio,
+		cfg:      Config{PortNaming: map[string]string{ingressIstio: istioPortNaming}},
+		wantName: networking.ServicePortNameHTTP1 + "-" + producerServiceName,
+	}, {
+		name:     "istio h2c with istio naming",
+		class:    ingressIstio,
+		cfg:      Config{ProducerProtocol: "h2c", PortNaming: map[string]string{ingressIstio: istioPortNaming}},
+		wantName: networking.ServicePortNameH2C + "-" + producerServiceName,
+	}, {
+		name:     "kourier with istio naming",
+		class:    ingressKourier,
+		cfg:      Config{PortNaming: map[string]string{ingressKourier: istioPortNaming}},
+		wantName: networking.ServicePortNameHTTP1 + "-" + producerServiceName,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.cfg.Validate(); err != nil {
+				t.Fatalf("Validate() = %v", err)
+			}
+			svc := MakeK8sService(ingAlwaysAsync, test.class, defaultProducer(), &test.cfg)
+			if got := svc.Spec.Ports[0].Name; got != test.wantName {
+				t.Errorf("service port name = %q, want %q", got, test.wantName)
+			}
+		})
+	}
+
+	if err := (&Config{PortNaming: map[string]string{ingressKourier: "linkerd"}}).Validate(); err == nil {
+		t.Error("Validate() = nil, want error for unsupported port naming")
+	}
+}
+
+func TestIngressClassAnnotationKey(t *testing.T) {
+	const customKey = "example.com/ingress-class"
+	custom := createdIng.DeepCopy()
+	delete(custom.Annotations, networking.IngressClassAnnotationKey)
+	custom.Annotations[customKey] = ingressKourier
+
+	table := TableTest{{
+		Name: "pin the class with a custom annotation key",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressClassAnnotationKey: customKey}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			custom,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+
+	invalid := &Config{IngressClassAnnotationKey: "not a key"}
+	if err := invalid.Validate(); err == nil {
+		t.Error("Validate() = nil, want error for invalid annotation key")
+	}
+}
+
+func TestMeshAnnotations(t *testing.T) {
+	t.Setenv("MESH_ANNOTATIONS", `{"istio.ingress.networking.knative.dev": {"sidecar.istio.io/inject": "false"}}`)
+	cfg, err := NewConfigFromEnv()
+	if err != nil {
+		t.Fatalf("NewConfigFromEnv() = %v", err)
+	}
+
+	ing := makeNewIngress(ingSometimesAsync, ingressIstio, defaultProducer(), cfg)
+	want := map[string]string{
+		networking.IngressClassAnnotationKey: ingressIstio,
+		asyncSourceKey:                       testingName,
+		managedAnnotationsKey:                "sidecar.istio.io/inject",
+		"sidecar.istio.io/inject":            "false",
+	}
+	if !reflect.DeepEqual(ing.Annotations, want) {
+		t.Errorf("istio ingress annotations = %v, want %v", ing.Annotations, want)
+	}
+	svc := MakeK8sService(ingSometimesAsync, ingressIstio, defaultProducer(), cfg)
+	if got := svc.Annotations["sidecar.istio.io/inject"]; got != "false" {
+		t.Errorf("istio service annotation = %q, want %q", got, "false")
+	}
+
+	ing = makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), cfg)
+	if _, ok := ing.Annotations["sidecar.istio.io/inject"]; ok {
+		t.Errorf("kourier ingress annotations = %v, want no mesh annotations", ing.Annotations)
+	}
+	if svc := MakeK8sService(ingSometimesAsync, ingressKourier, defaultProducer(), cfg); len(svc.Annotations) != 1 {
+		t.Errorf("kourier service annotations = %v, want only the source", svc.Annotations)
+	}
+
+	invalid := &Config{MeshAnnotations: ClassAnnotations{ingressIstio: {"not a key": "false"}}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("Validate() = nil, want error for invalid annotation key")
+	}
+}
+
+func TestMeshAnnotationsServiceUpdate(t *testing.T) {
+	cfg := Config{MeshAnnotations: ClassAnnotations{ingressKourier: {"sidecar.istio.io/inject": "false"}}}
+	annotated := service(defaultNamespace, testingName)
+	annotated.Annotations["sidecar.istio.io/inject"] = "false"
+	annotated.Annotations[managedAnnotationsKey] = "sidecar.istio.io/inject"
+	ingWithMesh := ingressWithPaths(defaultNamespace, testingName, statusUnknown, conditionalAsyncPaths)
+	ingWithMesh.Annotations["sidecar.istio.io/inject"] = "false"
+	ingWithMesh.Annotations[managedAnnotationsKey] = "sidecar.istio.io/inject"
+	// An annotation set on the generated service by someone else.
+	foreign := func(svc *corev1.Service) *corev1.Service {
+		svc = svc.DeepCopy()
+		svc.Annotations["team.example.com/owner"] = "payments"
+		return svc
+	}
+
+	table := TableTest{{
+		Name: "add the mesh annotations to the existing service",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			ingWithMesh,
+			service(defaultNamespace, testingName),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: annotated,
+		}}}, {
+		Name: "remove the mesh annotations no longer configured",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			foreign(annotated),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: foreign(service(defaultNamespace, testingName)),
+		}}}, {
+		Name: "keep the annotations of others",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			ingWithMesh,
+			foreign(annotated),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestServiceAnnotations(t *testing.T) {
+	t.Setenv("SERVICE_ANNOTATIONS", `{"service.kubernetes.io/topology-aware-hints": "auto", "sidecar.istio.io/inject": "true"}`)
+	t.Setenv("MESH_ANNOTATIONS", `{"istio.ingress.networking.knative.dev": {"sidecar.istio.io/inject": "false"}}`)
+	cfg, err := NewConfigFromEnv()
+	if err != nil {
+		t.Fatalf("NewConfigFromEnv() = %v", err)
+	}
+
+	svc := MakeK8sService(ingSometimesAsync, ingressKourier, defaultProducer(), cfg)
+	want := map[string]string{
+		asyncSourceKey:        testingName,
+		managedAnnotationsKey: "service.kubernetes.io/topology-aware-hints,sidecar.istio.io/inject",
+		"service.kubernetes.io/topology-aware-hints": "auto",
+		"sidecar.istio.io/inject":                    "true",
+	}
+	if !reflect.DeepEqual(svc.Annotations, want) {
+		t.Errorf("kourier service annotations = %v, want %v", svc.Annotations, want)
+	}
+	svc = MakeK8sService(ingSometimesAsync, ingressIstio, defaultProducer(), cfg)
+	want["sidecar.istio.io/inject"] = "false"
+	if !reflect.DeepEqual(svc.Annotations, want) {
+		t.Errorf("istio service annotations = %v, want %v with the mesh annotations taking precedence", svc.Annotations, want)
+	}
+	if ing := makeNewIngress(ingSometimesAsync, ingressKourier, defaultProducer(), cfg); ing.Annotations["service.kubernetes.io/topology-aware-hints"] != "" {
+		t.Errorf("ingress annotations = %v, want no service annotations", ing.Annotations)
+	}
+
+	invalid := &Config{ServiceAnnotations: ServiceAnnotations{"not a key": "auto"}}
+	if err := invalid.Validate(); err == nil {
+		t.Error("Validate() = nil, want error for invalid annotation key")
+	}
+
+	annotated := service(defaultNamespace, testingName)
+	annotated.Annotations["service.kubernetes.io/topology-aware-hints"] = "auto"
+	annotated.Annotations[managedAnnotationsKey] = "service.kubernetes.io/topology-aware-hints"
+	table := TableTest{{
+		Name: "add the service annotations to the existing service",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{ServiceAnnotations: ServiceAnnotations{"service.kubernetes.io/topology-aware-hints": "auto"}}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: annotated,
+		}}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestIngressCompareIgnore(t *testing.T) {
+	// The data plane defaulted a field of the generated ingress.
+	defaulted := createdIng.DeepCopy()
+	defaulted.Spec.HTTPOption = netv1alpha1.HTTPOptionRedirected
+
+	table := TableTest{{
+		Name: "defaulted field corrected",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			defaulted,
+			service(defaultNamespace, testingName),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: createdIng,
+		}}}, {
+		Name: "defaulted field ignored",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressCompareIgnore: []string{"httpOption"}}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			defaulted,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestClusterLocalIngress(t *testing.T) {
+	clusterLocal := ingSometimesAsync.DeepCopy()
+	clusterLocal.Spec.Rules[0].Visibility = v1alpha1.IngressVisibilityClusterLocal
+	generated := createdIng.DeepCopy()
+	generated.Spec.Rules[0].Visibility = v1alpha1.IngressVisibilityClusterLocal
+	withIngressSpecHash(generated)
+	// Only the private load balancer is reported.
+	privateOnly := clusterLocal.DeepCopy()
+	privateOnly.Status.PublicLoadBalancer = &v1alpha1.LoadBalancerStatus{}
+	// The rules of a service labeled cluster-local may still look public.
+	visibilityLabel := map[string]string{networkpkg.VisibilityLabelKey: "cluster-local"}
+	labeled := ingSometimesAsync.DeepCopy()
+	labeled.Labels = visibilityLabel
+	labeledGenerated := generated.DeepCopy()
+	labeledGenerated.Labels = visibilityLabel
+	labeledPublic := createdIng.DeepCopy()
+	labeledPublic.Labels = visibilityLabel
+	labeledPrivateOnly := labeled.DeepCopy()
+	labeledPrivateOnly.Status.PublicLoadBalancer = &v1alpha1.LoadBalancerStatus{}
+
+	table := TableTest{{
+		Name: "cluster-local ingress reports the private load balancer",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			clusterLocal,
+		},
+		WantCreates: []runtime.Object{
+			generated,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: privateOnly,
+		}}}, {
+		Name: "visibility label wins over public rules",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			labeled,
+		},
+		WantCreates: []runtime.Object{
+			labeledGenerated,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: labeledPrivateOnly,
+		}}}, {
+		Name: "visibility label ignored",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IgnoreVisibilityLabel: true}),
+		Objects: []runtime.Object{
+			labeled,
+		},
+		WantCreates: []runtime.Object{
+			labeledPublic,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestProducerNotReadyRequeue(t *testing.T) {
+	cfg := Config{ProducerNotReadyMinDelay: 10 * time.Second, ProducerNotReadyMaxDelay: time.Minute}
+	waiting := ingSometimesAsync.DeepCopy()
+	waiting.GetConditionSet().Manage(&waiting.Status).MarkUnknown(v1alpha1.IngressConditionLoadBalancerReady, "ProducerNotReady",
+		"Waiting for the producer %s to have ready endpoints", defaultProducer().Hostname())
+
+	var delays []time.Duration
+	table := TableTest{{
+		Name: "requeue while the producer has no endpoints",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: waiting,
+		}}},
+	}
+	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+		r := NewReconciler(listers.GetIngressLister(), listers.GetK8sServiceLister(), listers.GetEndpointsLister(),
+			fakenetworkingclient.Get(ctx), fakekubeclient.Get(ctx), cfg)
+		r.enqueueAfter = func(_ interface{}, delay time.Duration) {
+			delays = append(delays, delay)
+		}
+		return ingressreconciler.NewReconciler(ctx, logging.FromContext(ctx), fakenetworkingclient.Get(ctx),
+			listers.GetIngressLister(), controller.GetEventRecorder(ctx), r, asyncIngressClassName, controller.Options{})
+	}))
+
+	if want := []time.Duration{10 * time.Second}; !reflect.DeepEqual(delays, want) {
+		t.Errorf("requeue delays = %v, want %v", delays, want)
+	}
+	if err := (&Config{ProducerNotReadyMinDelay: time.Minute, ProducerNotReadyMaxDelay: time.Second}).Validate(); err == nil {
+		t.Error("Validate() = nil, want error for a max delay below the min delay")
+	}
+}
+
+func TestProducerHealthProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != defaultProducer().Hostname() {
+			t.Errorf("Probe host = %q, want %q", r.Host, defaultProducer().Hostname())
+		}
+		switch r.URL.Path {
+		case "/healthz":
+		case "/redirect":
+			http.Redirect(w, r, "/healthz", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	// Route the probes of the producer hostname to the test server.
+	client := probeClient(&http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	})
+	withHealthPath := func(path string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		ing.Annotations[asyncProducerHealthPathKey] = path
+		return ing
+	}
+	unhealthy := withHealthPath("/unhealthy")
+	unhealthy.GetConditionSet().Manage(&unhealthy.Status).MarkUnknown(v1alpha1.IngressConditionLoadBalancerReady, "ProducerUnhealthy",
+		"The producer %s failed the health probe: unexpected status 503", defaultProducer().Hostname())
+	redirected := withHealthPath("/redirect")
+	redirected.GetConditionSet().Manage(&redirected.Status).MarkUnknown(v1alpha1.IngressConditionLoadBalancerReady, "ProducerUnhealthy",
+		"The producer %s failed the health probe: unexpected status 302", defaultProducer().Hostname())
+
+	var delays []time.Duration
+	table := TableTest{{
+		Name: "healthy producer",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withHealthPath("/healthz"),
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "unhealthy producer",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withHealthPath("/unhealthy"),
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: unhealthy,
+		}}}, {
+		Name: "redirects are not followed",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withHealthPath("/redirect"),
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: redirected,
+		}}}, {
+		Name: "invalid health path",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withHealthPath("healthz"),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key %s: healthz must start with /", asyncProducerHealthPathKey),
+		}},
+	}
+	table.Test(t, MakeFactory(func(ctx context.Context, listers *Listers, cmw configmap.Watcher) controller.Reconciler {
+		r := NewReconciler(listers.GetIngressLister(), listers.GetK8sServiceLister(), listers.GetEndpointsLister(),
+			fakenetworkingclient.Get(ctx), fakekubeclient.Get(ctx), Config{})
+		r.httpClient = client
+		r.enqueueAfter = func(_ interface{}, delay time.Duration) {
+			delays = append(delays, delay)
+		}
+		return ingressreconciler.NewReconciler(ctx, logging.FromContext(ctx), fakenetworkingclient.Get(ctx),
+			listers.GetIngressLister(), controller.GetEventRecorder(ctx), r, asyncIngressClassName, controller.Options{})
+	}))
+
+	if want := []time.Duration{defaultProducerNotReadyMinDelay, defaultProducerNotReadyMinDelay}; !reflect.DeepEqual(delays, want) {
+		t.Errorf("requeue delays = %v, want %v", delays, want)
+	}
+}
+
+func TestProducerProbeRetries(t *testing.T) {
+	// The server fails the probes until healthy is set.
+	var mu sync.Mutex
+	var healthy bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	setHealthy := func(h bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		healthy = h
+	}
+	newReconciler := func(cfg Config) (*Reconciler, *[]time.Duration) {
+		var delays []time.Duration
+		r := &Reconciler{
+			config: cfg,
+			httpClient: probeClient(&http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+				},
+			}),
+		}
+		r.enqueueAfter = func(_ interface{}, delay time.Duration) {
+			delays = append(delays, delay)
+		}
+		return r, &delays
+	}
+	flaky := ingSometimesAsync.DeepCopy()
+	flaky.Annotations[asyncProducerHealthPathKey] = "/healthz"
+	wantReady := func(r *Reconciler, ing *v1alpha1.Ingress, want bool, when string) {
+		t.Helper()
+		if got, err := r.waitForProducer(context.Background(), ing, defaultProducer()); err != nil || got != want {
+			t.Errorf("waitForProducer() %s = %v, %v, want %v", when, got, err, want)
+		}
+	}
+	reason := func(ing *v1alpha1.Ingress) string {
+		return ing.Status.GetCondition(v1alpha1.IngressConditionLoadBalancerReady).Reason
+	}
+
+	// The failures below the threshold requeue the ingress after the interval and keep
+	// its condition, a success resets them.
+	r, delays := newReconciler(Config{ProducerProbeFailureThreshold: 3, ProducerProbeInterval: 2 * time.Second})
+	ing := flaky.DeepCopy()
+	setHealthy(false)
+	wantReady(r, ing, false, "after the first failure")
+	wantReady(r, ing, false, "after the second failure")
+	if got := reason(ing); got == producerUnhealthyReason {
+		t.Errorf("Reason = %s below the failure threshold, want the previous reason", got)
+	}
+	if want := []time.Duration{2 * time.Second, 2 * time.Second}; !reflect.DeepEqual(*delays, want) {
+		t.Errorf("requeue delays = %v, want %v", *delays, want)
+	}
+	setHealthy(true)
+	wantReady(r, ing, true, "after a success")
+	setHealthy(false)
+	wantReady(r, ing, false, "after a failure following the success")
+	if got := reason(ing); got == producerUnhealthyReason {
+		t.Errorf("Reason = %s after the failures were reset, want the previous reason", got)
+	}
+
+	// Reaching the threshold marks the ingress as waiting for the producer.
+	r, delays = newReconciler(Config{ProducerProbeFailureThreshold: 2, ProducerProbeInterval: 2 * time.Second})
+	ing = flaky.DeepCopy()
+	wantReady(r, ing, false, "after the first failure")
+	wantReady(r, ing, false, "at the failure threshold")
+	if got := reason(ing); got != producerUnhealthyReason {
+		t.Errorf("Reason = %s at the failure threshold, want %s", got, producerUnhealthyReason)
+	}
+	if want := []time.Duration{2 * time.Second, defaultProducerNotReadyMinDelay}; !reflect.DeepEqual(*delays, want) {
+		t.Errorf("requeue delays = %v, want %v", *delays, want)
+	}
+
+	for _, invalid := range []Config{
+		{ProducerProbeFailureThreshold: -1},
+		{ProducerProbeFailureThreshold: maxProducerProbeFailureThreshold + 1},
+		{ProducerProbeInterval: -time.Second},
+		{ProducerProbeInterval: 2 * time.Minute},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Validate(%+v) = nil, want error", invalid)
+		}
+	}
+}
+
+func TestDefaultLoadBalancerWarning(t *testing.T) {
+	const contour = "contour.ingress.networking.knative.dev"
+	source := ingSometimesAsync.DeepCopy()
+	source.Annotations[asyncIngressClassKey] = contour
+	generated := createdIng.DeepCopy()
+	generated.Annotations[networking.IngressClassAnnotationKey] = contour
+	msg := "The load balancers of the ingress class " + contour + " are unknown, the status points to the default load balancers"
+	warned := source.DeepCopy()
+	warned.GetConditionSet().Manage(&warned.Status).SetCondition(apis.Condition{
+		Type:     defaultLoadBalancerCondition,
+		Status:   corev1.ConditionTrue,
+		Severity: apis.ConditionSeverityWarning,
+		Reason:   "UnknownIngressClass",
+		Message:  msg,
+	})
+
+	table := TableTest{{
+		Name: "class without known load balancers",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressClasses: []string{contour}}),
+		Objects: []runtime.Object{
+			source,
+		},
+		WantCreates: []runtime.Object{
+			generated,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: warned,
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "DefaultLoadBalancer", msg),
+		}}, {
+		Name: "class with known load balancers",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestPassUnknownIngressClass(t *testing.T) {
+	const nginx = "nginx.ingress.networking.knative.dev"
+	t.Setenv(ingressClassName, nginx)
+	generated := createdIng.DeepCopy()
+	generated.Annotations[networking.IngressClassAnnotationKey] = nginx
+	msg := "The load balancers of the ingress class " + nginx + " are unknown, the status points to the default load balancers"
+	warned := ingSometimesAsync.DeepCopy()
+	warned.GetConditionSet().Manage(&warned.Status).SetCondition(apis.Condition{
+		Type:     defaultLoadBalancerCondition,
+		Status:   corev1.ConditionTrue,
+		Severity: apis.ConditionSeverityWarning,
+		Reason:   "UnknownIngressClass",
+		Message:  msg,
+	})
+
+	table := TableTest{{
+		Name: "unknown class is passed through",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{PassUnknownIngressClass: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			generated,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: warned,
+		}},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "DefaultLoadBalancer", msg),
+		}}, {
+		Name: "unknown class is replaced by kourier by default",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestPreferProducers(t *testing.T) {
+	original := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		asyncPreferProducersKey:              "respond-priority=priority-producer,respond-batch=batch-producer",
+	}))
+	preferPath := func(value, producer string) netv1alpha1.HTTPIngressPath {
+		path := *conditionalAsyncPaths[0].DeepCopy()
+		path.Headers = map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: value}}
+		path.Splits[0].ServiceName = testingName + asyncSuffix + "-" + producer
+		path.RewriteHost = network.GetServiceHostname(producer, knativeTesting)
+		return path
+	}
+	preferService := func(producer string) *corev1.Service {
+		svc := service(defaultNamespace, testingName)
+		svc.Name = testingName + asyncSuffix + "-" + producer
+		svc.Labels = map[string]string{preferProducerIngressLabelKey: testingName}
+		svc.Spec.ExternalName = network.GetServiceHostname(producer, knativeTesting)
+		return withServiceSpecHash(svc)
+	}
+	want := []netv1alpha1.HTTPIngressPath{
+		preferPath("respond-batch", "batch-producer"),
+		preferPath("respond-priority", "priority-producer"),
+		conditionalAsyncPaths[0],
+		conditionalAsyncPaths[1],
+	}
+
+	table := TableTest{{
+		Name: "two Prefer values route to two producers",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			original,
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, want),
+			service(defaultNamespace, testingName),
+			preferService("batch-producer"),
+			preferService("priority-producer"),
+		}}, {
+		Name: "delete the service of a removed mapping",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			service(defaultNamespace, testingName),
+			preferService("batch-producer"),
+		},
+		WantDeletes: []ktesting.DeleteActionImpl{{
+			ActionImpl: ktesting.ActionImpl{
+				Namespace: defaultNamespace,
+				Verb:      "delete",
+				Resource:  corev1.SchemeGroupVersion.WithResource("services"),
+			},
+			Name: testingName + asyncSuffix + "-batch-producer",
+		}}}, {
+		Name: "invalid prefer producers",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+				networking.IngressClassAnnotationKey: asyncIngressClassName,
+				asyncPreferProducersKey:              "respond-async=batch-producer",
+			})),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key %s: the Prefer value %s can't be mapped, it is routed by the async mode",
+				asyncPreferProducersKey, preferAsyncValue),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestProducerNamespaceChange(t *testing.T) {
+	// The objects generated before the producers moved from the old namespace to the
+	// system namespace, e.g. after reinstalling the component.
+	const oldNamespace = "knative-serving"
+	original := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		asyncPreferProducersKey:              "respond-batch=batch-producer",
+	}))
+	generated := withIngressSpecHash(makeNewIngress(original, ingressKourier, defaultProducer(), &Config{}))
+	generated.Status = statusUnknown
+	oldGenerated := generated.DeepCopy()
+	for i := range oldGenerated.Spec.Rules[0].HTTP.Paths {
+		path := &oldGenerated.Spec.Rules[0].HTTP.Paths[i]
+		if path.RewriteHost != "" {
+			path.RewriteHost = strings.Replace(path.RewriteHost, "."+knativeTesting+".", "."+oldNamespace+".", 1)
+		}
+	}
+	withIngressSpecHash(oldGenerated)
+
+	preferService := func(namespace string) *corev1.Service {
+		svc := service(defaultNamespace, testingName)
+		svc.Name = testingName + asyncSuffix + "-batch-producer"
+		svc.Labels = map[string]string{preferProducerIngressLabelKey: testingName}
+		svc.Spec.ExternalName = network.GetServiceHostname("batch-producer", namespace)
+		return withServiceSpecHash(svc)
+	}
+	oldService := service(defaultNamespace, testingName)
+	oldService.Spec.ExternalName = network.GetServiceHostname(producerServiceName, oldNamespace)
+	withServiceSpecHash(oldService)
+
+	table := TableTest{{
+		Name: "producer hosts follow the producer namespace",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			original,
+			oldGenerated,
+			oldService,
+			preferService(oldNamespace),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: generated,
+		}, {
+			Object: service(defaultNamespace, testingName),
+		}, {
+			Object: preferService(knativeTesting),
+		}}}, {
+		Name: "nothing to update once the hosts follow",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			original,
+			generated,
+			service(defaultNamespace, testingName),
+			preferService(knativeTesting),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestGeneratedRoutesReport(t *testing.T) {
+	cfg := Config{ReportGeneratedRoutes: true}
+	reported := func(ing *v1alpha1.Ingress, msg string) *v1alpha1.Ingress {
+		ing = ing.DeepCopy()
+		ing.GetConditionSet().Manage(&ing.Status).SetCondition(apis.Condition{
+			Type:     routesGeneratedCondition,
+			Status:   corev1.ConditionTrue,
+			Severity: apis.ConditionSeverityInfo,
+			Reason:   "RoutesGenerated",
+			Message:  msg,
+		})
+		return ing
+	}
+	preferIng := ingress(defaultNamespace, testingName, statusReady, withAnnotations(map[string]string{
+		networking.IngressClassAnnotationKey: asyncIngressClassName,
+		asyncPreferProducersKey:              "respond-batch=batch-producer",
+	}))
+	preferCreated := withIngressSpecHash(makeNewIngress(preferIng, ingressKourier, defaultProducer(), &cfg))
+	preferCreated.Status = statusUnknown
+
+	table := TableTest{{
+		Name: "always mode",
+		Key:  "default/testing-always",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingAlwaysAsync,
+			createdIngWithAsyncAlways,
+			service(defaultNamespace, testingAlwaysAsyncName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: reported(ingAlwaysAsync, "The generated ingress has 1 async and 1 sync paths in always.async.knative.dev mode"),
+		}}}, {
+		Name: "conditional mode",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: reported(ingSometimesAsync, "The generated ingress has 1 async and 1 sync paths in conditional.async.knative.dev mode"),
+		}}}, {
+		Name: "conditional mode with a prefer producer",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			preferIng,
+		},
+		WantCreates: []runtime.Object{
+			preferCreated,
+			service(defaultNamespace, testingName),
+			withServiceSpecHash(makePreferServices(preferIng, ingressKourier, &cfg)[0]),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: reported(preferIng, "The generated ingress has 2 async and 1 sync paths in conditional.async.knative.dev mode"),
+		}}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestReportConditions(t *testing.T) {
+	cfg := Config{ReportConditions: true}
+	reported := func(ing *v1alpha1.Ingress, steps ...apis.Condition) *v1alpha1.Ingress {
+		ing = ing.DeepCopy()
+		for _, step := range steps {
+			step.Severity = apis.ConditionSeverityInfo
+			ing.GetConditionSet().Manage(&ing.Status).SetCondition(step)
+		}
+		return ing
+	}
+	step := func(t apis.ConditionType, status corev1.ConditionStatus, reason, message string) apis.Condition {
+		return apis.Condition{Type: t, Status: status, Reason: reason, Message: message}
+	}
+	valid := step(annotationValidCondition, corev1.ConditionTrue, "", "")
+	producerReady := step(producerReadyCondition, corev1.ConditionTrue, "", "")
+	readyChild := createdIng.DeepCopy()
+	readyChild.Status = statusReady
+	clusterIPService := service(defaultNamespace, testingName)
+	clusterIPService.Spec.Type = corev1.ServiceTypeClusterIP
+	conflictMsg := "The service testing-async exists with type ClusterIP, refusing to overwrite it"
+	conflict := ingSometimesAsync.DeepCopy()
+	conflict.GetConditionSet().Manage(&conflict.Status).MarkFalse(v1alpha1.IngressConditionNetworkConfigured,
+		serviceConflictReason, conflictMsg)
+
+	table := TableTest{{
+		Name: "ready generated ingress",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			readyChild,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: reported(ingSometimesAsync, valid, producerReady,
+				step(childIngressReadyCondition, corev1.ConditionTrue, "", ""),
+				step(serviceReadyCondition, corev1.ConditionTrue, "", "")),
+		}}}, {
+		Name: "generated ingress not reconciled yet",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: reported(ingSometimesAsync, valid, producerReady,
+				step(childIngressReadyCondition, corev1.ConditionUnknown, childNotReadyReason,
+					"Waiting for the generated ingress testing-new to be ready"),
+				step(serviceReadyCondition, corev1.ConditionTrue, "", "")),
+		}}}, {
+		Name: "service conflict",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			clusterIPService,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: reported(conflict, valid, producerReady,
+				step(serviceReadyCondition, corev1.ConditionFalse, serviceConflictReason, conflictMsg)),
+		}}}, {
+		Name: "invalid annotation",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(cfg),
+		Objects: []runtime.Object{
+			ingInvalidModeAnnotation,
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key async.knative.dev/mode: "),
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: reported(ingInvalidModeAnnotation,
+				step(annotationValidCondition, corev1.ConditionFalse, invalidAnnotationReason, "Invalid value for key async.knative.dev/mode: ")),
+		}}}, {
+		Name: "no step conditions by default",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			readyChild,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestOwnerReferences(t *testing.T) {
+	owner := metav1.OwnerReference{
+		APIVersion: "serving.knative.dev/v1",
+		Kind:       "Route",
+		Name:       testingName,
+		UID:        "route-uid",
+		Controller: &[]bool{true}[0],
+	}
+	owned := ingSometimesAsync.DeepCopy()
+	owned.OwnerReferences = []metav1.OwnerReference{owner}
+	ownedIng := createdIng.DeepCopy()
+	ownedIng.OwnerReferences = owned.OwnerReferences
+	ownedService := service(defaultNamespace, testingName)
+	ownedService.OwnerReferences = owned.OwnerReferences
+
+	unowned := owned.DeepCopy()
+	unowned.Finalizers = []string{finalizerName}
+	deleted := unowned.DeepCopy()
+	deleted.DeletionTimestamp = &metav1.Time{Time: time.Unix(1, 0)}
+	unfinalized := owned.DeepCopy()
+	unfinalized.Finalizers = nil
+	otherService := service(defaultNamespace, "other")
+	foreignIng := createdIng.DeepCopy()
+	foreignIng.Annotations[asyncSourceKey] = "other"
+	foreignService := service(defaultNamespace, testingName)
+	delete(foreignService.Annotations, asyncSourceKey)
+
+	table := TableTest{{
+		Name: "owner references are copied by default",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			owned,
+		},
+		WantCreates: []runtime.Object{
+			ownedIng,
+			ownedService,
+		}}, {
+		Name: "owner references, the deleted source is left to the garbage collector",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			deleted,
+			ownedIng,
+			ownedService,
+		}}, {
+		Name: "no owner references, the source gets a finalizer",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{DisableOwnerReferences: true}),
+		Objects: []runtime.Object{
+			unfinalized,
+		},
+		WantCreates: []runtime.Object{
+			createdIng,
+			service(defaultNamespace, testingName),
+		},
+		WantPatches: []ktesting.PatchActionImpl{
+			patchFinalizers(defaultNamespace, testingName, finalizerName),
+		},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, "FinalizerUpdate", "Updated %q finalizers", testingName),
+		}}, {
+		Name: "no owner references, the finalizer deletes the generated objects",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{DisableOwnerReferences: true}),
+		Objects: []runtime.Object{
+			deleted,
+			createdIng,
+			service(defaultNamespace, testingName),
+			otherService,
+		},
+		WantDeletes: []ktesting.DeleteActionImpl{{
+			ActionImpl: ktesting.ActionImpl{
+				Namespace: defaultNamespace,
+				Verb:      "delete",
+				Resource:  v1alpha1.SchemeGroupVersion.WithResource("ingresses"),
+			},
+			Name: testingName + newSuffix,
+		}, {
+			ActionImpl: ktesting.ActionImpl{
+				Namespace: defaultNamespace,
+				Verb:      "delete",
+				Resource:  corev1.SchemeGroupVersion.WithResource("services"),
+			},
+			Name: testingName + asyncSuffix,
+		}},
+		WantPatches: []ktesting.PatchActionImpl{
+			patchFinalizers(defaultNamespace, testingName),
+		},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, "FinalizerUpdate", "Updated %q finalizers", testingName),
+		}}, {
+		Name: "no owner references, the finalizer keeps the objects not generated for the source",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{DisableOwnerReferences: true}),
+		Objects: []runtime.Object{
+			deleted,
+			foreignIng,
+			foreignService,
+		},
+		WantPatches: []ktesting.PatchActionImpl{
+			patchFinalizers(defaultNamespace, testingName),
+		},
+		WantEvents: []string{
+			Eventf(corev1.EventTypeNormal, "FinalizerUpdate", "Updated %q finalizers", testingName),
+		}}, {
+		Name: "owner references disabled later, the generated objects are adopted",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{DisableOwnerReferences: true}),
+		Objects: []runtime.Object{
+			unowned,
+			ownedIng,
+			ownedService,
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+// patchFinalizers returns the patch the generated reconciler sends to set the finalizers.
+func patchFinalizers(namespace, name string, finalizers ...string) ktesting.PatchActionImpl {
+	action := ktesting.PatchActionImpl{}
+	action.Name = name
+	action.Namespace = namespace
+	if finalizers == nil {
+		finalizers = []string{}
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"finalizers":      finalizers,
+			"resourceVersion": "",
+		},
+	})
+	action.Patch = patch
+	return action
+}
+
+func TestForceSyncAnnotation(t *testing.T) {
+	withForceSync := func(value string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		ing.Annotations[asyncForceSyncAtKey] = value
+		return ing
+	}
+	generated := func(value string) *v1alpha1.Ingress {
+		ing := createdIng.DeepCopy()
+		ing.Annotations[asyncForceSyncAtKey] = value
+		return ing
+	}
+	generatedService := func(value string) *corev1.Service {
+		svc := service(defaultNamespace, testingName)
+		svc.Annotations[asyncForceSyncAtKey] = value
+		return svc
+	}
+
+	table := TableTest{{
+		Name: "new value writes the generated objects",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withForceSync("2020-10-02T10:00:00Z"),
+			generated("2020-10-01T10:00:00Z"),
+			generatedService("2020-10-01T10:00:00Z"),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: generated("2020-10-02T10:00:00Z"),
+		}, {
+			Object: generatedService("2020-10-02T10:00:00Z"),
+		}}}, {
+		Name: "unchanged value writes nothing",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withForceSync("2020-10-02T10:00:00Z"),
+			generated("2020-10-02T10:00:00Z"),
+			generatedService("2020-10-02T10:00:00Z"),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestSourceGenerationAnnotation(t *testing.T) {
+	withGeneration := func(ing *v1alpha1.Ingress, generation string) *v1alpha1.Ingress {
+		ing = ing.DeepCopy()
+		ing.Annotations[sourceGenerationKey] = generation
+		return ing
+	}
+	changedSource := ingSometimesAsync.DeepCopy()
+	changedSource.Generation = 2
+	changedSource.Status.ObservedGeneration = 2
+
+	table := TableTest{{
+		Name: "annotation carries the generation of the source",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{SourceGenerationAnnotation: true}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			withGeneration(createdIng, "0"),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "annotation is updated when the source changes",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{SourceGenerationAnnotation: true}),
+		Objects: []runtime.Object{
+			changedSource,
+			withGeneration(createdIng, "1"),
+			service(defaultNamespace, testingName),
+		},
+		WantUpdates: []ktesting.UpdateActionImpl{{
+			Object: withGeneration(createdIng, "2"),
+		}}}, {
+		Name: "unchanged source is not updated",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{SourceGenerationAnnotation: true}),
+		Objects: []runtime.Object{
+			changedSource,
+			withGeneration(createdIng, "2"),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "no annotation by default",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			changedSource,
+			createdIng,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+// asyncIngressClassKey selects the class of the generated ingress among the classes
+// managed by the controller.
+const asyncIngressClassKey = "async.knative.dev/ingress-class"
+
+// defaultIngressClass returns the class set with INGRESS_CLASS_NAME, or Kourier if the
+// load balancer of the class is unknown. With PassUnknownIngressClass a class with unknown
+// load balancers is kept, the status then points to the default load balancers.
+func (c *Config) defaultIngressClass() string {
+	ingressClass := os.Getenv(ingressClassName)
+	if ingressClass == "" || (!c.PassUnknownIngressClass && !knownLoadBalancer(ingressClass)) {
+		return ingressKourier
+	}
+	return ingressClass
+}
+
+// ingressClassFor returns the class of the ingress generated for the source ingress.
+// The class annotation of the source must name the default class or one of the
+// classes listed in INGRESS_CLASSES.
+func (r *Reconciler) ingressClassFor(ing *v1alpha1.Ingress) (string, error) {
+	defaultClass := r.config.defaultIngressClass()
+	ingressClass, ok := ing.Annotations[asyncIngressClassKey]
+	if !ok {
+		return defaultClass, nil
+	}
+	if ingressClass != defaultClass && !sets.NewString(r.config.IngressClasses...).Has(ingressClass) {
+		return "", fmt.Errorf("Invalid value for key %s: ingress class %q is not managed by the controller",
+			asyncIngressClassKey, ingressClass)
+	}
+	return ingressClass, nil
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/logging"
+)
+
+// defaultIngressNameTemplate names the generated ingress after its source with the -new suffix.
+const defaultIngressNameTemplate = "{{.Name}}" + newSuffix
+
+// asyncSourceKey is set on the generated ingresses and services to the name of their source
+// ingress, to find the ingresses generated for it under another name template and the
+// source to reconcile when a generated object changes.
+const asyncSourceKey = "async.knative.dev/source"
+
+// ingressNameData holds the fields of the source ingress available to the
+// INGRESS_NAME_TEMPLATE.
+type ingressNameData struct {
+	Name      string
+	Namespace string
+	// Hash is the first 8 hex digits of the SHA-256 of the namespace and name.
+	Hash string
+}
+
+// generatedIngressName returns the name of the ingress generated for the source ingress.
+func (c *Config) generatedIngressName(namespace, name string) string {
+	tmpl := c.nameTemplate
+	if tmpl == nil {
+		// The Config wasn't validated, parse the template on the fly.
+		parsed, err := parseIngressNameTemplate(c.ingressNameTemplate())
+		if err != nil {
+			return name + newSuffix
+		}
+		tmpl = parsed
+	}
+	generated, err := executeIngressNameTemplate(tmpl, namespace, name)
+	if err != nil {
+		// The template was validated with the config.
+		return name + newSuffix
+	}
+	return generated
+}
+
+func (c *Config) ingressNameTemplate() string {
+	if c.IngressNameTemplate == "" {
+		return defaultIngressNameTemplate
+	}
+	return c.IngressNameTemplate
+}
+
+func parseIngressNameTemplate(text string) (*template.Template, error) {
+	return template.New("ingress-name").Option("missingkey=error").Parse(text)
+}
+
+func executeIngressNameTemplate(tmpl *template.Template, namespace, name string) (string, error) {
+	sum := sha256.Sum256([]byte(namespace + "/" + name))
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, ingressNameData{
+		Name:      name,
+		Namespace: namespace,
+		Hash:      hex.EncodeToString(sum[:])[:8],
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// validateIngressNameTemplate parses the template and returns an error if it doesn't
+// produce a legal name, produces the same name for different ingresses, or produces the
+// name of the source ingress, which the generated ingress would replace.
+func validateIngressNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := parseIngressNameTemplate(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ingress name template %q: %w", text, err)
+	}
+	names := make([]string, 0, 2)
+	for _, source := range []string{"helloworld", "helloworld-sleep"} {
+		generated, err := executeIngressNameTemplate(tmpl, "default", source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ingress name template %q: %w", text, err)
+		}
+		if errs := validation.IsDNS1123Subdomain(generated); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid ingress name template %q: %s", text, strings.Join(errs, "; "))
+		}
+		if generated == source {
+			return nil, fmt.Errorf("invalid ingress name template %q: the name must differ from the source ingress", text)
+		}
+		names = append(names, generated)
+	}
+	if names[0] == names[1] {
+		return nil, fmt.Errorf("invalid ingress name template %q: the name must depend on the source ingress", text)
+	}
+	return tmpl, nil
+}
+
+// staleIngresses returns the ingresses generated for the source under another name
+// template: the ingresses annotated with the source, and the ingress with the default name
+// generated before the annotation was set. Only ingresses carrying the spec hash of the
+// controller and adoptable for the source are stale, an ingress of another controller with
+// the same name is kept. The current generated ingress is never stale.
+func (r *Reconciler) staleIngresses(ctx context.Context, source *v1alpha1.Ingress) ([]*v1alpha1.Ingress, error) {
+	ingresses, err := r.ingressLister.Ingresses(source.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	current := r.config.generatedIngressName(source.Namespace, source.Name)
+	var stale []*v1alpha1.Ingress
+	for _, ing := range ingresses {
+		if ing.Name == current || ing.Name == source.Name {
+			continue
+		}
+		name, annotated := ing.Annotations[asyncSourceKey]
+		if name != source.Name && (annotated || ing.Name != source.Name+newSuffix) {
+			continue
+		}
+		if _, ok := ing.Annotations[specHashKey]; !ok || !r.config.adoptable(metav1.GetControllerOf(ing), source) {
+			logging.FromContext(ctx).Warnf("Not deleting the ingress %s, it was not generated for %s", ing.Name, source.Name)
+			continue
+		}
+		stale = append(stale, ing)
+	}
+	return stale, nil
+}
+
+// deleteStaleIngresses deletes the ingresses generated for the source under another name
+// template, so they don't keep routing after the template changed.
+func (r *Reconciler) deleteStaleIngresses(ctx context.Context, source *v1alpha1.Ingress) error {
+	logger := logging.FromContext(ctx)
+	stale, err := r.staleIngresses(ctx, source)
+	if err != nil {
+		return err
+	}
+	for _, ing := range stale {
+		logger.Infof("Deleting the ingress %s generated under another name template", ing.Name)
+		err = r.netclient.NetworkingV1alpha1().Ingresses(ing.Namespace).Delete(ctx, ing.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrs.IsNotFound(err) {
+			return fmt.Errorf("failed to delete Ingress: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ktesting "k8s.io/client-go/testing"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+
+	. "knative.dev/async-component/pkg/reconciler/testing"
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+func TestIngressNameTemplate(t *testing.T) {
+	const template = "async-{{.Name}}-{{.Hash}}"
+	renamed := createdIng.DeepCopy()
+	renamed.Name = "async-testing-fa90f1fe"
+
+	table := TableTest{{
+		Name: "generated ingress named by the template",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressNameTemplate: template}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+		},
+		WantCreates: []runtime.Object{
+			renamed,
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "existing ingress named by the template is kept",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressNameTemplate: template}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			renamed,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+
+	if got, want := (&Config{}).generatedIngressName(defaultNamespace, testingName), testingName+newSuffix; got != want {
+		t.Errorf("generatedIngressName() = %q, want %q by default", got, want)
+	}
+}
+
+func TestValidateIngressNameTemplate(t *testing.T) {
+	for _, valid := range []string{"{{.Name}}-new", "async-{{.Name}}", "{{.Name}}-{{.Hash}}", "async-{{.Hash}}"} {
+		if err := (&Config{IngressNameTemplate: valid}).Validate(); err != nil {
+			t.Errorf("Validate(%q) = %v, want nil", valid, err)
+		}
+	}
+	cfg := &Config{IngressNameTemplate: "async-{{.Name}}"}
+	if err := cfg.Validate(); err != nil || cfg.nameTemplate == nil {
+		t.Fatalf("Validate() = %v, want the parsed template", err)
+	}
+	if got, want := cfg.generatedIngressName(defaultNamespace, testingName), "async-"+testingName; got != want {
+		t.Errorf("generatedIngressName() = %q, want %q", got, want)
+	}
+	for _, invalid := range []string{"{{.Name", "{{.Owner}}", "Async_{{.Name}}", "async", "{{.Namespace}}-async", "{{.Name}}", "{{.Name}}{{if false}}-new{{end}}"} {
+		if err := (&Config{IngressNameTemplate: invalid}).Validate(); err == nil {
+			t.Errorf("Validate(%q) = nil, want error", invalid)
+		}
+	}
+}
+
+func TestDeleteStaleIngresses(t *testing.T) {
+	named := func(name string) *v1alpha1.Ingress {
+		ing := createdIng.DeepCopy()
+		ing.Name = name
+		return ing
+	}
+	foreign := createdIng.DeepCopy()
+	delete(foreign.Annotations, specHashKey)
+	finalized := ingSometimesAsync.DeepCopy()
+	finalized.Finalizers = []string{finalizerName}
+	owned := createdIng.DeepCopy()
+	owned.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "serving.knative.dev/v1",
+		Kind:       "Route",
+		Name:       testingName,
+		UID:        "route-uid",
+		Controller: &[]bool{true}[0],
+	}}
+	finalized.OwnerReferences = owned.OwnerReferences
+	legacy := createdIng.DeepCopy()
+	delete(legacy.Annotations, asyncSourceKey)
+	otherSource := named("v1-other")
+	otherSource.Annotations[asyncSourceKey] = "other"
+	deleteIngress := func(name string) ktesting.DeleteActionImpl {
+		return ktesting.DeleteActionImpl{
+			ActionImpl: ktesting.ActionImpl{
+				Namespace: defaultNamespace,
+				Verb:      "delete",
+				Resource:  v1alpha1.SchemeGroupVersion.WithResource("ingresses"),
+			},
+			Name: name,
+		}
+	}
+
+	table := TableTest{{
+		Name: "ingress with the default suffix is deleted",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressNameTemplate: "async-{{.Name}}"}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			named("async-testing"),
+			service(defaultNamespace, testingName),
+		},
+		WantDeletes: []ktesting.DeleteActionImpl{
+			deleteIngress(testingName + newSuffix),
+		}}, {
+		Name: "ingresses generated for the source under other templates are deleted",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressNameTemplate: "v2-{{.Name}}"}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			named("v1-testing"),
+			named("v2-testing"),
+			otherSource,
+			service(defaultNamespace, testingName),
+		},
+		WantDeletes: []ktesting.DeleteActionImpl{
+			deleteIngress(testingName + newSuffix),
+			deleteIngress("v1-testing"),
+		}}, {
+		Name: "ingress with the default suffix generated before the source annotation is deleted",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressNameTemplate: "async-{{.Name}}"}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			legacy,
+			named("async-testing"),
+			service(defaultNamespace, testingName),
+		},
+		WantDeletes: []ktesting.DeleteActionImpl{
+			deleteIngress(testingName + newSuffix),
+		}}, {
+		Name: "ingress of another controller is kept",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressNameTemplate: "async-{{.Name}}"}),
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			foreign,
+			named("async-testing"),
+			service(defaultNamespace, testingName),
+		}}, {
+		Name: "ingress generated with owner references is deleted after they were disabled",
+		Key:  "default/testing",
+		Ctx:  withTestConfig(Config{IngressNameTemplate: "async-{{.Name}}", DisableOwnerReferences: true}),
+		Objects: []runtime.Object{
+			finalized,
+			owned,
+			named("async-testing"),
+			service(defaultNamespace, testingName),
+		},
+		WantDeletes: []ktesting.DeleteActionImpl{
+			deleteIngress(testingName + newSuffix),
+		}}, {
+		Name: "ingresses of other sources are kept",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			ingSometimesAsync,
+			createdIng,
+			otherSource,
+			service(defaultNamespace, testingName),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"strings"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/kmeta"
+)
+
+const (
+	// asyncProducerKServiceKey names a Knative Service as the producer, as name or
+	// namespace/name. The namespace defaults to the namespace of the ingress.
+	asyncProducerKServiceKey = "async.knative.dev/producer-ksvc"
+
+	// routeLabelKey labels the placeholder service Knative Serving creates for the route
+	// of a Knative Service, with the name of the route.
+	routeLabelKey = "serving.knative.dev/route"
+
+	// kserviceLabelKey labels the services of the revisions of a Knative Service with the
+	// name of the Knative Service, which is the name of its route.
+	kserviceLabelKey = "serving.knative.dev/service"
+
+	// serviceTypeLabelKey labels the services of a revision with their type. The public
+	// service of a revision has the endpoints of its pods, or of the activator while the
+	// revision is scaled to zero.
+	serviceTypeLabelKey = "networking.internal.knative.dev/serviceType"
+	publicServiceType   = "Public"
+	privateServiceType  = "Private"
+)
+
+// parseProducerKService returns the producer named by the producer-ksvc annotation value.
+func parseProducerKService(value, namespace string) (Producer, error) {
+	name := value
+	if i := strings.Index(value, "/"); i >= 0 {
+		namespace, name = value[:i], value[i+1:]
+		if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+			return Producer{}, fmt.Errorf("invalid namespace %q: %s", namespace, strings.Join(errs, "; "))
+		}
+	}
+	if errs := validation.IsDNS1035Label(name); len(errs) > 0 {
+		return Producer{}, fmt.Errorf("invalid name %q: %s", name, strings.Join(errs, "; "))
+	}
+	return Producer{Name: name, Namespace: namespace}, nil
+}
+
+// validateProducerKService validates the producer-ksvc annotation, which is exclusive
+// with the producer-service annotation.
+func validateProducerKService(annotations map[string]string) error {
+	value, ok := annotations[asyncProducerKServiceKey]
+	if !ok {
+		return nil
+	}
+	if _, ok := annotations[asyncProducerServiceKey]; ok {
+		return fmt.Errorf("Invalid value for key %s: %s is set as well", asyncProducerKServiceKey, asyncProducerServiceKey)
+	}
+	if _, err := parseProducerKService(value, ""); err != nil {
+		return fmt.Errorf("Invalid value for key %s: %w", asyncProducerKServiceKey, err)
+	}
+	return nil
+}
+
+// kserviceRouteError reports a Knative Service producer without route, the ingress is
+// marked as not configured until the route exists.
+type kserviceRouteError struct {
+	message string
+}
+
+func (e *kserviceRouteError) Error() string {
+	return e.message
+}
+
+// kserviceProducer returns the producer for the Knative Service named by the producer-ksvc
+// annotation. The route of a Knative Service has a placeholder service of the same name,
+// whose cluster local hostname is the domain of the route, so the generated ExternalName
+// service and the rewritten host both resolve to the route of the Knative Service. It
+// returns a kserviceRouteError if the placeholder service doesn't exist or isn't the
+// placeholder of a route.
+func (r *Reconciler) kserviceProducer(ing *v1alpha1.Ingress) (Producer, error) {
+	producer, err := parseProducerKService(ing.Annotations[asyncProducerKServiceKey], ing.Namespace)
+	if err != nil {
+		return Producer{}, err
+	}
+	placeholder, err := r.serviceLister.Services(producer.Namespace).Get(producer.Name)
+	if apierrs.IsNotFound(err) {
+		return Producer{}, &kserviceRouteError{fmt.Sprintf("The route of the Knative Service %s/%s has no service yet",
+			producer.Namespace, producer.Name)}
+	} else if err != nil {
+		return Producer{}, err
+	}
+	if placeholder.Labels[routeLabelKey] != producer.Name {
+		return Producer{}, &kserviceRouteError{fmt.Sprintf("The service %s/%s is not the route of a Knative Service",
+			producer.Namespace, producer.Name)}
+	}
+	return producer, nil
+}
+
+// kserviceProducerFilter returns a filter passing the ingresses whose producer-ksvc
+// annotation names the route, to reconcile them when the route changes.
+func kserviceProducerFilter(route metav1.Object) func(interface{}) bool {
+	return func(obj interface{}) bool {
+		ing, ok := obj.(*v1alpha1.Ingress)
+		if !ok {
+			return false
+		}
+		value, ok := ing.Annotations[asyncProducerKServiceKey]
+		if !ok {
+			return false
+		}
+		producer, err := parseProducerKService(value, ing.Namespace)
+		return err == nil && producer == Producer{Name: route.GetName(), Namespace: route.GetNamespace()}
+	}
+}
+
+// producerEndpointsNames returns the names of the endpoints of the producer. The route of
+// a Knative Service has a placeholder service without endpoints, its requests reach the
+// revisions, so the endpoints of the revision services of the given type are returned.
+func (r *Reconciler) producerEndpointsNames(p Producer, serviceType string) ([]string, error) {
+	service, err := r.serviceLister.Services(p.Namespace).Get(p.Name)
+	if apierrs.IsNotFound(err) {
+		return []string{p.Name}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	route, ok := service.Labels[routeLabelKey]
+	if !ok {
+		return []string{p.Name}, nil
+	}
+	revisions, err := r.serviceLister.Services(p.Namespace).List(labels.SelectorFromSet(labels.Set{
+		kserviceLabelKey:    route,
+		serviceTypeLabelKey: serviceType,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	names := sets.NewString()
+	for _, revision := range revisions {
+		names.Insert(revision.Name)
+	}
+	return names.List(), nil
+}
+
+// producerOfEndpoints returns the producer whose readiness depends on the endpoints: the
+// Knative Service of the endpoints of a revision, or the service of the endpoints.
+func producerOfEndpoints(obj interface{}) (Producer, bool) {
+	endpoints, err := kmeta.DeletionHandlingAccessor(obj)
+	if err != nil {
+		return Producer{}, false
+	}
+	if route, ok := endpoints.GetLabels()[kserviceLabelKey]; ok {
+		return Producer{Name: route, Namespace: endpoints.GetNamespace()}, true
+	}
+	return Producer{Name: endpoints.GetName(), Namespace: endpoints.GetNamespace()}, true
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	ktesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+
+	. "knative.dev/async-component/pkg/reconciler/testing"
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+func TestProducerKService(t *testing.T) {
+	route := func(namespace, name string, labels map[string]string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: labels},
+			Spec: corev1.ServiceSpec{
+				Type:         corev1.ServiceTypeExternalName,
+				ExternalName: "kourier-internal.kourier-system.svc.cluster.local",
+			},
+		}
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, svc := range []*corev1.Service{
+		route(defaultNamespace, "orders-producer", map[string]string{routeLabelKey: "orders-producer"}),
+		route("producers", "shared-producer", map[string]string{routeLabelKey: "shared-producer"}),
+		route(defaultNamespace, "plain-service", nil),
+	} {
+		if err := indexer.Add(svc); err != nil {
+			t.Fatalf("Error adding service %s: %v", svc.Name, err)
+		}
+	}
+	r := &Reconciler{serviceLister: corev1listers.NewServiceLister(indexer)}
+	tests := []struct {
+		name    string
+		value   string
+		want    Producer
+		wantErr bool
+	}{{
+		name:  "namespace of the ingress",
+		value: "orders-producer",
+		want:  Producer{Name: "orders-producer", Namespace: defaultNamespace},
+	}, {
+		name:  "other namespace",
+		value: "producers/shared-producer",
+		want:  Producer{Name: "shared-producer", Namespace: "producers"},
+	}, {
+		name:    "no route yet",
+		value:   "missing-producer",
+		wantErr: true,
+	}, {
+		name:    "not a route",
+		value:   "plain-service",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			source := ingSometimesAsync.DeepCopy()
+			source.Annotations[asyncProducerKServiceKey] = test.value
+			producer, err := r.resolveProducer(source)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("resolveProducer() = %v, want error", producer)
+				}
+				return
+			}
+			if err != nil || producer != test.want {
+				t.Fatalf("resolveProducer() = %v, %v, want %v", producer, err, test.want)
+			}
+
+			// The async paths rewrite the host to the domain of the route, which the
+			// generated service resolves to.
+			ing, svc, _ := makeChildren(source, ingressKourier, producer, &Config{})
+			host := test.want.Name + "." + test.want.Namespace + ".svc.cluster.local"
+			if svc.Spec.ExternalName != host {
+				t.Errorf("ExternalName = %q, want %q", svc.Spec.ExternalName, host)
+			}
+			for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+				if path.Splits[0].ServiceName == svc.Name && path.RewriteHost != host {
+					t.Errorf("RewriteHost = %q, want %q", path.RewriteHost, host)
+				}
+			}
+		})
+	}
+
+	// A missing route marks the ingress as not configured, and its creation reconciles
+	// the ingress again.
+	missing := ingSometimesAsync.DeepCopy()
+	missing.Annotations[asyncProducerKServiceKey] = "missing-producer"
+	notConfigured := missing.DeepCopy()
+	conditionsOf(notConfigured).markNotConfigured(producerRouteReason,
+		"The route of the Knative Service default/missing-producer has no service yet")
+	table := TableTest{{
+		Name: "route of the producer not found",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			missing,
+		},
+		WantStatusUpdates: []ktesting.UpdateActionImpl{{
+			Object: notConfigured,
+		}},
+	}}
+	table.Test(t, MakeFactory(newTestReconciler))
+	filter := kserviceProducerFilter(route(defaultNamespace, "missing-producer", nil))
+	if !filter(missing) {
+		t.Error("kserviceProducerFilter() = false, want true for the ingress of the route")
+	}
+	if filter(ingSometimesAsync) {
+		t.Error("kserviceProducerFilter() = true, want false for an ingress without producer-ksvc")
+	}
+
+	// The endpoints of Knative Services outside the namespace of the controller aren't
+	// watched, the ingresses don't wait for them.
+	waiting := &Reconciler{
+		serviceLister:   r.serviceLister,
+		endpointsLister: corev1listers.NewEndpointsLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		config:          Config{ProducerNotReadyMinDelay: time.Second},
+	}
+	shared := Producer{Name: "shared-producer", Namespace: "producers"}
+	if ready, err := waiting.waitForProducer(context.Background(), ingSometimesAsync.DeepCopy(), shared); err != nil || !ready {
+		t.Errorf("waitForProducer(%v) = %v, %v, want true", shared, ready, err)
+	}
+
+	for value, valid := range map[string]bool{
+		"orders-producer":           true,
+		"producers/shared-producer": true,
+		"Orders":                    false,
+		"producers/":                false,
+		"/orders-producer":          false,
+	} {
+		err := validateProducerKService(map[string]string{asyncProducerKServiceKey: value})
+		if valid != (err == nil) {
+			t.Errorf("validateProducerKService(%q) = %v, want valid %v", value, err, valid)
+		}
+	}
+	if err := validateProducerKService(map[string]string{
+		asyncProducerKServiceKey: "orders-producer",
+		asyncProducerServiceKey:  "team-producer",
+	}); err == nil {
+		t.Error("validateProducerKService() = nil, want error with the producer-service annotation")
+	}
+}
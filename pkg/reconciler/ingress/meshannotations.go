@@ -0,0 +1,93 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"knative.dev/pkg/kmeta"
+)
+
+// managedAnnotationsKey lists the keys of the configured annotations set on a generated
+// object, so they are removed once they are no longer configured.
+const managedAnnotationsKey = "async.knative.dev/managed-annotations"
+
+// ClassAnnotations holds the annotations set on the generated objects per ingress class.
+type ClassAnnotations map[string]map[string]string
+
+// Decode implements envconfig.Decoder, the value is a JSON object keyed by ingress class.
+func (a *ClassAnnotations) Decode(value string) error {
+	return json.Unmarshal([]byte(value), a)
+}
+
+// validate returns an error if an annotation key is not a qualified name.
+func (a ClassAnnotations) validate() error {
+	for class, annotations := range a {
+		for key := range annotations {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return fmt.Errorf("invalid mesh annotation %q for ingress class %q: %s", key, class, strings.Join(errs, "; "))
+			}
+		}
+	}
+	return nil
+}
+
+// ServiceAnnotations holds the annotations set on the generated services of all ingress
+// classes, e.g. for topology hints or load balancer settings.
+type ServiceAnnotations map[string]string
+
+// Decode implements envconfig.Decoder, the value is a JSON object.
+func (a *ServiceAnnotations) Decode(value string) error {
+	return json.Unmarshal([]byte(value), a)
+}
+
+// validate returns an error if an annotation key is not a qualified name.
+func (a ServiceAnnotations) validate() error {
+	for key := range a {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid service annotation %q: %s", key, strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
+// withManagedKeys returns the configured annotations and the list of their keys, nil
+// without configured annotations.
+func withManagedKeys(configured map[string]string) map[string]string {
+	if len(configured) == 0 {
+		return nil
+	}
+	return kmeta.UnionMaps(configured, map[string]string{
+		managedAnnotationsKey: strings.Join(sets.StringKeySet(configured).List(), ","),
+	})
+}
+
+// mergeAnnotations returns the existing annotations updated with the desired ones. The
+// configured annotations listed on the existing object that aren't desired anymore are
+// removed, the annotations set by others are kept.
+func mergeAnnotations(existing, desired map[string]string) map[string]string {
+	merged := kmeta.UnionMaps(existing, desired)
+	if managed, ok := existing[managedAnnotationsKey]; ok {
+		for _, key := range append(strings.Split(managed, ","), managedAnnotationsKey) {
+			if _, ok := desired[key]; !ok {
+				delete(merged, key)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+const (
+	// asyncReadProducerKey routes the async GET and HEAD requests to another producer
+	// service next to the default producer, e.g. a read-optimized one.
+	asyncReadProducerKey = "async.knative.dev/read-producer"
+
+	// asyncWriteProducerKey routes the other async requests, the mutating ones, to
+	// another producer service next to the default producer.
+	asyncWriteProducerKey = "async.knative.dev/write-producer"
+)
+
+// readMethods are the methods routed to the read producer, in the order of their paths.
+var readMethods = []string{http.MethodGet, http.MethodHead}
+
+// methodProducer returns the producer named by the annotation. The producers get services
+// like the producers of the prefer-producers annotation.
+func methodProducer(annotations map[string]string, key string) (preferProducer, bool) {
+	service, ok := annotations[key]
+	return preferProducer{service: service}, ok
+}
+
+// validateMethodProducers returns an error if the read or write producer isn't a valid
+// service name.
+func validateMethodProducers(annotations map[string]string) error {
+	for _, key := range []string{asyncReadProducerKey, asyncWriteProducerKey} {
+		if name, ok := annotations[key]; ok {
+			if errs := validation.IsDNS1035Label(name); len(errs) > 0 {
+				return fmt.Errorf("Invalid value for key %s: %s", key, strings.Join(errs, "; "))
+			}
+		}
+	}
+	return nil
+}
+
+// methodProducers returns the producers the async requests of the ingress are routed to
+// by their method: the read and write producers, and the resolved producer unless both
+// of them are set.
+func methodProducers(ingress *v1alpha1.Ingress, producer Producer) []Producer {
+	read, hasRead := methodProducer(ingress.Annotations, asyncReadProducerKey)
+	write, hasWrite := methodProducer(ingress.Annotations, asyncWriteProducerKey)
+	var producers []Producer
+	if !hasRead || !hasWrite {
+		producers = append(producers, producer)
+	}
+	if hasRead {
+		producers = append(producers, read.producer())
+	}
+	if hasWrite && (!hasRead || write.service != read.service) {
+		producers = append(producers, write.producer())
+	}
+	return producers
+}
+
+// withMethodProducers returns the paths with the paths routed to the producer service split
+// by method when the ingress has a read or write producer: GET and HEAD requests are routed
+// to the read producer, all others to the write producer, each defaulting to the producer.
+// Paths already matching a method are routed to the producer of their method. The method
+// is matched with the :method pseudo-header, which requires an Envoy based data plane.
+func withMethodProducers(paths []v1alpha1.HTTPIngressPath, producerService string, ingress *v1alpha1.Ingress) []v1alpha1.HTTPIngressPath {
+	read, hasRead := methodProducer(ingress.Annotations, asyncReadProducerKey)
+	write, hasWrite := methodProducer(ingress.Annotations, asyncWriteProducerKey)
+	if !hasRead && !hasWrite {
+		return paths
+	}
+	routeTo := func(path v1alpha1.HTTPIngressPath, p preferProducer, ok bool) v1alpha1.HTTPIngressPath {
+		routed := *path.DeepCopy()
+		if !ok {
+			return routed
+		}
+		for i := range routed.Splits {
+			if routed.Splits[i].ServiceName == producerService {
+				routed.Splits[i].ServiceName = p.serviceName(ingress.Name)
+			}
+		}
+		if routed.RewriteHost != "" {
+			routed.RewriteHost = p.producer().Hostname()
+		}
+		return routed
+	}
+	split := make([]v1alpha1.HTTPIngressPath, 0, len(paths))
+	for _, path := range paths {
+		if !pathRoutesTo(path, producerService) {
+			split = append(split, path)
+			continue
+		}
+		if method, ok := path.Headers[methodHeaderField]; ok {
+			if sets.NewString(readMethods...).Has(method.Exact) {
+				split = append(split, routeTo(path, read, hasRead))
+			} else {
+				split = append(split, routeTo(path, write, hasWrite))
+			}
+			continue
+		}
+		for _, method := range readMethods {
+			readPath := routeTo(path, read, hasRead)
+			readPath.Headers = unionHeaderMatches(path.Headers,
+				map[string]v1alpha1.HeaderMatch{methodHeaderField: {Exact: method}})
+			split = append(split, readPath)
+		}
+		split = append(split, routeTo(path, write, hasWrite))
+	}
+	return split
+}
+
+// pathRoutesTo returns true if a split of the path routes to the service.
+func pathRoutesTo(path v1alpha1.HTTPIngressPath, service string) bool {
+	for _, split := range path.Splits {
+		if split.ServiceName == service {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/network"
+
+	. "knative.dev/async-component/pkg/reconciler/testing"
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+func TestMethodProducers(t *testing.T) {
+	withProducers := func(annotations map[string]string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		for k, v := range annotations {
+			ing.Annotations[k] = v
+		}
+		return ing
+	}
+	methodPath := func(method, producer string) v1alpha1.HTTPIngressPath {
+		path := *conditionalAsyncPaths[0].DeepCopy()
+		if method != "" {
+			path.Headers[methodHeaderField] = v1alpha1.HeaderMatch{Exact: method}
+		}
+		if producer != "" {
+			path.Splits[0].ServiceName = testingName + asyncSuffix + "-" + producer
+			path.RewriteHost = network.GetServiceHostname(producer, knativeTesting)
+		}
+		return path
+	}
+	producerService := func(producer string) *corev1.Service {
+		svc := service(defaultNamespace, testingName)
+		svc.Name = testingName + asyncSuffix + "-" + producer
+		svc.Labels = map[string]string{preferProducerIngressLabelKey: testingName}
+		svc.Spec.ExternalName = network.GetServiceHostname(producer, knativeTesting)
+		return withServiceSpecHash(svc)
+	}
+
+	table := TableTest{{
+		Name: "reads and writes route to two producers",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withProducers(map[string]string{asyncReadProducerKey: "reader", asyncWriteProducerKey: "writer"}),
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, []v1alpha1.HTTPIngressPath{
+				methodPath(http.MethodGet, "reader"),
+				methodPath(http.MethodHead, "reader"),
+				methodPath("", "writer"),
+				conditionalAsyncPaths[1],
+			}),
+			producerService("reader"),
+			producerService("writer"),
+		}}, {
+		Name: "writes route to the default producer without a write producer",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withProducers(map[string]string{asyncReadProducerKey: "reader"}),
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, []v1alpha1.HTTPIngressPath{
+				methodPath(http.MethodGet, "reader"),
+				methodPath(http.MethodHead, "reader"),
+				methodPath("", ""),
+				conditionalAsyncPaths[1],
+			}),
+			service(defaultNamespace, testingName),
+			producerService("reader"),
+		}}, {
+		Name: "one service for the same read and write producer",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withProducers(map[string]string{asyncReadProducerKey: "rw", asyncWriteProducerKey: "rw"}),
+		},
+		WantCreates: []runtime.Object{
+			ingressWithPaths(defaultNamespace, testingName, statusUnknown, []v1alpha1.HTTPIngressPath{
+				methodPath(http.MethodGet, "rw"),
+				methodPath(http.MethodHead, "rw"),
+				methodPath("", "rw"),
+				conditionalAsyncPaths[1],
+			}),
+			producerService("rw"),
+		}}, {
+		Name: "invalid write producer",
+		Key:  "default/testing",
+		Objects: []runtime.Object{
+			withProducers(map[string]string{asyncWriteProducerKey: "Writer"}),
+		},
+		WantErr: true,
+		WantEvents: []string{
+			Eventf(corev1.EventTypeWarning, "InternalError", "Invalid value for key %s: %s", asyncWriteProducerKey,
+				"a DNS-1035 label must consist of lower case alphanumeric characters or '-', start with an alphabetic character, and end with an alphanumeric character (e.g. 'my-name',  or 'abc-123', regex used for validation is '[a-z]([-a-z0-9]*[a-z0-9])?')"),
+		}},
+	}
+	table.Test(t, MakeFactory(newTestReconciler))
+}
+
+func TestMethodProducersWithMethodRoutes(t *testing.T) {
+	source := ingSometimesAsync.DeepCopy()
+	source.Annotations[asyncRoutesKey] = "GET /orders,POST /orders"
+	source.Annotations[asyncReadProducerKey] = "reader"
+	source.Annotations[asyncWriteProducerKey] = "writer"
+
+	ing := makeNewIngress(source, ingressKourier, defaultProducer(), &Config{})
+	got := map[string]string{}
+	for _, path := range ing.Spec.Rules[0].HTTP.Paths {
+		if path.Path == "/orders" {
+			got[path.Headers[methodHeaderField].Exact] = path.Splits[0].ServiceName
+		}
+	}
+	want := map[string]string{
+		http.MethodGet:  testingName + asyncSuffix + "-reader",
+		http.MethodPost: testingName + asyncSuffix + "-writer",
+	}
+	if len(got) != len(want) || got[http.MethodGet] != want[http.MethodGet] || got[http.MethodPost] != want[http.MethodPost] {
+		t.Errorf("method routes = %v, want %v", got, want)
+	}
+}
+
+func TestWaitForMethodProducers(t *testing.T) {
+	withProducers := func(annotations map[string]string) *v1alpha1.Ingress {
+		ing := ingSometimesAsync.DeepCopy()
+		for k, v := range annotations {
+			ing.Annotations[k] = v
+		}
+		return ing
+	}
+	ready := func(name string) *corev1.Endpoints {
+		return &corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: knativeTesting},
+			Subsets: []corev1.EndpointSubset{{
+				Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+			}},
+		}
+	}
+	endpoints := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, e := range []*corev1.Endpoints{ready(producerServiceName), ready("write-producer")} {
+		endpoints.Add(e)
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []Producer
+		wantMessage string
+	}{{
+		name: "producer only",
+		want: []Producer{defaultProducer()},
+	}, {
+		name:        "read producer without ready endpoints",
+		annotations: map[string]string{asyncReadProducerKey: "read-producer"},
+		want:        []Producer{defaultProducer(), {Name: "read-producer", Namespace: knativeTesting}},
+		wantMessage: "Waiting for the producer read-producer.knative-testing.svc.cluster.local to have ready endpoints",
+	}, {
+		name:        "write producer with ready endpoints",
+		annotations: map[string]string{asyncWriteProducerKey: "write-producer"},
+		want:        []Producer{defaultProducer(), {Name: "write-producer", Namespace: knativeTesting}},
+	}, {
+		name:        "read and write producers replace the producer",
+		annotations: map[string]string{asyncReadProducerKey: "write-producer", asyncWriteProducerKey: "write-producer"},
+		want:        []Producer{{Name: "write-producer", Namespace: knativeTesting}},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ing := withProducers(test.annotations)
+			if got := methodProducers(ing, defaultProducer()); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("methodProducers() = %v, want %v", got, test.want)
+			}
+			r := &Reconciler{
+				serviceLister:   corev1listers.NewServiceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+				endpointsLister: corev1listers.NewEndpointsLister(endpoints),
+				config:          Config{ProducerNotReadyMinDelay: time.Second},
+			}
+			got, err := r.waitForProducer(context.Background(), ing, defaultProducer())
+			if err != nil {
+				t.Fatalf("waitForProducer() = %v", err)
+			}
+			if want := test.wantMessage == ""; got != want {
+				t.Errorf("waitForProducer() = %v, want %v", got, want)
+			}
+			if test.wantMessage == "" {
+				return
+			}
+			if cond := ing.Status.GetCondition(v1alpha1.IngressConditionLoadBalancerReady); cond == nil || cond.Message != test.wantMessage {
+				t.Errorf("LoadBalancerReady = %+v, want message %q", cond, test.wantMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+// methodHeaderField is the pseudo-header carrying the request method. Matching it
+// requires an Envoy based data plane such as Kourier.
+const methodHeaderField = ":method"
+
+var routeMethods = sets.NewString(http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions)
+
+// methodRoute is a request method and path prefix whose requests are always asynchronous.
+type methodRoute struct {
+	method string
+	prefix string
+}
+
+// parseMethodRoutes parses the value of the async-routes annotation, a comma separated
+// list of "METHOD /prefix" pairs, e.g. "POST /orders,PUT /orders". The routes are sorted
+// by descending prefix length.
+func parseMethodRoutes(value string) ([]methodRoute, error) {
+	var routes []methodRoute
+	if strings.TrimSpace(value) == "" {
+		return routes, nil
+	}
+	seen := sets.NewString()
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.Fields(entry)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected METHOD /prefix, got %q", entry)
+		}
+		route := methodRoute{method: parts[0], prefix: parts[1]}
+		if !routeMethods.Has(route.method) {
+			return nil, fmt.Errorf("unsupported method %q: must be one of %s", route.method, strings.Join(routeMethods.List(), ", "))
+		}
+		if !strings.HasPrefix(route.prefix, "/") {
+			return nil, fmt.Errorf("path prefix %q must start with /", route.prefix)
+		}
+		key := route.method + " " + route.prefix
+		if seen.Has(key) {
+			return nil, fmt.Errorf("duplicate route %s", key)
+		}
+		seen.Insert(key)
+		routes = append(routes, route)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	return routes, nil
+}
+
+// makeMethodPaths returns the producer paths for the routes overlapping the path. They
+// must precede the paths generated for the mode of the path.
+func makeMethodPaths(path, producer v1alpha1.HTTPIngressPath, routes []methodRoute) []v1alpha1.HTTPIngressPath {
+	var paths []v1alpha1.HTTPIngressPath
+	for _, route := range routes {
+		async := routeToProducer(path, producer)
+		switch {
+		case strings.HasPrefix(route.prefix, path.Path):
+			// The route is narrower than the path, or the path matches all requests.
+			async.Path = route.prefix
+		case strings.HasPrefix(path.Path, route.prefix):
+			// The path is narrower than the route.
+		default:
+			continue
+		}
+		async.Headers = unionHeaderMatches(path.Headers,
+			map[string]v1alpha1.HeaderMatch{methodHeaderField: {Exact: route.method}})
+		paths = append(paths, async)
+	}
+	return paths
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"reflect"
+	"testing"
+
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+)
+
+func TestParseMethodRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []methodRoute
+		wantErr bool
+	}{{
+		name:  "empty",
+		value: "",
+	}, {
+		name:  "sorted by prefix length",
+		value: "POST /orders, PUT /orders/items,DELETE /",
+		want: []methodRoute{
+			{method: "PUT", prefix: "/orders/items"},
+			{method: "POST", prefix: "/orders"},
+			{method: "DELETE", prefix: "/"},
+		},
+	}, {
+		name:    "missing prefix",
+		value:   "POST",
+		wantErr: true,
+	}, {
+		name:    "lower case method",
+		value:   "post /orders",
+		wantErr: true,
+	}, {
+		name:    "relative prefix",
+		value:   "POST orders",
+		wantErr: true,
+	}, {
+		name:    "duplicate route",
+		value:   "POST /orders,POST /orders",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseMethodRoutes(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseMethodRoutes() = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseMethodRoutes() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMakeMethodPaths(t *testing.T) {
+	producer := v1alpha1.HTTPIngressPath{
+		Splits:      []v1alpha1.IngressBackendSplit{{Percent: 100}},
+		RewriteHost: "producer",
+	}
+	routes, err := parseMethodRoutes("POST /orders,PUT /orders/items")
+	if err != nil {
+		t.Fatalf("parseMethodRoutes() = %v", err)
+	}
+	asyncPath := func(path, method string) v1alpha1.HTTPIngressPath {
+		return v1alpha1.HTTPIngressPath{
+			Path:        path,
+			Headers:     map[string]v1alpha1.HeaderMatch{methodHeaderField: {Exact: method}},
+			Splits:      producer.Splits,
+			RewriteHost: producer.RewriteHost,
+		}
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want []v1alpha1.HTTPIngressPath
+	}{{
+		name: "catch all path",
+		path: "",
+		want: []v1alpha1.HTTPIngressPath{asyncPath("/orders/items", "PUT"), asyncPath("/orders", "POST")},
+	}, {
+		name: "path between the routes",
+		path: "/orders/",
+		want: []v1alpha1.HTTPIngressPath{asyncPath("/orders/items", "PUT"), asyncPath("/orders/", "POST")},
+	}, {
+		name: "path narrower than the routes",
+		path: "/orders/items/42",
+		want: []v1alpha1.HTTPIngressPath{asyncPath("/orders/items/42", "PUT"), asyncPath("/orders/items/42", "POST")},
+	}, {
+		name: "unrelated path",
+		path: "/search",
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := makeMethodPaths(v1alpha1.HTTPIngressPath{Path: test.path}, producer, routes)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("makeMethodPaths() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
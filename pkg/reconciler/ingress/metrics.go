@@ -0,0 +1,178 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"knative.dev/pkg/metrics"
+)
+
+// The workqueue metrics (workqueue_depth, workqueue_adds_total, workqueue_retries_total, ...)
+// and the generic reconcile_count and reconcile_latency metrics are registered by
+// knative.dev/pkg/controller. The metrics below only cover the async reconciler.
+var (
+	ingressReconcileLatencyStat = stats.Float64(
+		"ingress_reconcile_latency",
+		"Latency of generating the async ingress and service for an ingress",
+		stats.UnitMilliseconds)
+
+	// reconcileDistribution matches the buckets of the knative reconcile_latency metric.
+	reconcileDistribution = view.Distribution(10, 100, 1000, 10000, 30000, 60000)
+
+	// ingressClassTagKey and asyncModeTagKey break the metrics down by the class of the
+	// generated ingress and the async mode of the source ingress. Their values are bounded,
+	// see classTagValue and modeTagValue.
+	ingressClassTagKey = tag.MustNewKey("ingress_class")
+	asyncModeTagKey    = tag.MustNewKey("async_mode")
+
+	// metricLabelsTagKey tags the metrics with the labels of the metric-labels annotation
+	// of the source ingress, as a sorted list of key=value pairs. The views need fixed tag
+	// keys, so the labels share one tag; their number and length bound the cardinality.
+	metricLabelsTagKey = tag.MustNewKey("metric_labels")
+
+	metricLabelKeyPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+const (
+	// asyncMetricLabelsKey sets the labels of the metrics of an ingress, e.g. "team=payments,app=checkout".
+	asyncMetricLabelsKey = "async.knative.dev/metric-labels"
+
+	// The limits keep the tag value within the 255 characters OpenCensus allows.
+	maxMetricLabels           = 3
+	maxMetricLabelKeyLength   = 32
+	maxMetricLabelValueLength = 48
+)
+
+// unknownTagValue tags reconciles failing before the class or mode is known, otherTagValue
+// the classes without known load balancers and the invalid modes.
+const (
+	unknownTagValue = "unknown"
+	otherTagValue   = "other"
+)
+
+func init() {
+	if err := view.Register(&view.View{
+		Description: ingressReconcileLatencyStat.Description(),
+		Measure:     ingressReconcileLatencyStat,
+		Aggregation: reconcileDistribution,
+		TagKeys:     []tag.Key{ingressClassTagKey, asyncModeTagKey, metricLabelsTagKey},
+	}, &view.View{
+		Name:        "ingress_reconcile_count",
+		Description: "Number of reconciles of ingresses",
+		Measure:     ingressReconcileLatencyStat,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{ingressClassTagKey, asyncModeTagKey, metricLabelsTagKey},
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// reportReconcileLatency records the time passed since start as the reconcile latency of
+// an ingress of the given class and mode, either may be empty if it is not known, and with
+// the value of its metric-labels annotation.
+func reportReconcileLatency(ctx context.Context, start time.Time, ingressClass, mode, labels string) {
+	elapsed := float64(time.Since(start)) / float64(time.Millisecond)
+	ctx, err := tag.New(ctx,
+		tag.Upsert(ingressClassTagKey, classTagValue(ingressClass)),
+		tag.Upsert(asyncModeTagKey, modeTagValue(mode)),
+		tag.Upsert(metricLabelsTagKey, labelsTagValue(labels)))
+	if err != nil {
+		return
+	}
+	metrics.Record(ctx, ingressReconcileLatencyStat.M(elapsed))
+}
+
+// classTagValue returns the short name of a class with known load balancers, such as
+// "istio" or "kourier".
+func classTagValue(ingressClass string) string {
+	if ingressClass == "" {
+		return unknownTagValue
+	}
+	if !knownLoadBalancer(ingressClass) {
+		return otherTagValue
+	}
+	return strings.Split(ingressClass, ".")[0]
+}
+
+// modeTagValue returns the short name of the mode, such as "always" or "conditional".
+func modeTagValue(mode string) string {
+	switch mode {
+	case "":
+		return unknownTagValue
+	case asyncAlwaysMode, asyncConditionalMode, asyncHeaderMode:
+		return strings.Split(mode, ".")[0]
+	default:
+		return otherTagValue
+	}
+}
+
+// parseMetricLabels parses the value of the metric-labels annotation, a comma separated
+// list of at most maxMetricLabels "key=value" pairs. The keys are metric label names of
+// at most maxMetricLabelKeyLength characters, the values valid Kubernetes label values of
+// at most maxMetricLabelValueLength characters.
+// The labels are returned sorted by key.
+func parseMetricLabels(value string) ([]string, error) {
+	var labels []string
+	if strings.TrimSpace(value) == "" {
+		return labels, nil
+	}
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", entry)
+		}
+		key, labelValue := parts[0], parts[1]
+		if len(key) > maxMetricLabelKeyLength || !metricLabelKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid label key %q: must match %s and have at most %d characters",
+				key, metricLabelKeyPattern, maxMetricLabelKeyLength)
+		}
+		if len(labelValue) > maxMetricLabelValueLength {
+			return nil, fmt.Errorf("value of label %s has more than %d characters", key, maxMetricLabelValueLength)
+		}
+		if errs := validation.IsValidLabelValue(labelValue); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid value %q for label %s: %s", labelValue, key, strings.Join(errs, "; "))
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate label %s", key)
+		}
+		seen[key] = true
+		labels = append(labels, key+"="+labelValue)
+	}
+	if len(labels) > maxMetricLabels {
+		return nil, fmt.Errorf("%d labels, at most %d are allowed", len(labels), maxMetricLabels)
+	}
+	sort.Strings(labels)
+	return labels, nil
+}
+
+// labelsTagValue returns the sorted labels of the metric-labels annotation value, or
+// otherTagValue if the value is invalid.
+func labelsTagValue(value string) string {
+	labels, err := parseMetricLabels(value)
+	if err != nil {
+		return otherTagValue
+	}
+	return strings.Join(labels, ",")
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"knative.dev/pkg/metrics"
+)
+
+func TestReportReconcileLatency(t *testing.T) {
+	metrics.InitForTesting()
+	before := reconcileLatencyCount(t)
+	reportReconcileLatency(context.Background(), time.Now().Add(-50*time.Millisecond), "", "", "")
+	if got, want := reconcileLatencyCount(t), before+1; got != want {
+		t.Errorf("ingress_reconcile_latency count = %d, want %d", got, want)
+	}
+}
+
+func reconcileLatencyCount(t *testing.T) int64 {
+	t.Helper()
+	rows, err := view.RetrieveData(ingressReconcileLatencyStat.Name())
+	if err != nil {
+		t.Fatalf("RetrieveData() = %v", err)
+	}
+	var count int64
+	for _, row := range rows {
+		count += row.Data.(*view.DistributionData).Count
+	}
+	return count
+}
+
+func TestReconcileMetricTags(t *testing.T) {
+	metrics.InitForTesting()
+	reportReconcileLatency(context.Background(), time.Now(), ingressIstio, asyncConditionalMode, "")
+	reportReconcileLatency(context.Background(), time.Now(), ingressKourier, asyncAlwaysMode, "")
+	reportReconcileLatency(context.Background(), time.Now(), "contour.ingress.networking.knative.dev", "sometimes", "")
+	reportReconcileLatency(context.Background(), time.Now(), "", "", "")
+
+	rows, err := view.RetrieveData("ingress_reconcile_count")
+	if err != nil {
+		t.Fatalf("RetrieveData() = %v", err)
+	}
+	got := make(map[string]int64)
+	for _, row := range rows {
+		tags := make(map[tag.Key]string)
+		for _, rowTag := range row.Tags {
+			tags[rowTag.Key] = rowTag.Value
+		}
+		got[tags[ingressClassTagKey]+"/"+tags[asyncModeTagKey]] += row.Data.(*view.CountData).Value
+	}
+	for _, key := range []string{"istio/conditional", "kourier/always", "other/other", "unknown/unknown"} {
+		if got[key] == 0 {
+			t.Errorf("ingress_reconcile_count has no row tagged %s, got %v", key, got)
+		}
+	}
+}
+
+func TestParseMetricLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{{
+		name: "no labels",
+	}, {
+		name:  "sorted labels",
+		value: "team=payments, app=checkout",
+		want:  "app=checkout,team=payments",
+	}, {
+		name:  "as many labels as allowed",
+		value: "a=1,b=2,c=3",
+		want:  "a=1,b=2,c=3",
+	}, {
+		name:    "too many labels",
+		value:   "a=1,b=2,c=3,d=4",
+		wantErr: true,
+	}, {
+		name:    "key too long",
+		value:   strings.Repeat("k", maxMetricLabelKeyLength+1) + "=v",
+		wantErr: true,
+	}, {
+		name:    "value too long",
+		value:   "team=" + strings.Repeat("v", maxMetricLabelValueLength+1),
+		wantErr: true,
+	}, {
+		name:    "invalid key",
+		value:   "team-name=payments",
+		wantErr: true,
+	}, {
+		name:    "invalid value",
+		value:   "team=pay ments",
+		wantErr: true,
+	}, {
+		name:    "duplicate key",
+		value:   "team=a,team=b",
+		wantErr: true,
+	}, {
+		name:    "missing value",
+		value:   "team",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			labels, err := parseMetricLabels(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseMetricLabels(%q) = %v, wantErr %v", test.value, err, test.wantErr)
+			}
+			if got := strings.Join(labels, ","); got != test.want {
+				t.Errorf("parseMetricLabels(%q) = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+
+	longest := strings.Repeat("k", maxMetricLabelKeyLength) + "=" + strings.Repeat("v", maxMetricLabelValueLength)
+	value := labelsTagValue(strings.Join([]string{longest, "a" + longest[1:], "b" + longest[1:]}, ","))
+	if value == otherTagValue {
+		t.Fatal("labelsTagValue() rejected the longest valid labels")
+	}
+	if _, err := tag.New(context.Background(), tag.Upsert(metricLabelsTagKey, value)); err != nil {
+		t.Errorf("the longest labels are no valid tag value: %v", err)
+	}
+}
+
+func TestReconcileMetricLabels(t *testing.T) {
+	metrics.InitForTesting()
+	reportReconcileLatency(context.Background(), time.Now(), ingressKourier, asyncAlwaysMode, "team=payments,app=checkout")
+	reportReconcileLatency(context.Background(), time.Now(), ingressKourier, asyncAlwaysMode, "a=1,b=2,c=3,d=4")
+
+	rows, err := view.RetrieveData("ingress_reconcile_count")
+	if err != nil {
+		t.Fatalf("RetrieveData() = %v", err)
+	}
+	got := make(map[string]int64)
+	for _, row := range rows {
+		for _, rowTag := range row.Tags {
+			if rowTag.Key == metricLabelsTagKey {
+				got[rowTag.Value] += row.Data.(*view.CountData).Value
+			}
+		}
+	}
+	for _, value := range []string{"app=checkout,team=payments", otherTagValue} {
+		if got[value] == 0 {
+			t.Errorf("ingress_reconcile_count has no row with metric labels %q, got %v", value, got)
+		}
+	}
+}
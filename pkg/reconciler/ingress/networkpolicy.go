@@ -0,0 +1,178 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/kmeta"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/system"
+)
+
+// namespaceNameLabelKey is set on every namespace by Kubernetes 1.21 and later.
+const namespaceNameLabelKey = "kubernetes.io/metadata.name"
+
+// gatewayNamespace returns the namespace of the gateway of the ingress class.
+func gatewayNamespace(ingressClass string) string {
+	lb, ok := loadBalancers[strings.Split(ingressClass, ".")[0]]
+	if !ok {
+		lb = loadBalancers["kourier"]
+	}
+	// The domains have the form name.namespace.svc.cluster.local.
+	return strings.Split(lb.Public, ".")[1]
+}
+
+// gatewayNamespaces returns the namespaces of the gateways of all ingress classes managed
+// by the controller, sorted.
+func (c *Config) gatewayNamespaces() []string {
+	namespaces := sets.NewString(gatewayNamespace(c.defaultIngressClass()))
+	for _, ingressClass := range c.IngressClasses {
+		namespaces.Insert(gatewayNamespace(ingressClass))
+	}
+	return namespaces.List()
+}
+
+// producerPodSelector returns the labels selecting the pods of the producer service, false
+// if they are unknown. The pods of a Knative Service are labeled with its name, the pods of
+// the default producer with the producer selector, and the pods of other producers are
+// selected by their service.
+func producerPodSelector(producer *corev1.Service, cfg *Config) (map[string]string, bool) {
+	if route, ok := producer.Labels[routeLabelKey]; ok {
+		return map[string]string{kserviceLabelKey: route}, true
+	}
+	if producer.Name == producerServiceName && producer.Namespace == system.Namespace() {
+		selectorKey, selectorValue := cfg.producerSelector()
+		return map[string]string{selectorKey: selectorValue}, true
+	}
+	// An empty pod selector would select all pods of the namespace.
+	return producer.Spec.Selector, len(producer.Spec.Selector) > 0
+}
+
+// MakeProducerNetworkPolicy constructs the NetworkPolicy allowing the gateways of the
+// managed ingress classes to reach the pods of the producer. The policy of a producer is
+// shared by all ingresses and owned by the producer service, as owner references can't
+// cross namespaces. The pods of a Knative Service are reached through the activator
+// too while they scale from zero, it runs in the namespace of Knative Serving.
+func MakeProducerNetworkPolicy(producer *corev1.Service, podSelector map[string]string, cfg *Config) *networkingv1.NetworkPolicy {
+	namespaces := sets.NewString(cfg.gatewayNamespaces()...)
+	if _, ok := producer.Labels[routeLabelKey]; ok {
+		namespaces.Insert(system.Namespace())
+	}
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      kmeta.ChildName(producer.Name, "-gateway"),
+			Namespace: producer.Namespace,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(producer, corev1.SchemeGroupVersion.WithKind("Service")),
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: podSelector,
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			// All ports are allowed, the requests may reach the pods through a sidecar.
+			Ingress: []networkingv1.NetworkPolicyIngressRule{{
+				From: []networkingv1.NetworkPolicyPeer{{
+					NamespaceSelector: &metav1.LabelSelector{
+						MatchExpressions: []metav1.LabelSelectorRequirement{{
+							Key:      namespaceNameLabelKey,
+							Operator: metav1.LabelSelectorOpIn,
+							Values:   namespaces.List(),
+						}},
+					},
+				}},
+			}},
+		},
+	}
+}
+
+// policyProducers returns the producers reached by the async requests of the ingress: the
+// producers routed to by method, and the producers of its prefer-producers annotation.
+func policyProducers(ing *v1alpha1.Ingress, producer Producer) []Producer {
+	producers := methodProducers(ing, producer)
+	seen := make(map[Producer]bool, len(producers))
+	for _, p := range producers {
+		seen[p] = true
+	}
+	// The annotation was validated before, or the ingress is exempt from validation and
+	// an invalid value is ignored.
+	others, _ := parsePreferProducers(ing.Annotations[asyncPreferProducersKey])
+	for _, other := range others {
+		if p := other.producer(); !seen[p] {
+			seen[p] = true
+			producers = append(producers, p)
+		}
+	}
+	return producers
+}
+
+// reconcileNetworkPolicy creates or updates the NetworkPolicies of the producers of the
+// ingress if enabled.
+func (r *Reconciler) reconcileNetworkPolicy(ctx context.Context, ing *v1alpha1.Ingress, producer Producer) error {
+	if !r.config.ProducerNetworkPolicy {
+		return nil
+	}
+	for _, p := range policyProducers(ing, producer) {
+		if err := r.reconcileProducerNetworkPolicy(ctx, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Reconciler) reconcileProducerNetworkPolicy(ctx context.Context, p Producer) error {
+	producer, err := r.serviceLister.Services(p.Namespace).Get(p.Name)
+	if apierrs.IsNotFound(err) {
+		return fmt.Errorf("producer service %s/%s does not exist", p.Namespace, p.Name)
+	} else if err != nil {
+		return err
+	}
+	podSelector, ok := producerPodSelector(producer, &r.config)
+	if !ok {
+		logging.FromContext(ctx).Warnf("Not generating a NetworkPolicy for the producer %s/%s, its service selects no pods",
+			p.Namespace, p.Name)
+		return nil
+	}
+	desired := MakeProducerNetworkPolicy(producer, podSelector, &r.config)
+	policies := r.kubeclient.NetworkingV1().NetworkPolicies(desired.Namespace)
+	policy, err := r.policyLister.NetworkPolicies(desired.Namespace).Get(desired.Name)
+	if apierrs.IsNotFound(err) {
+		if _, err := policies.Create(ctx, desired, r.config.createOptions()); err != nil {
+			return fmt.Errorf("failed to create NetworkPolicy: %w", err)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !equality.Semantic.DeepEqual(policy.Spec, desired.Spec) {
+		// Don't modify the informers copy
+		update := policy.DeepCopy()
+		update.Spec = desired.Spec
+		if _, err := policies.Update(ctx, update, r.config.updateOptions()); err != nil {
+			return fmt.Errorf("failed to update NetworkPolicy: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"strings"
+)
+
+// pathModes maps path prefixes to the async mode of the paths starting with them.
+type pathModes map[string]string
+
+// parsePathModes parses the value of the path-modes annotation, a comma separated
+// list of prefix=mode pairs, e.g. "/orders=always.async.knative.dev,/health=never.async.knative.dev".
+func parsePathModes(value string) (pathModes, error) {
+	modes := pathModes{}
+	if strings.TrimSpace(value) == "" {
+		return modes, nil
+	}
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected prefix=mode, got %q", entry)
+		}
+		prefix, mode := parts[0], parts[1]
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("path prefix %q must start with /", prefix)
+		}
+		switch mode {
+		case asyncAlwaysMode, asyncConditionalMode, asyncNeverMode:
+		default:
+			return nil, fmt.Errorf("unsupported mode %q for path prefix %s", mode, prefix)
+		}
+		if _, ok := modes[prefix]; ok {
+			return nil, fmt.Errorf("duplicate path prefix %s", prefix)
+		}
+		modes[prefix] = mode
+	}
+	return modes, nil
+}
+
+// modeFor returns the mode of the longest prefix matching the path, or defaultMode if
+// no prefix matches. An empty path matches all requests and is treated as "/".
+func (m pathModes) modeFor(path, defaultMode string) string {
+	if path == "" {
+		path = "/"
+	}
+	longest := -1
+	mode := defaultMode
+	for prefix, prefixMode := range m {
+		if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			longest, mode = len(prefix), prefixMode
+		}
+	}
+	return mode
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"testing"
+)
+
+func TestParsePathModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    pathModes
+		wantErr bool
+	}{{
+		name:  "empty",
+		value: "",
+		want:  pathModes{},
+	}, {
+		name:  "three modes",
+		value: "/reports=always.async.knative.dev, /search=conditional.async.knative.dev,/health=never.async.knative.dev",
+		want: pathModes{
+			"/reports": asyncAlwaysMode,
+			"/search":  asyncConditionalMode,
+			"/health":  asyncNeverMode,
+		},
+	}, {
+		name:    "missing mode",
+		value:   "/reports",
+		wantErr: true,
+	}, {
+		name:    "relative prefix",
+		value:   "reports=always.async.knative.dev",
+		wantErr: true,
+	}, {
+		name:    "unknown mode",
+		value:   "/reports=sometimes",
+		wantErr: true,
+	}, {
+		name:    "duplicate prefix",
+		value:   "/reports=always.async.knative.dev,/reports=never.async.knative.dev",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parsePathModes(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parsePathModes() = %v, wantErr %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("parsePathModes() = %v, want %v", got, test.want)
+			}
+			for prefix, mode := range test.want {
+				if got[prefix] != mode {
+					t.Errorf("mode for %s = %q, want %q", prefix, got[prefix], mode)
+				}
+			}
+		})
+	}
+}
+
+func TestPathModesModeFor(t *testing.T) {
+	modes := pathModes{
+		"/":           asyncNeverMode,
+		"/api":        asyncConditionalMode,
+		"/api/orders": asyncAlwaysMode,
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", asyncNeverMode},
+		{"/index.html", asyncNeverMode},
+		{"/api/search", asyncConditionalMode},
+		{"/api/orders/42", asyncAlwaysMode},
+	}
+	for _, test := range tests {
+		if got := modes.modeFor(test.path, asyncConditionalMode); got != test.want {
+			t.Errorf("modeFor(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+	if got := (pathModes{}).modeFor("/api", asyncAlwaysMode); got != asyncAlwaysMode {
+		t.Errorf("modeFor without prefixes = %q, want the default %q", got, asyncAlwaysMode)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"knative.dev/pkg/configmap"
+)
+
+const (
+	// PolicyConfigName is the name of the ConfigMap holding the cluster-wide policy.
+	PolicyConfigName = "config-async-policy"
+
+	// forceAsyncNamespacesKey lists the namespaces whose ingresses are always
+	// asynchronous, whatever their mode annotation says.
+	forceAsyncNamespacesKey = "force-async-namespaces"
+)
+
+// Policy is the cluster-wide policy read from the config-async-policy ConfigMap.
+type Policy struct {
+	ForceAsyncNamespaces sets.String
+}
+
+// NewPolicyFromConfigMap creates a Policy from the supplied ConfigMap.
+func NewPolicyFromConfigMap(cm *corev1.ConfigMap) (*Policy, error) {
+	p := &Policy{ForceAsyncNamespaces: sets.NewString()}
+	for _, ns := range strings.Split(cm.Data[forceAsyncNamespacesKey], ",") {
+		ns = strings.TrimSpace(ns)
+		if ns == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace %q in %s: %s", ns, forceAsyncNamespacesKey, strings.Join(errs, "; "))
+		}
+		p.ForceAsyncNamespaces.Insert(ns)
+	}
+	return p, nil
+}
+
+// forcesAsync returns true if ingresses in the namespace must be always asynchronous.
+func (p *Policy) forcesAsync(namespace string) bool {
+	return p != nil && p.ForceAsyncNamespaces.Has(namespace)
+}
+
+type policyKey struct{}
+
+// policyToContext attaches the Policy to the context.
+func policyToContext(ctx context.Context, p *Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, p)
+}
+
+// policyFromContext returns the Policy attached to the context, or nil if there is none.
+func policyFromContext(ctx context.Context) *Policy {
+	p, _ := ctx.Value(policyKey{}).(*Policy)
+	return p
+}
+
+// PolicyStore is a typed wrapper around configmap.UntypedStore to handle the Policy.
+type PolicyStore struct {
+	*configmap.UntypedStore
+}
+
+// NewPolicyStore creates a PolicyStore. WatchConfigs must be called to keep it up to date.
+func NewPolicyStore(logger configmap.Logger, onAfterStore ...func(name string, value interface{})) *PolicyStore {
+	return &PolicyStore{
+		UntypedStore: configmap.NewUntypedStore(
+			"async-policy",
+			logger,
+			configmap.Constructors{
+				PolicyConfigName: NewPolicyFromConfigMap,
+			},
+			onAfterStore...,
+		),
+	}
+}
+
+// ToContext attaches the current Policy to the context.
+func (s *PolicyStore) ToContext(ctx context.Context) context.Context {
+	return policyToContext(ctx, s.Load())
+}
+
+// Load returns the current Policy.
+func (s *PolicyStore) Load() *Policy {
+	p, _ := s.UntypedLoad(PolicyConfigName).(*Policy)
+	return p
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"knative.dev/networking/pkg/apis/networking"
+)
+
+const (
+	// knativePortNaming names the port after the protocol, "http" or "http2".
+	knativePortNaming = "knative"
+	// istioPortNaming follows the <protocol>-<suffix> convention Istio uses to detect
+	// the protocol of a port, "http-async-producer" or "http2-async-producer".
+	istioPortNaming = "istio"
+)
+
+// portNamingFor returns the port naming of the service generated for the ingress class.
+// Every class uses the Knative naming unless configured otherwise, a default per class
+// would rename the ports of the existing services on upgrade.
+func (c *Config) portNamingFor(ingressClass string) string {
+	if naming, ok := c.PortNaming[ingressClass]; ok {
+		return naming
+	}
+	return knativePortNaming
+}
+
+// servicePortName returns the name of the generated service port. The generated
+// ingress selects the port by number, so only the name seen by the mesh changes.
+func servicePortName(protocol networking.ProtocolType, naming string) string {
+	name := networking.ServicePortName(protocol)
+	if naming == istioPortNaming {
+		return name + "-" + producerServiceName
+	}
+	return name
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/kmeta"
+	"knative.dev/pkg/system"
+)
+
+const (
+	// asyncPreferProducersKey maps Prefer header values to producer services, e.g.
+	// "respond-batch=batch-producer" routes requests with Prefer: respond-batch to the
+	// batch-producer service next to the default producer.
+	asyncPreferProducersKey = "async.knative.dev/prefer-producers"
+
+	// preferProducerIngressLabelKey is set to the name of the source ingress on the
+	// services generated for the prefer-producers annotation, so the services of removed
+	// mappings can be found and deleted.
+	preferProducerIngressLabelKey = "async.knative.dev/prefer-producer-ingress"
+)
+
+// preferProducer routes the requests with a Prefer header value to a producer service.
+type preferProducer struct {
+	value   string
+	service string
+}
+
+// parsePreferProducers parses the value of the prefer-producers annotation, a comma
+// separated list of "value=service" pairs. The mappings are sorted by value.
+func parsePreferProducers(value string) ([]preferProducer, error) {
+	var producers []preferProducer
+	if strings.TrimSpace(value) == "" {
+		return producers, nil
+	}
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected value=service, got %q", entry)
+		}
+		producer := preferProducer{value: parts[0], service: parts[1]}
+		if producer.value == preferAsyncValue || producer.value == preferSyncValue {
+			return nil, fmt.Errorf("the Prefer value %s can't be mapped, it is routed by the async mode", producer.value)
+		}
+		if errs := validation.IsDNS1035Label(producer.service); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid service %q for Prefer value %s: %s", producer.service, producer.value, strings.Join(errs, "; "))
+		}
+		if seen[producer.value] {
+			return nil, fmt.Errorf("duplicate Prefer value %s", producer.value)
+		}
+		seen[producer.value] = true
+		producers = append(producers, producer)
+	}
+	sort.Slice(producers, func(i, j int) bool {
+		return producers[i].value < producers[j].value
+	})
+	return producers, nil
+}
+
+// producer returns the producer service the mapping routes to.
+func (p preferProducer) producer() Producer {
+	return Producer{Name: p.service, Namespace: system.Namespace()}
+}
+
+// serviceName returns the name of the service generated for the mapping in the namespace
+// of the ingress.
+func (p preferProducer) serviceName(ingressName string) string {
+	return kmeta.ChildName(ingressName, asyncSuffix+"-"+p.service)
+}
+
+// makePreferPaths returns the paths routing the requests of the path with a mapped Prefer
+// value to their producer. They must precede the paths generated for the mode of the path.
+func makePreferPaths(path, producer v1alpha1.HTTPIngressPath, producers []preferProducer, ingressName string) []v1alpha1.HTTPIngressPath {
+	paths := make([]v1alpha1.HTTPIngressPath, 0, len(producers))
+	for _, p := range producers {
+		async := routeToProducer(path, producer)
+		for i := range async.Splits {
+			async.Splits[i].ServiceName = p.serviceName(ingressName)
+		}
+		if producer.RewriteHost != "" {
+			async.RewriteHost = p.producer().Hostname()
+		}
+		async.Headers = unionHeaderMatches(path.Headers,
+			map[string]v1alpha1.HeaderMatch{preferHeaderField: {Exact: p.value}})
+		paths = append(paths, async)
+	}
+	return paths
+}
+
+// makePreferServices returns the services routing to the producers of the prefer-producers
+// annotation of the ingress, and to its read and write producers.
+func makePreferServices(ingress *v1alpha1.Ingress, ingressClass string, cfg *Config) []*corev1.Service {
+	// The annotation was validated before, or the ingress is exempt from validation and
+	// invalid values are ignored.
+	producers, _ := parsePreferProducers(ingress.Annotations[asyncPreferProducersKey])
+	for _, key := range []string{asyncReadProducerKey, asyncWriteProducerKey} {
+		if p, ok := methodProducer(ingress.Annotations, key); ok {
+			producers = append(producers, p)
+		}
+	}
+	services := make([]*corev1.Service, 0, len(producers))
+	seen := sets.NewString()
+	for _, p := range producers {
+		if seen.Has(p.service) {
+			continue
+		}
+		seen.Insert(p.service)
+		service := MakeK8sService(ingress, ingressClass, p.producer(), cfg)
+		service.Name = p.serviceName(ingress.Name)
+		service.Labels = map[string]string{preferProducerIngressLabelKey: ingress.Name}
+		services = append(services, service)
+	}
+	return services
+}
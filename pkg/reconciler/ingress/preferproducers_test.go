@@ -0,0 +1,69 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePreferProducers(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []preferProducer
+		wantErr bool
+	}{{
+		name:  "empty",
+		value: "",
+	}, {
+		name:  "sorted by value",
+		value: "respond-priority=priority-producer, respond-batch=batch-producer",
+		want: []preferProducer{
+			{value: "respond-batch", service: "batch-producer"},
+			{value: "respond-priority", service: "priority-producer"},
+		},
+	}, {
+		name:    "missing service",
+		value:   "respond-batch",
+		wantErr: true,
+	}, {
+		name:    "missing value",
+		value:   "=batch-producer",
+		wantErr: true,
+	}, {
+		name:    "invalid service",
+		value:   "respond-batch=Batch.Producer",
+		wantErr: true,
+	}, {
+		name:    "value routed by the async mode",
+		value:   "respond-sync=sync-producer",
+		wantErr: true,
+	}, {
+		name:    "duplicate value",
+		value:   "respond-batch=batch-producer,respond-batch=other-producer",
+		wantErr: true,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parsePreferProducers(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parsePreferProducers() = %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parsePreferProducers() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
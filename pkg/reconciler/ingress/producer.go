@@ -0,0 +1,243 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/network"
+	"knative.dev/pkg/system"
+)
+
+// asyncProducerHealthPathKey makes the reconciler probe the producer with a GET request
+// to the path before marking the ingress ready.
+const asyncProducerHealthPathKey = "async.knative.dev/producer-health-path"
+
+// Producer identifies the service the async requests are routed to.
+type Producer struct {
+	Name      string
+	Namespace string
+}
+
+// defaultProducer returns the producer installed next to the controller.
+func defaultProducer() Producer {
+	return Producer{Name: producerServiceName, Namespace: system.Namespace()}
+}
+
+// Hostname returns the cluster local hostname of the producer service.
+func (p Producer) Hostname() string {
+	return network.GetServiceHostname(p.Name, p.Namespace)
+}
+
+// resolveProducer returns the producer for the async requests of the ingress. The producer
+// named by the producer-service annotation is used as is, the Knative Service named by the
+// producer-ksvc annotation through its route. Otherwise the fallback producer is used
+// instead of the default one while the default producer has no ready endpoints.
+func (r *Reconciler) resolveProducer(ing *v1alpha1.Ingress) (Producer, error) {
+	primary := defaultProducer()
+	if name := ing.Annotations[asyncProducerServiceKey]; name != "" {
+		return Producer{Name: name, Namespace: primary.Namespace}, nil
+	}
+	if _, ok := ing.Annotations[asyncProducerKServiceKey]; ok {
+		return r.kserviceProducer(ing)
+	}
+	if r.config.FallbackProducerService == "" {
+		return primary, nil
+	}
+	ready, err := r.producerReadyDebounced(ing, primary)
+	if err != nil || ready {
+		return primary, err
+	}
+	return Producer{Name: r.config.FallbackProducerService, Namespace: primary.Namespace}, nil
+}
+
+// producerReady returns true if the producer service has at least one ready endpoint. The
+// result is cached for ProducerReadinessCacheTTL, changes of the endpoints invalidate it.
+func (r *Reconciler) producerReady(p Producer) (bool, error) {
+	ttl := r.config.ProducerReadinessCacheTTL
+	if ttl == 0 {
+		return r.lookupProducerReady(p)
+	}
+	if ready, ok := r.readiness.get(p, r.clock.Now()); ok {
+		return ready, nil
+	}
+	ready, err := r.lookupProducerReady(p)
+	if err != nil {
+		return false, err
+	}
+	r.readiness.set(p, ready, r.clock.Now().Add(ttl))
+	return ready, nil
+}
+
+// lookupProducerReady returns true if the endpoints of the producer have a ready address.
+// A Knative Service producer, like the default producer, is ready if the public service
+// of one of its revisions has a ready address, the activator while it is scaled to zero.
+// The ClusterIP services bypass the activator, with them the private services of the
+// revisions need a ready pod.
+func (r *Reconciler) lookupProducerReady(p Producer) (bool, error) {
+	serviceType := publicServiceType
+	if r.config.clusterIPServices() {
+		serviceType = privateServiceType
+	}
+	names, err := r.producerEndpointsNames(p, serviceType)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		endpoints, err := r.endpointsLister.Endpoints(p.Namespace).Get(name)
+		if apierrs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if hasReadyAddress(endpoints) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// hasReadyAddress returns true if a subset of the endpoints has a ready address.
+func hasReadyAddress(endpoints *corev1.Endpoints) bool {
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForProducer returns false and requeues the ingress with an increasing delay if
+// one of the producers routed to by method has no ready endpoints and
+// ProducerNotReadyMinDelay is set, or if it fails the health probe requested with the
+// producer-health-path annotation ProducerProbeFailureThreshold consecutive times. Below
+// the threshold the ingress is probed again after ProducerProbeInterval and keeps its
+// condition. The endpoints of producers outside the watched namespace, Knative Services
+// named by the producer-ksvc annotation in other namespaces, aren't checked.
+func (r *Reconciler) waitForProducer(ctx context.Context, ing *v1alpha1.Ingress, producer Producer) (bool, error) {
+	key := types.NamespacedName{Namespace: ing.Namespace, Name: ing.Name}
+	path := ing.Annotations[asyncProducerHealthPathKey]
+	var reason, message string
+	for _, p := range methodProducers(ing, producer) {
+		if r.config.ProducerNotReadyMinDelay != 0 && r.config.watchesEndpointsOf(p.Namespace) {
+			ready, err := r.producerReadyDebounced(ing, p)
+			if err != nil {
+				return false, err
+			}
+			if !ready {
+				reason = producerNotReadyReason
+				message = fmt.Sprintf("Waiting for the producer %s to have ready endpoints", p.Hostname())
+				break
+			}
+		}
+		if path == "" {
+			continue
+		}
+		err := r.probeProducer(ctx, p, path)
+		if err == nil {
+			r.failures.reset(key, p)
+			continue
+		}
+		if r.failures.record(key, p) < r.config.producerProbeFailureThreshold() {
+			// Probe again after the interval, the condition is kept until the threshold.
+			logging.FromContext(ctx).Infof("The producer %s failed the health probe: %v", p.Hostname(), err)
+			if r.enqueueAfter != nil {
+				r.enqueueAfter(ing, r.config.producerProbeInterval())
+			}
+			return false, nil
+		}
+		reason = producerUnhealthyReason
+		message = fmt.Sprintf("The producer %s failed the health probe: %v", p.Hostname(), err)
+		break
+	}
+
+	if reason == "" {
+		r.backoff.reset(key)
+		conditionsFor(ing, &r.config).markStep(producerReadyCondition, corev1.ConditionTrue, "", "")
+		return true, nil
+	}
+	delay := r.backoff.next(key, r.config.producerNotReadyMinDelay(), r.config.producerNotReadyMaxDelay())
+	conditionsFor(ing, &r.config).markWaitingForProducer(reason, message)
+	if r.enqueueAfter != nil {
+		r.enqueueAfter(ing, delay)
+	}
+	return false, nil
+}
+
+// probeClient returns the HTTP client of the producer health probe. It doesn't follow
+// redirects, a redirect fails the probe like any other status outside of 2xx.
+func probeClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// probeProducer sends a GET request to the path of the producer and returns an error if
+// it fails or doesn't answer with a 2xx status within the probe timeout.
+func (r *Reconciler) probeProducer(ctx context.Context, p Producer, path string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.config.producerProbeTimeout())
+	defer cancel()
+	probeURL := url.URL{Scheme: "http", Host: p.Hostname(), Path: path}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkProducerService returns a message if the service of the producer is checked and
+// doesn't exist. The ingress is reconciled again when the service is created.
+func (r *Reconciler) checkProducerService(p Producer) (string, error) {
+	if !r.config.CheckProducerService {
+		return "", nil
+	}
+	if _, err := r.serviceLister.Services(p.Namespace).Get(p.Name); apierrs.IsNotFound(err) {
+		return fmt.Sprintf("Waiting for the producer service %s/%s to be created", p.Namespace, p.Name), nil
+	} else if err != nil {
+		return "", err
+	}
+	return "", nil
+}
+
+// producerServiceExists asks the API server whether the producer service exists, for the
+// startup check before the informers are synced.
+func producerServiceExists(ctx context.Context, kubeclient kubernetes.Interface) (bool, error) {
+	p := defaultProducer()
+	_, err := kubeclient.CoreV1().Services(p.Namespace).Get(ctx, p.Name, metav1.GetOptions{})
+	if apierrs.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
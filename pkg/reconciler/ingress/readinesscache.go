@@ -0,0 +1,85 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"sync"
+	"time"
+)
+
+// readinessCache holds the readiness of the producers for ProducerReadinessCacheTTL, so
+// the reconciles of many ingresses sharing a producer look up its endpoints once.
+type readinessCache struct {
+	mu      sync.Mutex
+	entries map[Producer]readinessEntry
+}
+
+type readinessEntry struct {
+	ready   bool
+	expires time.Time
+}
+
+// get returns the cached readiness of the producer, or false if it isn't cached or expired.
+func (c *readinessCache) get(p Producer, now time.Time) (ready, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[p]
+	if !ok || !now.Before(entry.expires) {
+		return false, false
+	}
+	return entry.ready, true
+}
+
+// set caches the readiness of the producer until expires.
+func (c *readinessCache) set(p Producer, ready bool, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[Producer]readinessEntry)
+	}
+	c.entries[p] = readinessEntry{ready: ready, expires: expires}
+}
+
+// has returns true if the readiness of the producer is cached, even if it expired.
+func (c *readinessCache) has(p Producer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[p]
+	return ok
+}
+
+// invalidate forgets the readiness of the producer.
+func (c *readinessCache) invalidate(p Producer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, p)
+}
+
+// refreshReadinessOf caches the readiness of the producer whose endpoints changed, it
+// handles the events of the endpoints informer. The lister already holds the change, so
+// the following reconciles of the ingresses of the producer find the fresh readiness in
+// the cache. Only the producers looked up by a reconcile before are cached.
+func (r *Reconciler) refreshReadinessOf(obj interface{}) {
+	ttl := r.config.ProducerReadinessCacheTTL
+	p, ok := producerOfEndpoints(obj)
+	if ttl == 0 || !ok || !r.readiness.has(p) {
+		return
+	}
+	ready, err := r.lookupProducerReady(p)
+	if err != nil {
+		r.readiness.invalidate(p)
+		return
+	}
+	r.readiness.set(p, ready, r.clock.Now().Add(ttl))
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestProducerReadinessCache(t *testing.T) {
+	producer := defaultProducer()
+	ready := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: producer.Name, Namespace: producer.Namespace},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+		}},
+	}
+	notReady := ready.DeepCopy()
+	notReady.Subsets[0].NotReadyAddresses = notReady.Subsets[0].Addresses
+	notReady.Subsets[0].Addresses = nil
+
+	newReconciler := func(ttl time.Duration) (*Reconciler, cache.Indexer, *clock.FakeClock) {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		if err := indexer.Add(ready); err != nil {
+			t.Fatalf("Error adding the endpoints: %v", err)
+		}
+		fakeClock := clock.NewFakeClock(time.Now())
+		return &Reconciler{
+			serviceLister:   corev1listers.NewServiceLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+			endpointsLister: corev1listers.NewEndpointsLister(indexer),
+			config:          Config{ProducerReadinessCacheTTL: ttl},
+			clock:           fakeClock,
+		}, indexer, fakeClock
+	}
+	wantReady := func(r *Reconciler, want bool, when string) {
+		t.Helper()
+		if got, err := r.producerReady(producer); err != nil || got != want {
+			t.Errorf("producerReady() %s = %v, %v, want %v", when, got, err, want)
+		}
+	}
+
+	r, indexer, fakeClock := newReconciler(10 * time.Second)
+	wantReady(r, true, "initially")
+	indexer.Update(notReady)
+	wantReady(r, true, "within the TTL")
+	fakeClock.Step(10 * time.Second)
+	wantReady(r, false, "after the TTL")
+
+	// A change of the endpoints refreshes the cached readiness right away.
+	indexer.Update(ready)
+	wantReady(r, false, "before the endpoints event")
+	r.refreshReadinessOf(ready)
+	wantReady(r, true, "after the endpoints event")
+	indexer.Update(notReady)
+	r.refreshReadinessOf(notReady)
+	indexer.Update(ready)
+	wantReady(r, false, "from the cache filled by the endpoints event")
+
+	// Other producers are cached on their own, the endpoints of producers never looked
+	// up by a reconcile aren't cached.
+	other := Producer{Name: "other-producer", Namespace: producer.Namespace}
+	if got, err := r.producerReady(other); err != nil || got {
+		t.Errorf("producerReady(%s) = %v, %v, want false", other.Name, got, err)
+	}
+	unknown := ready.DeepCopy()
+	unknown.Name = "unknown"
+	r.refreshReadinessOf(unknown)
+	if r.readiness.has(Producer{Name: unknown.Name, Namespace: unknown.Namespace}) {
+		t.Error("The readiness of a producer never looked up is cached")
+	}
+
+	r, indexer, _ = newReconciler(0)
+	wantReady(r, true, "without a cache")
+	indexer.Update(notReady)
+	wantReady(r, false, "without a cache")
+
+	if err := (&Config{ProducerReadinessCacheTTL: -time.Second}).Validate(); err == nil {
+		t.Error("Validate() = nil, want error for a negative TTL")
+	}
+}
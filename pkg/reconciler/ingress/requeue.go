@@ -0,0 +1,131 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"knative.dev/pkg/kmeta"
+)
+
+const (
+	// defaultProducerNotReadyMinDelay is the first requeue delay of ingresses whose
+	// producer fails the health probe when no minimum is configured.
+	defaultProducerNotReadyMinDelay = 5 * time.Second
+
+	// defaultProducerNotReadyMaxDelay caps the requeue delay when no maximum is configured.
+	defaultProducerNotReadyMaxDelay = 5 * time.Minute
+
+	// defaultProducerProbeTimeout is the timeout of the producer health probe.
+	defaultProducerProbeTimeout = time.Second
+
+	// defaultProducerProbeInterval is the delay between the attempts of the producer
+	// health probe.
+	defaultProducerProbeInterval = time.Second
+
+	// maxProducerProbeFailureThreshold and maxProducerProbeInterval bound the time a
+	// failing producer is probed before the ingresses are marked as waiting for it.
+	maxProducerProbeFailureThreshold = 10
+	maxProducerProbeInterval         = time.Minute
+)
+
+// notReadyBackoff tracks the requeue delay of the ingresses waiting for the producer.
+// The delay doubles on every attempt, from the minimum up to the maximum delay.
+type notReadyBackoff struct {
+	mu       sync.Mutex
+	attempts map[types.NamespacedName]int
+}
+
+// next returns the delay before the next attempt for the ingress.
+func (b *notReadyBackoff) next(key types.NamespacedName, min, max time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.attempts == nil {
+		b.attempts = make(map[types.NamespacedName]int)
+	}
+	delay := min
+	for i := 0; i < b.attempts[key] && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	b.attempts[key]++
+	return delay
+}
+
+// reset forgets the attempts of the ingress once the producer is ready.
+func (b *notReadyBackoff) reset(key types.NamespacedName) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.attempts, key)
+}
+
+// probeFailures counts the consecutive failed health probes of the producers per ingress.
+// The probes are spread over reconciles, ProducerProbeInterval apart.
+type probeFailures struct {
+	mu     sync.Mutex
+	counts map[probeKey]int
+}
+
+// probeKey identifies the probes of a producer for an ingress.
+type probeKey struct {
+	ingress  types.NamespacedName
+	producer Producer
+}
+
+// record counts a failed probe of the producer for the ingress and returns the
+// consecutive failures.
+func (f *probeFailures) record(key types.NamespacedName, p Producer) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.counts == nil {
+		f.counts = make(map[probeKey]int)
+	}
+	f.counts[probeKey{key, p}]++
+	return f.counts[probeKey{key, p}]
+}
+
+// reset forgets the failures of the producer for the ingress once a probe succeeds.
+func (f *probeFailures) reset(key types.NamespacedName, p Producer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.counts, probeKey{key, p})
+}
+
+// forget forgets the failures of all producers of the ingress once it is deleted.
+func (f *probeFailures) forget(key types.NamespacedName) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for k := range f.counts {
+		if k.ingress == key {
+			delete(f.counts, k)
+		}
+	}
+}
+
+// forgetIngress drops the requeue state of the ingress once it is deleted, so the
+// attempts and failures of deleted ingresses don't pile up. It handles the deletes of
+// the ingress informer, with or without a finalizer on the ingress.
+func (r *Reconciler) forgetIngress(obj interface{}) {
+	ing, err := kmeta.DeletionHandlingAccessor(obj)
+	if err != nil {
+		return
+	}
+	key := types.NamespacedName{Namespace: ing.GetNamespace(), Name: ing.GetName()}
+	r.backoff.reset(key)
+	r.failures.forget(key)
+}
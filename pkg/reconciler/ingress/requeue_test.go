@@ -0,0 +1,83 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestNotReadyBackoff(t *testing.T) {
+	key := types.NamespacedName{Namespace: defaultNamespace, Name: testingName}
+	other := types.NamespacedName{Namespace: defaultNamespace, Name: "other"}
+	b := &notReadyBackoff{}
+
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, b.next(key, time.Second, 5*time.Second))
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("delays = %v, want %v", got, want)
+	}
+	if got := b.next(other, time.Second, 5*time.Second); got != time.Second {
+		t.Errorf("delay of another ingress = %v, want %v", got, time.Second)
+	}
+
+	b.reset(key)
+	if got := b.next(key, time.Second, 5*time.Second); got != time.Second {
+		t.Errorf("delay after reset = %v, want %v", got, time.Second)
+	}
+}
+
+func TestForgetIngress(t *testing.T) {
+	key := types.NamespacedName{Namespace: defaultNamespace, Name: testingName}
+	other := types.NamespacedName{Namespace: defaultNamespace, Name: "other"}
+
+	tests := []struct {
+		name string
+		obj  interface{}
+	}{{
+		name: "deleted ingress",
+		obj:  ingSometimesAsync,
+	}, {
+		name: "tombstone",
+		obj:  cache.DeletedFinalStateUnknown{Key: key.String(), Obj: ingSometimesAsync},
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := &Reconciler{}
+			r.backoff.next(key, time.Second, 5*time.Second)
+			r.backoff.next(other, time.Second, 5*time.Second)
+			r.failures.record(key, defaultProducer())
+			r.failures.record(key, Producer{Namespace: defaultNamespace, Name: "read-producer"})
+			r.failures.record(other, defaultProducer())
+
+			r.forgetIngress(test.obj)
+			if _, ok := r.backoff.attempts[key]; ok {
+				t.Error("the backoff of the deleted ingress is kept")
+			}
+			if got := len(r.failures.counts); got != 1 {
+				t.Errorf("probe failures = %v, want only the ones of the other ingress", r.failures.counts)
+			}
+			if got := r.backoff.next(other, time.Second, 5*time.Second); got != 2*time.Second {
+				t.Errorf("delay of another ingress = %v, want %v", got, 2*time.Second)
+			}
+		})
+	}
+}
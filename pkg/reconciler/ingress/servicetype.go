@@ -0,0 +1,282 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/kmeta"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/network"
+	"knative.dev/pkg/system"
+)
+
+const (
+	externalNameServiceType = string(corev1.ServiceTypeExternalName)
+	clusterIPServiceType    = string(corev1.ServiceTypeClusterIP)
+	autoServiceType         = "auto"
+
+	// asyncProducerKey is set on the generated ClusterIP services to the namespace/name of
+	// the producer whose endpoints they mirror.
+	asyncProducerKey = "async.knative.dev/producer"
+
+	// externalNameProbeName is the ExternalName service created on startup to probe
+	// whether the cluster DNS resolves ExternalName services.
+	externalNameProbeName = "async-externalname-probe"
+
+	// externalNameProbeTimeout bounds the DNS lookup of the probe service.
+	externalNameProbeTimeout = 5 * time.Second
+
+	// producerIndex is the index of the generated ClusterIP services by their producer.
+	producerIndex = "async-producer"
+)
+
+// clusterIPServices returns true if the generated services are ClusterIP services
+// mirroring the endpoints of the producer.
+func (c *Config) clusterIPServices() bool {
+	return c.ProducerServiceType == clusterIPServiceType
+}
+
+// detectProducerServiceType probes whether ExternalName services resolve in the cluster,
+// some network setups block them. It creates an ExternalName service resolving to the
+// API server service and looks it up with lookupHost. It returns ClusterIP if the lookup
+// fails, and ExternalName if it succeeds or the probe service can't be created.
+func detectProducerServiceType(ctx context.Context, client kubernetes.Interface,
+	lookupHost func(context.Context, string) ([]string, error)) string {
+	logger := logging.FromContext(ctx)
+
+	probe := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: externalNameProbeName, Namespace: system.Namespace()},
+		Spec: corev1.ServiceSpec{
+			Type:         corev1.ServiceTypeExternalName,
+			ExternalName: network.GetServiceHostname("kubernetes", metav1.NamespaceDefault),
+		},
+	}
+	services := client.CoreV1().Services(probe.Namespace)
+	if _, err := services.Create(ctx, probe, metav1.CreateOptions{}); err != nil && !apierrs.IsAlreadyExists(err) {
+		logger.Warnf("Error creating the ExternalName probe service, generating ExternalName services: %v", err)
+		return externalNameServiceType
+	}
+	defer func() {
+		if err := services.Delete(ctx, probe.Name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+			logger.Warnf("Error deleting the ExternalName probe service: %v", err)
+		}
+	}()
+
+	lookupCtx, cancel := context.WithTimeout(ctx, externalNameProbeTimeout)
+	defer cancel()
+	if _, err := lookupHost(lookupCtx, network.GetServiceHostname(probe.Name, probe.Namespace)); err != nil {
+		logger.Warnf("ExternalName services don't resolve, generating ClusterIP services. They bypass the activator, "+
+			"Knative Service producers must not scale to zero: %v", err)
+		return clusterIPServiceType
+	}
+	logger.Info("ExternalName services resolve, generating ExternalName services")
+	return externalNameServiceType
+}
+
+// producerOf returns the producer whose endpoints the generated ClusterIP service mirrors.
+func producerOf(service *corev1.Service) (Producer, bool) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(service.Annotations[asyncProducerKey])
+	if err != nil || name == "" {
+		return Producer{}, false
+	}
+	return Producer{Name: name, Namespace: namespace}, true
+}
+
+// makeEndpointSubsets returns the subsets of the endpoints of the generated service: the
+// addresses of the producer endpoints, with the port of the producer pods the port of the
+// producer service with the port number of the generated service maps to.
+func makeEndpointSubsets(service, producerService *corev1.Service, producerEndpoints *corev1.Endpoints) []corev1.EndpointSubset {
+	port := service.Spec.Ports[0]
+	portName, found := "", false
+	for _, producerPort := range producerService.Spec.Ports {
+		if producerPort.Port == port.Port {
+			portName, found = producerPort.Name, true
+			break
+		}
+	}
+	var subsets []corev1.EndpointSubset
+	for _, subset := range producerEndpoints.Subsets {
+		var endpointPort *corev1.EndpointPort
+		for i := range subset.Ports {
+			if (found && subset.Ports[i].Name == portName) || (!found && len(subset.Ports) == 1) {
+				endpointPort = &subset.Ports[i]
+				break
+			}
+		}
+		if endpointPort == nil {
+			continue
+		}
+		subsets = append(subsets, corev1.EndpointSubset{
+			Addresses:         withoutTargetRefs(subset.Addresses),
+			NotReadyAddresses: withoutTargetRefs(subset.NotReadyAddresses),
+			Ports: []corev1.EndpointPort{{
+				Name:     port.Name,
+				Port:     endpointPort.Port,
+				Protocol: port.Protocol,
+			}},
+		})
+	}
+	return subsets
+}
+
+// withoutTargetRefs copies the addresses without their references to the producer pods,
+// which live in another namespace than the generated endpoints.
+func withoutTargetRefs(addresses []corev1.EndpointAddress) []corev1.EndpointAddress {
+	if len(addresses) == 0 {
+		return nil
+	}
+	copied := make([]corev1.EndpointAddress, 0, len(addresses))
+	for _, address := range addresses {
+		address.TargetRef = nil
+		copied = append(copied, address)
+	}
+	return copied
+}
+
+// reconcileEndpoints creates or updates the endpoints of a generated ClusterIP service
+// from the endpoints of its producer. The endpoints are deleted with the service. The
+// generated ExternalName services have no endpoints.
+func (r *Reconciler) reconcileEndpoints(ctx context.Context, service *corev1.Service) error {
+	producer, ok := producerOf(service)
+	if service.Spec.Type != corev1.ServiceTypeClusterIP || !ok {
+		return nil
+	}
+	subsets, err := r.producerSubsets(service, producer)
+	if err != nil {
+		return err
+	}
+
+	endpoints := r.kubeclient.CoreV1().Endpoints(service.Namespace)
+	existing, err := r.endpointsLister.Endpoints(service.Namespace).Get(service.Name)
+	if apierrs.IsNotFound(err) {
+		desired := &corev1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            service.Name,
+				Namespace:       service.Namespace,
+				Labels:          service.Labels,
+				OwnerReferences: service.OwnerReferences,
+			},
+			Subsets: subsets,
+		}
+		if _, err := endpoints.Create(ctx, desired, r.config.createOptions()); err != nil {
+			return fmt.Errorf("Failed to create async K8s Endpoints: %w", err)
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to get async K8s Endpoints: %w", err)
+	}
+	if equality.Semantic.DeepEqual(existing.Subsets, subsets) {
+		return nil
+	}
+	// Don't modify the informers copy
+	updated := existing.DeepCopy()
+	updated.Subsets = subsets
+	if _, err := endpoints.Update(ctx, updated, r.config.updateOptions()); err != nil {
+		return fmt.Errorf("Failed to update async K8s Endpoints: %w", err)
+	}
+	return nil
+}
+
+// producerSubsets returns the subsets of the endpoints of the generated service mirroring
+// the producer. The route of a Knative Service has no endpoints, so the endpoints of the
+// private services of its revisions, which select its pods, are mirrored instead. The
+// requests then reach the pods without the activator: a Knative Service producer scaled
+// to zero has no endpoints and isn't scaled up by them.
+func (r *Reconciler) producerSubsets(service *corev1.Service, producer Producer) ([]corev1.EndpointSubset, error) {
+	names, err := r.producerEndpointsNames(producer, privateServiceType)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the producer K8s Service: %w", err)
+	}
+	var subsets []corev1.EndpointSubset
+	for _, name := range names {
+		producerService, err := r.serviceLister.Services(producer.Namespace).Get(name)
+		if apierrs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to get the producer K8s Service: %w", err)
+		}
+		producerEndpoints, err := r.endpointsLister.Endpoints(producer.Namespace).Get(name)
+		if apierrs.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to get the producer K8s Endpoints: %w", err)
+		}
+		subsets = append(subsets, makeEndpointSubsets(service, producerService, producerEndpoints)...)
+	}
+	return subsets, nil
+}
+
+// producerIndexFunc indexes the generated ClusterIP services by the namespace/name of the
+// producer they mirror.
+func producerIndexFunc(obj interface{}) ([]string, error) {
+	service, ok := obj.(*corev1.Service)
+	if !ok {
+		return nil, nil
+	}
+	if _, ok := producerOf(service); !ok {
+		return nil, nil
+	}
+	return []string{service.Annotations[asyncProducerKey]}, nil
+}
+
+// mirroringServices returns the generated services mirroring the producer of the endpoints,
+// from an indexer with the producerIndex.
+func mirroringServices(indexer cache.Indexer, obj interface{}) []interface{} {
+	p, ok := producerOfEndpoints(obj)
+	if !ok {
+		return nil
+	}
+	services, err := indexer.ByIndex(producerIndex, p.Namespace+"/"+p.Name)
+	if err != nil {
+		return nil
+	}
+	return services
+}
+
+// generatedEndpointsFilter returns a filter passing the endpoints of the generated
+// ClusterIP services.
+func generatedEndpointsFilter(lister corev1listers.ServiceLister) func(interface{}) bool {
+	return func(obj interface{}) bool {
+		endpoints, err := kmeta.DeletionHandlingAccessor(obj)
+		if err != nil {
+			return false
+		}
+		service, err := lister.Services(endpoints.GetNamespace()).Get(endpoints.GetName())
+		if err != nil {
+			return false
+		}
+		_, mirrors := producerOf(service)
+		return service.Spec.Type == corev1.ServiceTypeClusterIP && mirrors
+	}
+}
+
+// generatedService returns true if the service has a type the controller generates: an
+// ExternalName service, or a ClusterIP service without selector mirroring a producer.
+func generatedService(service *corev1.Service) bool {
+	if service.Spec.Type == corev1.ServiceTypeExternalName {
+		return true
+	}
+	_, mirrors := producerOf(service)
+	return service.Spec.Type == corev1.ServiceTypeClusterIP && len(service.Spec.Selector) == 0 && mirrors
+}
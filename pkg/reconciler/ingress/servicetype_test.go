@@ -0,0 +1,351 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	fakekubeclient "knative.dev/pkg/client/injection/kube/client/fake"
+	"knative.dev/pkg/network"
+	"knative.dev/pkg/system"
+
+	. "knative.dev/pkg/reconciler/testing"
+)
+
+func TestDetectProducerServiceType(t *testing.T) {
+	probeHost := network.GetServiceHostname(externalNameProbeName, system.Namespace())
+	tests := []struct {
+		name   string
+		lookup func(context.Context, string) ([]string, error)
+		want   string
+	}{{
+		name: "ExternalName resolves",
+		lookup: func(_ context.Context, host string) ([]string, error) {
+			if host != probeHost {
+				return nil, errors.New("unexpected host " + host)
+			}
+			return []string{"10.0.0.1"}, nil
+		},
+		want: externalNameServiceType,
+	}, {
+		name: "ExternalName blocked",
+		lookup: func(context.Context, string) ([]string, error) {
+			return nil, errors.New("no such host")
+		},
+		want: clusterIPServiceType,
+	}}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, _ := SetupFakeContext(t)
+			client := fakekubeclient.Get(ctx)
+			if got := detectProducerServiceType(ctx, client, test.lookup); got != test.want {
+				t.Errorf("detectProducerServiceType() = %s, want %s", got, test.want)
+			}
+			// The probe service is cleaned up.
+			_, err := client.CoreV1().Services(system.Namespace()).Get(ctx, externalNameProbeName, metav1.GetOptions{})
+			if !apierrs.IsNotFound(err) {
+				t.Errorf("Get(probe service) = %v, want not found", err)
+			}
+		})
+	}
+
+	for _, serviceType := range []string{"", externalNameServiceType, clusterIPServiceType, autoServiceType} {
+		if err := (&Config{ProducerServiceType: serviceType}).Validate(); err != nil {
+			t.Errorf("Validate(%q) = %v", serviceType, err)
+		}
+	}
+	if err := (&Config{ProducerServiceType: "NodePort"}).Validate(); err == nil {
+		t.Error("Validate() = nil, want error for a NodePort service type")
+	}
+}
+
+func TestClusterIPService(t *testing.T) {
+	cfg := &Config{ProducerServiceType: clusterIPServiceType}
+	producer := defaultProducer()
+
+	// Without the ClusterIP type the generated service stays an ExternalName service.
+	if svc := MakeK8sService(ingSometimesAsync, ingressKourier, producer, &Config{}); svc.Spec.Type != corev1.ServiceTypeExternalName {
+		t.Fatalf("Type = %s, want ExternalName by default", svc.Spec.Type)
+	}
+	svc := MakeK8sService(ingSometimesAsync, ingressKourier, producer, cfg)
+	if svc.Spec.Type != corev1.ServiceTypeClusterIP || svc.Spec.ExternalName != "" || len(svc.Spec.Selector) != 0 {
+		t.Fatalf("Spec = %+v, want a ClusterIP service without ExternalName and selector", svc.Spec)
+	}
+	if got, ok := producerOf(svc); !ok || got != producer {
+		t.Fatalf("producerOf() = %v, %v, want %v", got, ok, producer)
+	}
+	if !generatedService(svc) {
+		t.Error("generatedService() = false, want true for the generated ClusterIP service")
+	}
+	if selected := (&corev1.Service{Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP, Selector: map[string]string{"app": "x"}}}); generatedService(selected) {
+		t.Error("generatedService() = true, want false for a service with a selector")
+	}
+
+	producerService := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: producer.Name, Namespace: producer.Namespace},
+		Spec: corev1.ServiceSpec{Ports: []corev1.ServicePort{
+			{Name: "metrics", Port: 9090},
+			{Name: "http", Port: svc.Spec.Ports[0].Port},
+		}},
+	}
+	producerEndpoints := &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: producer.Name, Namespace: producer.Namespace},
+		Subsets: []corev1.EndpointSubset{{
+			Addresses: []corev1.EndpointAddress{{
+				IP:        "10.0.0.1",
+				TargetRef: &corev1.ObjectReference{Kind: "Pod", Name: "producer-1", Namespace: producer.Namespace},
+			}},
+			NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.2"}},
+			Ports: []corev1.EndpointPort{
+				{Name: "metrics", Port: 9091},
+				{Name: "http", Port: 8080},
+			},
+		}},
+	}
+	want := []corev1.EndpointSubset{{
+		Addresses:         []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+		NotReadyAddresses: []corev1.EndpointAddress{{IP: "10.0.0.2"}},
+		Ports: []corev1.EndpointPort{{
+			Name:     svc.Spec.Ports[0].Name,
+			Port:     8080,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}}
+
+	ctx, _ := SetupFakeContext(t)
+	client := fakekubeclient.Get(ctx)
+	services := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	endpoints := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	services.Add(producerService)
+	endpoints.Add(producerEndpoints)
+	r := &Reconciler{
+		serviceLister:   corev1listers.NewServiceLister(services),
+		endpointsLister: corev1listers.NewEndpointsLister(endpoints),
+		kubeclient:      client,
+	}
+	getEndpoints := func() *corev1.Endpoints {
+		t.Helper()
+		got, err := client.CoreV1().Endpoints(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Get(endpoints) = %v", err)
+		}
+		return got
+	}
+
+	if err := r.reconcileEndpoints(ctx, svc); err != nil {
+		t.Fatalf("reconcileEndpoints() = %v", err)
+	}
+	created := getEndpoints()
+	if !equality.Semantic.DeepEqual(created.Subsets, want) {
+		t.Errorf("Subsets = %+v, want %+v", created.Subsets, want)
+	}
+	if !equality.Semantic.DeepEqual(created.OwnerReferences, svc.OwnerReferences) {
+		t.Errorf("OwnerReferences = %+v, want the owner references of the service %+v", created.OwnerReferences, svc.OwnerReferences)
+	}
+
+	// The endpoints follow the producer.
+	endpoints.Add(created)
+	rolled := producerEndpoints.DeepCopy()
+	rolled.Subsets[0].Addresses[0].IP = "10.0.0.3"
+	endpoints.Update(rolled)
+	if err := r.reconcileEndpoints(ctx, svc); err != nil {
+		t.Fatalf("reconcileEndpoints() = %v", err)
+	}
+	if got := getEndpoints().Subsets[0].Addresses[0].IP; got != "10.0.0.3" {
+		t.Errorf("Address = %s, want 10.0.0.3", got)
+	}
+
+	// The route of a Knative Service has no endpoints, the private services of its
+	// revisions are mirrored.
+	route := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "orders-producer",
+			Namespace: producer.Namespace,
+			Labels:    map[string]string{routeLabelKey: "orders-producer"},
+		},
+		Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeExternalName, ExternalName: privateLBDomain},
+	}
+	revisionLabels := func(serviceType string) map[string]string {
+		return map[string]string{kserviceLabelKey: route.Name, serviceTypeLabelKey: serviceType}
+	}
+	private := producerService.DeepCopy()
+	private.Name, private.Labels = "orders-producer-00001-private", revisionLabels(privateServiceType)
+	privateEndpoints := producerEndpoints.DeepCopy()
+	privateEndpoints.Name, privateEndpoints.Labels = private.Name, private.Labels
+	public := producerService.DeepCopy()
+	public.Name, public.Labels = "orders-producer-00001", revisionLabels(publicServiceType)
+	publicEndpoints := producerEndpoints.DeepCopy()
+	publicEndpoints.Name, publicEndpoints.Labels = public.Name, public.Labels
+	publicEndpoints.Subsets[0].Addresses[0].IP = "10.0.0.9"
+	for _, obj := range []interface{}{route, private, public} {
+		services.Add(obj)
+	}
+	endpoints.Add(privateEndpoints)
+	endpoints.Add(publicEndpoints)
+	routeProducer := Producer{Name: route.Name, Namespace: route.Namespace}
+	routeSvc := MakeK8sService(ingSometimesAsync, ingressKourier, routeProducer, cfg)
+	routeSvc.Name = "orders-async"
+	if err := r.reconcileEndpoints(ctx, routeSvc); err != nil {
+		t.Fatalf("reconcileEndpoints() = %v", err)
+	}
+	mirrored, err := client.CoreV1().Endpoints(routeSvc.Namespace).Get(ctx, routeSvc.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get(endpoints) = %v", err)
+	}
+	if !equality.Semantic.DeepEqual(mirrored.Subsets, want) {
+		t.Errorf("Subsets = %+v, want the private endpoints of the revision %+v", mirrored.Subsets, want)
+	}
+	annotations := map[string]string{asyncProducerKServiceKey: route.Name}
+	if err := validateAsyncModeAnnotation(annotations, cfg); err != nil {
+		t.Errorf("validateAsyncModeAnnotation() = %v, want nil for a Knative Service producer", err)
+	}
+
+	// Only the endpoints of producers enqueue the generated services mirroring them.
+	generated := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{producerIndex: producerIndexFunc})
+	generated.Add(svc)
+	generated.Add(routeSvc)
+	for _, test := range []struct {
+		endpoints *corev1.Endpoints
+		want      string
+	}{
+		{endpoints: producerEndpoints, want: svc.Name},
+		{endpoints: privateEndpoints, want: routeSvc.Name},
+		{endpoints: &corev1.Endpoints{ObjectMeta: metav1.ObjectMeta{Name: "activator", Namespace: producer.Namespace}}},
+	} {
+		var got string
+		for _, obj := range mirroringServices(generated, test.endpoints) {
+			got = obj.(*corev1.Service).Name
+		}
+		if got != test.want {
+			t.Errorf("mirroringServices(%s) = %q, want %q", test.endpoints.Name, got, test.want)
+		}
+	}
+	isGenerated := generatedEndpointsFilter(corev1listers.NewServiceLister(generated))
+	if !isGenerated(created) {
+		t.Error("generatedEndpointsFilter() = false, want true for the endpoints of a generated service")
+	}
+	if isGenerated(producerEndpoints) {
+		t.Error("generatedEndpointsFilter() = true, want false for the endpoints of a producer")
+	}
+}
+
+func TestServiceIPFamilies(t *testing.T) {
+	producer := defaultProducer()
+	clusterIP := &Config{ProducerServiceType: clusterIPServiceType}
+	dualStack := &Config{
+		ProducerServiceType:   clusterIPServiceType,
+		ServiceIPFamilyPolicy: string(corev1.IPFamilyPolicyPreferDualStack),
+		ServiceIPFamilies:     []string{"IPv6", "IPv4"},
+	}
+
+	if svc := MakeK8sService(ingSometimesAsync, ingressKourier, producer, clusterIP); svc.Spec.IPFamilyPolicy != nil || svc.Spec.IPFamilies != nil {
+		t.Errorf("IPFamilyPolicy, IPFamilies = %v, %v, want the cluster default", svc.Spec.IPFamilyPolicy, svc.Spec.IPFamilies)
+	}
+	svc := MakeK8sService(ingSometimesAsync, ingressKourier, producer, dualStack)
+	if svc.Spec.IPFamilyPolicy == nil || *svc.Spec.IPFamilyPolicy != corev1.IPFamilyPolicyPreferDualStack {
+		t.Errorf("IPFamilyPolicy = %v, want %s", svc.Spec.IPFamilyPolicy, corev1.IPFamilyPolicyPreferDualStack)
+	}
+	if want := []corev1.IPFamily{corev1.IPv6Protocol, corev1.IPv4Protocol}; !equality.Semantic.DeepEqual(svc.Spec.IPFamilies, want) {
+		t.Errorf("IPFamilies = %v, want %v", svc.Spec.IPFamilies, want)
+	}
+	externalName := *dualStack
+	externalName.ProducerServiceType = ""
+	if svc := MakeK8sService(ingSometimesAsync, ingressKourier, producer, &externalName); svc.Spec.IPFamilyPolicy != nil || svc.Spec.IPFamilies != nil {
+		t.Errorf("IPFamilyPolicy, IPFamilies = %v, %v, want none on an ExternalName service", svc.Spec.IPFamilyPolicy, svc.Spec.IPFamilies)
+	}
+
+	// The families defaulted by the cluster are only updated when they are configured.
+	for _, test := range []struct {
+		name       string
+		cfg        *Config
+		wantUpdate bool
+	}{{
+		name: "cluster default",
+		cfg:  clusterIP,
+	}, {
+		name:       "configured",
+		cfg:        dualStack,
+		wantUpdate: true,
+	}} {
+		t.Run(test.name, func(t *testing.T) {
+			desired := MakeK8sService(ingSometimesAsync, ingressKourier, producer, test.cfg)
+			spec := managedServiceSpec(desired.Spec)
+			hash, _ := specHash(&spec, nil)
+			existing := desired.DeepCopy()
+			existing.Annotations[specHashKey] = hash
+			singleStack := corev1.IPFamilyPolicySingleStack
+			existing.Spec.IPFamilyPolicy = &singleStack
+			existing.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv4Protocol}
+
+			ctx, _ := SetupFakeContext(t)
+			client := fakekubeclient.Get(ctx)
+			services := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			services.Add(existing)
+			if _, err := client.CoreV1().Services(existing.Namespace).Create(ctx, existing, metav1.CreateOptions{}); err != nil {
+				t.Fatalf("Create() = %v", err)
+			}
+			r := &Reconciler{
+				serviceLister:   corev1listers.NewServiceLister(services),
+				endpointsLister: corev1listers.NewEndpointsLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+				kubeclient:      client,
+				config:          *test.cfg,
+			}
+			if err := r.reconcileService(ctx, desired); err != nil {
+				t.Fatalf("reconcileService() = %v", err)
+			}
+			updated := false
+			for _, action := range client.Actions() {
+				if action.GetVerb() == "update" && action.GetResource().Resource == "services" {
+					updated = true
+				}
+			}
+			if updated != test.wantUpdate {
+				t.Errorf("updated = %v, want %v", updated, test.wantUpdate)
+			}
+			got, err := client.CoreV1().Services(existing.Namespace).Get(ctx, existing.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get() = %v", err)
+			}
+			want := existing.Spec.IPFamilies
+			if test.wantUpdate {
+				want = desired.Spec.IPFamilies
+			}
+			if !equality.Semantic.DeepEqual(got.Spec.IPFamilies, want) {
+				t.Errorf("IPFamilies = %v, want %v", got.Spec.IPFamilies, want)
+			}
+		})
+	}
+
+	for _, invalid := range []*Config{
+		{ServiceIPFamilyPolicy: "DualStack"},
+		{ServiceIPFamilies: []string{"IPv5"}},
+		{ServiceIPFamilies: []string{"IPv4", "IPv4"}},
+		{ServiceIPFamilyPolicy: string(corev1.IPFamilyPolicySingleStack), ServiceIPFamilies: []string{"IPv4", "IPv6"}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("Validate(%+v) = nil, want error", invalid)
+		}
+	}
+	if err := dualStack.Validate(); err != nil {
+		t.Errorf("Validate() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"knative.dev/pkg/system"
+)
+
+// gatewaySigningKeyName is the key of the gateway signing Secret holding the signing key.
+const gatewaySigningKeyName = "signing-key"
+
+// gatewaySigningError is returned when the gateway signing Secret is missing or has no
+// signing key, the ingresses wait until it is created.
+type gatewaySigningError struct {
+	message string
+}
+
+func (e *gatewaySigningError) Error() string {
+	return e.message
+}
+
+// generateConfig returns the config the objects of an ingress are generated with. It
+// carries the key of the gateway signing Secret, if one is configured.
+func (r *Reconciler) generateConfig() (*Config, error) {
+	if r.config.GatewaySigningSecret == "" {
+		return &r.config, nil
+	}
+	secret, err := r.secretLister.Secrets(system.Namespace()).Get(r.config.GatewaySigningSecret)
+	if apierrs.IsNotFound(err) {
+		return nil, &gatewaySigningError{fmt.Sprintf("The gateway signing secret %s/%s does not exist",
+			system.Namespace(), r.config.GatewaySigningSecret)}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get the gateway signing secret: %w", err)
+	}
+	key := secret.Data[gatewaySigningKeyName]
+	if len(key) == 0 {
+		return nil, &gatewaySigningError{fmt.Sprintf("The gateway signing secret %s/%s has no %s",
+			system.Namespace(), r.config.GatewaySigningSecret, gatewaySigningKeyName)}
+	}
+	cfg := r.config
+	cfg.gatewaySigningKey = string(key)
+	return &cfg, nil
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"time"
+)
+
+// staggerDelay returns the delay for the random value f in [0, 1), it never exceeds max.
+func staggerDelay(max time.Duration, f float64) time.Duration {
+	if max <= 0 || f <= 0 {
+		return 0
+	}
+	if f >= 1 {
+		return max
+	}
+	return time.Duration(f * float64(max))
+}
+
+// staggerChildUpdate waits a random delay of up to ChildUpdateJitter before a generated
+// ingress is written, so ingresses changing at once don't write at the same time.
+func (r *Reconciler) staggerChildUpdate(ctx context.Context) error {
+	if r.config.ChildUpdateJitter == 0 {
+		return nil
+	}
+	delay := staggerDelay(r.config.ChildUpdateJitter, r.random())
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-r.clock.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
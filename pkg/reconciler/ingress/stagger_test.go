@@ -0,0 +1,87 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestStaggerDelay(t *testing.T) {
+	max := 10 * time.Second
+	for _, f := range []float64{0, 0.25, 0.5, 0.999999, 1} {
+		if got := staggerDelay(max, f); got < 0 || got > max {
+			t.Errorf("staggerDelay(%v, %v) = %v, want between 0 and %v", max, f, got, max)
+		}
+	}
+	if got, want := staggerDelay(max, 0.5), 5*time.Second; got != want {
+		t.Errorf("staggerDelay(%v, 0.5) = %v, want %v", max, got, want)
+	}
+	if got := staggerDelay(0, 0.5); got != 0 {
+		t.Errorf("staggerDelay(0, 0.5) = %v, want 0 without jitter", got)
+	}
+}
+
+func TestStaggerChildUpdate(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+	r := &Reconciler{
+		config: Config{ChildUpdateJitter: 10 * time.Second},
+		clock:  fakeClock,
+		random: func() float64 { return 0.5 },
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.staggerChildUpdate(context.Background())
+	}()
+	if err := wait.PollImmediate(time.Millisecond, 5*time.Second, func() (bool, error) {
+		return fakeClock.HasWaiters(), nil
+	}); err != nil {
+		t.Fatal("staggerChildUpdate() is not waiting on the clock")
+	}
+
+	fakeClock.Step(4 * time.Second)
+	select {
+	case err := <-done:
+		t.Fatalf("staggerChildUpdate() = %v before the delay elapsed", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	fakeClock.Step(time.Second)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("staggerChildUpdate() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("staggerChildUpdate() did not return after the delay")
+	}
+}
+
+func TestStaggerChildUpdateCanceled(t *testing.T) {
+	r := &Reconciler{
+		config: Config{ChildUpdateJitter: time.Hour},
+		clock:  clock.NewFakeClock(time.Now()),
+		random: func() float64 { return 0.5 },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.staggerChildUpdate(ctx); err != context.Canceled {
+		t.Errorf("staggerChildUpdate() = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2020 The Knative Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingress
+
+import (
+	"fmt"
+	"strconv"
+
+	"knative.dev/networking/pkg/apis/networking/v1alpha1"
+	"knative.dev/pkg/kmeta"
+)
+
+// asyncPercentKey sets the percent of the requests of always mode paths routed to the
+// producer, the others are routed to the backends of the path. It defaults to 100.
+const asyncPercentKey = "async.knative.dev/async-percent"
+
+// parseAsyncPercent returns the async percent of the annotations, 100 if it isn't set.
+func parseAsyncPercent(annotations map[string]string) (int, error) {
+	value, ok := annotations[asyncPercentKey]
+	if !ok {
+		return 100, nil
+	}
+	percent, err := strconv.Atoi(value)
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("%q is not a percent between 0 and 100", value)
+	}
+	return percent, nil
+}
+
+// weightedProducerPath returns a copy of the path routing percent of its requests to the
+// producer and the others to the backends of the path, keeping the ratio between them.
+// Only the producer split carries the producer headers. The host is rewritten per path,
+// not per split, so the path keeps the host of the source path for both.
+func weightedProducerPath(path, producer v1alpha1.HTTPIngressPath, percent int) v1alpha1.HTTPIngressPath {
+	weighted := *path.DeepCopy()
+	weighted.Splits = scaleSplits(weighted.Splits, 100-percent)
+	if percent == 0 {
+		return weighted
+	}
+	producerSplit := *producer.Splits[0].DeepCopy()
+	producerSplit.Percent = percent
+	producerSplit.AppendHeaders = kmeta.UnionMaps(producerSplit.AppendHeaders, producer.AppendHeaders)
+	weighted.Splits = append(weighted.Splits, producerSplit)
+	return weighted
+}
+
+// scaleSplits scales the percents of the splits to total percent. The percent lost to
+// rounding down goes to the last split, so the percents total exactly percent.
+func scaleSplits(splits []v1alpha1.IngressBackendSplit, percent int) []v1alpha1.IngressBackendSplit {
+	if len(splits) == 1 && splits[0].Percent == 0 {
+		splits[0].Percent = 100
+	}
+	total := 0
+	for i := range splits {
+		splits[i].Percent = splits[i].Percent * percent / 100
+		total += splits[i].Percent
+	}
+	if len(splits) > 0 {
+		splits[len(splits)-1].Percent += percent - total
+	}
+	return splits
+}